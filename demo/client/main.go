@@ -4,13 +4,12 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"io"
 	"sync"
 
-	"github.com/quic-go/quic-go"
 	"github.com/stonefire-oss/stonefire-im/demo/pb"
-	"github.com/stonefire-oss/stonefire-im/pkg/codec"
 	"github.com/stonefire-oss/stonefire-im/qrpc"
-	"google.golang.org/protobuf/proto"
+	"google.golang.org/grpc"
 )
 
 const addr = "localhost:4242"
@@ -28,25 +27,25 @@ func clientMain() error {
 		InsecureSkipVerify: true,
 		NextProtos:         []string{"quic-echo-example"},
 	}
-	conn, err := quic.DialAddr(context.Background(), addr, tlsConf, nil)
+	conn, err := qrpc.Dial(context.Background(), addr, tlsConf,
+		qrpc.WithDefaultCallOptions(grpc.UseCompressor("gzip")))
 	if err != nil {
 		return err
 	}
-	defer conn.CloseWithError(0, "")
+	defer conn.Close()
 
-	stream, err := conn.OpenStreamSync(context.Background())
-	uany(stream)
-
-	if stream2, err := conn.OpenStreamSync(context.Background()); err != nil {
+	client := pb.NewStudentServiceClient(conn)
+	if err := unary(client); err != nil {
 		return err
-	} else {
-		testStream(stream2)
 	}
-	return err
+	return testStream(client)
 }
 
-func testStream(stream quic.Stream) {
-	defer stream.Close()
+func testStream(client pb.StudentServiceClient) error {
+	stream, err := client.Hello(context.Background())
+	if err != nil {
+		return err
+	}
 
 	var (
 		wg sync.WaitGroup
@@ -62,32 +61,31 @@ func testStream(stream quic.Stream) {
 	}()
 
 	wg.Wait()
+	return nil
 }
 
-func read(stream quic.Stream, wg *sync.WaitGroup) error {
+func read(stream pb.StudentService_HelloClient, wg *sync.WaitGroup) error {
 	defer func() {
 		wg.Done()
 	}()
 	for {
-		msg, err := codec.DecodeOneMessage(stream, codec.SlicePayloadBuiler{})
+		echo, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
 		if err != nil {
 			fmt.Printf("%v\n", err)
 			return err
 		}
-
-		if ack, ok := msg.(*codec.Publish); ok && ack.Payload != nil {
-			sack := pb.Echo{}
-			qrpc.DecodePayload(&sack, ack.Payload, ack.Compressed)
-			qrpc.FreePayload(ack)
-			fmt.Printf("%s%n %V\n", sack.Name, err)
-		}
+		fmt.Printf("%s %s\n", echo.Name, echo.Msg)
 	}
 }
 
-func write(stream quic.Stream, wg *sync.WaitGroup) error {
+func write(stream pb.StudentService_HelloClient, wg *sync.WaitGroup) error {
 	defer func() {
 		wg.Done()
 	}()
+	defer stream.CloseSend()
 
 	stu := pb.Student{
 		Male:   true,
@@ -96,62 +94,24 @@ func write(stream quic.Stream, wg *sync.WaitGroup) error {
 
 	for i := 0; i < 10; i++ {
 		stu.Name = fmt.Sprintf("%s %d", "helloword", i)
-		c, err := qrpc.EncodePayload(&stu, true)
-		if err != nil {
+		if err := stream.Send(&stu); err != nil {
 			return err
 		}
-		h := codec.Header{
-			AckRequired: true,
-			Compressed:  true,
-		}
-		psu := codec.Publish{
-			Header:  h,
-			Path:    "/pb.StudentService/Hello",
-			Payload: c,
-		}
-		psu.Encode(stream)
-		c.Free()
 	}
 	return nil
 }
 
-func uany(stream quic.Stream) error {
+func unary(client pb.StudentServiceClient) error {
 	stu := pb.Student{
 		Name:   "hello",
 		Male:   true,
 		Scores: []int32{0, 1, 2},
 	}
-	defer stream.Close()
-	c, err := proto.Marshal(&stu)
+	res, err := client.CreateStudent(context.Background(), &stu)
 	if err != nil {
+		fmt.Printf("%v\n", err)
 		return err
 	}
-
-	h := codec.Header{
-		AckRequired: true,
-	}
-	psu := codec.Publish{
-		Header:  h,
-		Path:    "/pb.StudentService/CreateStudents",
-		Payload: codec.SlicePayload(c),
-	}
-	psu.Encode(stream)
-	msg, err := codec.DecodeOneMessage(stream, codec.SlicePayloadBuiler{})
-	if ack, ok := msg.(*codec.PubAck); ok {
-		if ack.Payload != nil {
-			sack := pb.Result{}
-			qrpc.DecodePayload(&sack, ack.Payload, ack.Compressed)
-			qrpc.FreePayload(ack)
-			fmt.Printf("%s%n %V\n", sack.Message, err)
-		} else {
-			if ack.Status.Code != 0 {
-				fmt.Printf("%d\n", ack.Status.Code)
-			}
-		}
-
-	}
-	if err != nil {
-		fmt.Printf("%V\n", err)
-	}
+	fmt.Printf("%d %s\n", res.Code, res.Message)
 	return nil
 }
@@ -8,6 +8,10 @@ import (
 	"crypto/x509"
 	"encoding/pem"
 	"math/big"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/quic-go/quic-go"
 	"github.com/stonefire-oss/stonefire-im/demo/pb"
@@ -48,8 +52,21 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	defer listener.Close()
-	s.Serve(listener)
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		<-sig
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		s.GracefulStop(ctx)
+	}()
+	if err := s.Serve(listener); err != nil {
+		panic(err)
+	}
+	<-stopped
 }
 
 func generateTLSConfig() *tls.Config {
@@ -0,0 +1,98 @@
+// Package broker routes the messages published on topics to the subscribers
+// whose topic filters match them, the MQTT way.
+//
+// A topic is a list of levels separated by '/'. A topic filter may use two
+// wildcards, each of which takes a whole level: '+' matches any single level
+// and '#', which must be the last level, matches any number of levels,
+// including none. Wildcards at the first level of a filter do not match the
+// topics starting with '$', which are reserved for the server.
+//
+// A filter of the form $share/{group}/{filter} subscribes to filter as a
+// member of a shared subscription group, which gets every message once
+// instead of every member getting it. Which member does is up to the server.
+package broker
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	separator      = "/"
+	singleWildcard = "+"
+	multiWildcard  = "#"
+
+	// SharePrefix starts the filters of the shared subscriptions.
+	SharePrefix = "$share/"
+)
+
+var (
+	ErrInvalidTopic  = errors.New("broker: invalid topic")
+	ErrInvalidFilter = errors.New("broker: invalid topic filter")
+)
+
+// ValidTopic reports whether topic can be published on: it is not empty and
+// holds no wildcard.
+func ValidTopic(topic string) bool {
+	return topic != "" && !strings.ContainsAny(topic, singleWildcard+multiWildcard)
+}
+
+// ValidFilter reports whether filter is a valid topic filter, shared or not.
+// The group of a shared subscription is a single level without wildcard.
+func ValidFilter(filter string) bool {
+	if group, f := SplitShared(filter); group != "" {
+		return !strings.ContainsAny(group, singleWildcard+multiWildcard) && validFilter(f)
+	}
+	return !strings.HasPrefix(filter, SharePrefix) && validFilter(filter)
+}
+
+// SplitShared returns the group and topic filter of a shared subscription
+// filter, an empty group if filter is not one.
+func SplitShared(filter string) (group, topicFilter string) {
+	rest, ok := strings.CutPrefix(filter, SharePrefix)
+	if !ok {
+		return "", filter
+	}
+	group, topicFilter, ok = strings.Cut(rest, separator)
+	if !ok || group == "" {
+		return "", filter
+	}
+	return group, topicFilter
+}
+
+func validFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+	levels := strings.Split(filter, separator)
+	for i, l := range levels {
+		switch {
+		case l == multiWildcard:
+			if i != len(levels)-1 {
+				return false
+			}
+		case l == singleWildcard:
+		case strings.ContainsAny(l, singleWildcard+multiWildcard):
+			return false
+		}
+	}
+	return true
+}
+
+// Match reports whether topic matches filter.
+func Match(filter, topic string) bool {
+	fl := strings.Split(filter, separator)
+	tl := strings.Split(topic, separator)
+	if strings.HasPrefix(topic, "$") && (fl[0] == singleWildcard || fl[0] == multiWildcard) {
+		return false
+	}
+	for i, l := range fl {
+		if l == multiWildcard {
+			return true
+		}
+		if i >= len(tl) || (l != singleWildcard && l != tl[i]) {
+			return false
+		}
+	}
+	return len(fl) == len(tl)
+}
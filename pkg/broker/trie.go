@@ -0,0 +1,125 @@
+package broker
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/stonefire-oss/stonefire-im/pkg/codec"
+)
+
+// Trie holds the topic filters of subscribers identified by K, indexed by
+// level so that the subscribers of a topic are found without going through
+// every filter. It is safe for concurrent use.
+type Trie[K comparable] struct {
+	mu   sync.RWMutex
+	root *node[K]
+}
+
+type node[K comparable] struct {
+	children map[string]*node[K]
+	subs     map[K]codec.QosLevel
+}
+
+func newNode[K comparable]() *node[K] {
+	return &node[K]{children: make(map[string]*node[K])}
+}
+
+// NewTrie returns an empty Trie.
+func NewTrie[K comparable]() *Trie[K] {
+	return &Trie[K]{root: newNode[K]()}
+}
+
+// Subscribe adds the subscription of sub to filter with qos, replacing the
+// QoS of an existing one.
+func (t *Trie[K]) Subscribe(filter string, sub K, qos codec.QosLevel) error {
+	if !ValidFilter(filter) {
+		return ErrInvalidFilter
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := t.root
+	for _, l := range strings.Split(filter, separator) {
+		c, ok := n.children[l]
+		if !ok {
+			c = newNode[K]()
+			n.children[l] = c
+		}
+		n = c
+	}
+	if n.subs == nil {
+		n.subs = make(map[K]codec.QosLevel)
+	}
+	n.subs[sub] = qos
+	return nil
+}
+
+// Unsubscribe removes the subscription of sub to filter. It reports whether
+// there was one.
+func (t *Trie[K]) Unsubscribe(filter string, sub K) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.remove(t.root, strings.Split(filter, separator), sub)
+}
+
+// remove removes the subscription below n and prunes the nodes left empty.
+func (t *Trie[K]) remove(n *node[K], levels []string, sub K) bool {
+	if len(levels) == 0 {
+		if _, ok := n.subs[sub]; !ok {
+			return false
+		}
+		delete(n.subs, sub)
+		return true
+	}
+	c, ok := n.children[levels[0]]
+	if !ok || !t.remove(c, levels[1:], sub) {
+		return false
+	}
+	if len(c.subs) == 0 && len(c.children) == 0 {
+		delete(n.children, levels[0])
+	}
+	return true
+}
+
+// Match returns the subscribers with a filter matching topic, each with the
+// highest QoS among its matching subscriptions.
+func (t *Trie[K]) Match(topic string) map[K]codec.QosLevel {
+	subs := make(map[K]codec.QosLevel)
+	levels := strings.Split(topic, separator)
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if strings.HasPrefix(topic, "$") {
+		// Wildcards do not match the first level of reserved topics.
+		if c, ok := t.root.children[levels[0]]; ok {
+			c.match(levels[1:], subs)
+		}
+		return subs
+	}
+	t.root.match(levels, subs)
+	return subs
+}
+
+func (n *node[K]) match(levels []string, subs map[K]codec.QosLevel) {
+	if c, ok := n.children[multiWildcard]; ok {
+		c.collect(subs)
+	}
+	if len(levels) == 0 {
+		n.collect(subs)
+		return
+	}
+	if c, ok := n.children[singleWildcard]; ok {
+		c.match(levels[1:], subs)
+	}
+	if c, ok := n.children[levels[0]]; ok {
+		c.match(levels[1:], subs)
+	}
+}
+
+func (n *node[K]) collect(subs map[K]codec.QosLevel) {
+	for k, q := range n.subs {
+		if cur, ok := subs[k]; !ok || q > cur {
+			subs[k] = q
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package broker
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/stonefire-oss/stonefire-im/pkg/codec"
+)
+
+func TestValidFilter(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   bool
+	}{
+		{"room/1/msg", true},
+		{"room/+/msg", true},
+		{"room/#", true},
+		{"#", true},
+		{"+", true},
+		{"/", true},
+		{"", false},
+		{"room/#/msg", false},
+		{"room/a+", false},
+		{"room/#a", false},
+		{"$share/workers/room/+/msg", true},
+		{"$share/workers/#", true},
+		{"$share/workers/", false},
+		{"$share/workers", false},
+		{"$share//room", false},
+		{"$share/a+/room", false},
+	}
+	for _, tt := range tests {
+		if got := ValidFilter(tt.filter); got != tt.want {
+			t.Errorf("ValidFilter(%q) = %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestSplitShared(t *testing.T) {
+	tests := []struct {
+		filter      string
+		group, want string
+	}{
+		{"$share/workers/room/+/msg", "workers", "room/+/msg"},
+		{"$share/workers/#", "workers", "#"},
+		{"room/+/msg", "", "room/+/msg"},
+		{"$share/workers", "", "$share/workers"},
+		{"$sharex/workers/room", "", "$sharex/workers/room"},
+	}
+	for _, tt := range tests {
+		group, got := SplitShared(tt.filter)
+		if group != tt.group || got != tt.want {
+			t.Errorf("SplitShared(%q) = %q, %q, want %q, %q", tt.filter, group, got, tt.group, tt.want)
+		}
+	}
+}
+
+type subscription struct {
+	filter string
+	sub    string
+	qos    codec.QosLevel
+}
+
+func TestTrie_Match(t *testing.T) {
+	subs := []subscription{
+		{"room/1/msg", "exact", codec.QosAtLeastOnce},
+		{"room/+/msg", "single", codec.QosAtMostOnce},
+		{"room/#", "multi", codec.QosAtLeastOnce},
+		{"#", "all", codec.QosAtMostOnce},
+		{"room/+", "single", codec.QosAtLeastOnce},
+		{"$sys/#", "sys", codec.QosAtMostOnce},
+	}
+	tr := NewTrie[string]()
+	for _, s := range subs {
+		if err := tr.Subscribe(s.filter, s.sub, s.qos); err != nil {
+			t.Fatalf("Subscribe(%q) error = %v", s.filter, err)
+		}
+	}
+
+	tests := []struct {
+		topic string
+		want  map[string]codec.QosLevel
+	}{
+		{"room/1/msg", map[string]codec.QosLevel{"exact": 1, "single": 0, "multi": 1, "all": 0}},
+		{"room/2/msg", map[string]codec.QosLevel{"single": 0, "multi": 1, "all": 0}},
+		// The highest QoS of the matching subscriptions wins.
+		{"room/2", map[string]codec.QosLevel{"single": 1, "multi": 1, "all": 0}},
+		// '#' matches the parent level too.
+		{"room", map[string]codec.QosLevel{"multi": 1, "all": 0}},
+		{"feed/1", map[string]codec.QosLevel{"all": 0}},
+		{"$sys/load", map[string]codec.QosLevel{"sys": 0}},
+	}
+	for _, tt := range tests {
+		got := tr.Match(tt.topic)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Match(%q) = %v, want %v", tt.topic, got, tt.want)
+		}
+		// Match agrees with the trie.
+		for sub := range tt.want {
+			matched := func(s subscription) bool { return s.sub == sub && Match(s.filter, tt.topic) }
+			if !slices.ContainsFunc(subs, matched) {
+				t.Errorf("no filter of %s Matches %q", sub, tt.topic)
+			}
+		}
+	}
+}
+
+func TestTrie_Unsubscribe(t *testing.T) {
+	tr := NewTrie[string]()
+	tr.Subscribe("room/+/msg", "a", codec.QosAtLeastOnce)
+	tr.Subscribe("room/+/msg", "b", codec.QosAtLeastOnce)
+
+	if !tr.Unsubscribe("room/+/msg", "a") {
+		t.Error("Unsubscribe() = false, want true")
+	}
+	if tr.Unsubscribe("room/+/msg", "a") {
+		t.Error("second Unsubscribe() = true, want false")
+	}
+	if got := tr.Match("room/1/msg"); !reflect.DeepEqual(got, map[string]codec.QosLevel{"b": 1}) {
+		t.Errorf("Match() = %v", got)
+	}
+
+	tr.Unsubscribe("room/+/msg", "b")
+	if len(tr.root.children) != 0 {
+		t.Errorf("empty nodes left after the last Unsubscribe: %v", tr.root.children)
+	}
+}
@@ -3,6 +3,7 @@ package codec
 import (
 	"errors"
 	"io"
+	"strconv"
 )
 
 var (
@@ -11,6 +12,7 @@ var (
 	errBadReturnCode     = errors.New("codec: is invalid")
 	errDataExceedsPacket = errors.New("codec: data exceeds packet length")
 	errMsgTooLong        = errors.New("codec: message is too long")
+	errDecodeCopy        = errors.New("codec: the copy of a PublishFrame cannot be decoded")
 )
 
 const (
@@ -18,16 +20,54 @@ const (
 	QosAtLeastOnce
 
 	qosFirstInvalid
+
+	// QosFailure is granted by a SubAck for a topic filter which was refused.
+	QosFailure = QosLevel(0x80)
 )
 
 type QosLevel uint8
 
 type ReturnCode uint8
 
+// ReturnCode constants carried by ConnAck.
+const (
+	RetCodeAccepted = ReturnCode(iota)
+	RetCodeUnacceptableProtocolVersion
+	RetCodeIdentifierRejected
+	RetCodeServerUnavailable
+	RetCodeBadUsernameOrPassword
+	RetCodeNotAuthorized
+	RetCodeClientIdInUse
+	RetCodeBadWill
+)
+
 func (rc ReturnCode) IsValid() bool {
 	return true
 }
 
+func (rc ReturnCode) String() string {
+	switch rc {
+	case RetCodeAccepted:
+		return "connection accepted"
+	case RetCodeUnacceptableProtocolVersion:
+		return "unacceptable protocol version"
+	case RetCodeIdentifierRejected:
+		return "identifier rejected"
+	case RetCodeServerUnavailable:
+		return "server unavailable"
+	case RetCodeBadUsernameOrPassword:
+		return "bad user name or password"
+	case RetCodeNotAuthorized:
+		return "not authorized"
+	case RetCodeClientIdInUse:
+		return "client identifier in use"
+	case RetCodeBadWill:
+		return "malformed will"
+	default:
+		return "unknown return code " + strconv.Itoa(int(rc))
+	}
+}
+
 func (qos QosLevel) IsValid() bool {
 	return qos < qosFirstInvalid
 }
@@ -74,6 +114,14 @@ func newMessage(msgType MessageType) (msg Message, err error) {
 		msg = new(PingAck)
 	case MsgDisconnect:
 		msg = new(Disconnect)
+	case MsgSubscribe:
+		msg = new(Subscribe)
+	case MsgSubAck:
+		msg = new(SubAck)
+	case MsgUnsubscribe:
+		msg = new(Unsubscribe)
+	case MsgUnsubAck:
+		msg = new(UnsubAck)
 	default:
 		return nil, errBadMsgType
 	}
@@ -33,10 +33,30 @@ func makePublish() *testCase {
 	}
 }
 
+func makeRetainedPublish() *testCase {
+	pub := Publish{
+		Header:  Header{Retain: true, DupFlag: true},
+		Path:    "rooms/1/topic",
+		Payload: SlicePayload([]byte("abcd")),
+		Props:   Props{},
+	}
+
+	buf := new(bytes.Buffer)
+	pub.Encode(buf)
+	return &testCase{
+		name:    "retained publish",
+		reader:  buf,
+		wantMsg: &pub,
+		wantErr: false,
+	}
+}
+
 func makePubAck() *testCase {
 	pub := PubAck{
 		Header:  Header{AckRequired: true},
 		Status:  Status{Code: 127, Message: "OK"},
+		Props:   Props{"a": {"a"}},
+		Trailer: Props{"b": {"b", "c"}},
 		Payload: SlicePayload([]byte("abcd")),
 	}
 
@@ -145,6 +165,64 @@ func makeDiscon() *testCase {
 	}
 }
 
+func makeSubscribe() *testCase {
+	sub := Subscribe{
+		Header:    Header{AckRequired: true},
+		MessageId: 7,
+		Topics: []TopicQos{
+			{Topic: "room/+/msg", Qos: QosAtLeastOnce},
+			{Topic: "feed/#", Qos: QosAtMostOnce},
+		},
+	}
+	buf := new(bytes.Buffer)
+	sub.Encode(buf)
+	return &testCase{
+		name:    "Subscribe",
+		reader:  buf,
+		wantMsg: &sub,
+	}
+}
+
+func makeSubAck() *testCase {
+	ack := SubAck{
+		MessageId: 7,
+		TopicsQos: []QosLevel{QosAtLeastOnce, QosFailure},
+	}
+	buf := new(bytes.Buffer)
+	ack.Encode(buf)
+	return &testCase{
+		name:    "SubAck",
+		reader:  buf,
+		wantMsg: &ack,
+	}
+}
+
+func makeUnsubscribe() *testCase {
+	unsub := Unsubscribe{
+		Header:    Header{AckRequired: true},
+		MessageId: 8,
+		Topics:    []string{"room/+/msg", "feed/#"},
+	}
+	buf := new(bytes.Buffer)
+	unsub.Encode(buf)
+	return &testCase{
+		name:    "Unsubscribe",
+		reader:  buf,
+		wantMsg: &unsub,
+	}
+}
+
+func makeUnsubAck() *testCase {
+	ack := UnsubAck{MessageId: 8}
+	buf := new(bytes.Buffer)
+	ack.Encode(buf)
+	return &testCase{
+		name:    "UnsubAck",
+		reader:  buf,
+		wantMsg: &ack,
+	}
+}
+
 func TestDecodeOneMessage(t *testing.T) {
 	type args struct {
 		r io.Reader
@@ -152,12 +230,17 @@ func TestDecodeOneMessage(t *testing.T) {
 
 	tests := []*testCase{
 		makePublish(),
+		makeRetainedPublish(),
 		makeConn(),
 		makePubAck(),
 		makePing(),
 		makePingAck(),
 		makeConnAck(),
 		makeDiscon(),
+		makeSubscribe(),
+		makeSubAck(),
+		makeUnsubscribe(),
+		makeUnsubAck(),
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -172,3 +255,99 @@ func TestDecodeOneMessage(t *testing.T) {
 		})
 	}
 }
+
+func TestEncodeHead(t *testing.T) {
+	tests := []*testCase{
+		makePublish(),
+		makePubAck(),
+		makePing(),
+		makeDiscon(),
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			head, pl, err := EncodeHead(tt.wantMsg)
+			if err != nil {
+				t.Fatalf("EncodeHead() error = %v", err)
+			}
+			frame := append([]byte(nil), head...)
+			if pl != nil {
+				frame = append(frame, pl.ReadOnlyData()...)
+			}
+			// Props are encoded in map order, the frames are compared once
+			// decoded.
+			got, err := DecodeOneMessage(bytes.NewReader(frame), SlicePayloadBuiler{})
+			if err != nil {
+				t.Fatalf("DecodeOneMessage() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.wantMsg) {
+				t.Errorf("EncodeHead() frame = %v, want %v", got, tt.wantMsg)
+			}
+		})
+	}
+}
+
+func TestPublishFrame(t *testing.T) {
+	tests := []struct {
+		name string
+		pub  Publish
+		id   uint16
+		dup  bool
+	}{
+		{
+			name: "ack required",
+			pub: Publish{
+				Header:  Header{AckRequired: true, Compressed: true},
+				Path:    "/path/b",
+				Payload: SlicePayload([]byte("abcd")),
+				Props:   Props{"a": {"a"}},
+			},
+			id: 0x1234,
+		},
+		{
+			name: "dup",
+			pub: Publish{
+				Header: Header{AckRequired: true, Retain: true},
+				Path:   "rooms/1",
+				Props:  Props{},
+			},
+			id:  7,
+			dup: true,
+		},
+		{
+			name: "at most once",
+			pub: Publish{
+				Path:    "/path/c",
+				Payload: SlicePayload([]byte("abcd")),
+				Props:   Props{},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := NewPublishFrame(&tt.pub)
+			if err != nil {
+				t.Fatalf("NewPublishFrame() error = %v", err)
+			}
+			// The copies do not change the frame, each one is
+			// decoded twice.
+			for range 2 {
+				buf := new(bytes.Buffer)
+				if err := f.Copy(tt.id, tt.dup).Encode(buf); err != nil {
+					t.Fatalf("Encode() error = %v", err)
+				}
+				got, err := DecodeOneMessage(buf, SlicePayloadBuiler{})
+				if err != nil {
+					t.Fatalf("DecodeOneMessage() error = %v", err)
+				}
+				want := tt.pub
+				want.DupFlag = tt.dup
+				if want.AckRequired {
+					want.MessageId = tt.id
+				}
+				if !reflect.DeepEqual(got, &want) {
+					t.Errorf("Copy() = %+v, want %+v", got, &want)
+				}
+			}
+		})
+	}
+}
@@ -15,6 +15,9 @@ const (
 type Header struct {
 	DupFlag                 bool
 	Compressed, AckRequired bool
+	// Retain asks the broker to keep a Publish on a topic for the later
+	// subscribers, and marks the Publish it sends them.
+	Retain bool
 }
 
 func (hdr *Header) Encode(w io.Writer, msgType MessageType, remainingLength int32) error {
@@ -33,6 +36,7 @@ func (hdr *Header) encodeInto(buf *bytes.Buffer, msgType MessageType, remainingL
 	}
 
 	val := byte(msgType) << 4
+	val |= (boolToByte(hdr.Retain) << 3)
 	val |= (boolToByte(hdr.DupFlag) << 2)
 	val |= (boolToByte(hdr.AckRequired) << 1)
 	val |= boolToByte(hdr.Compressed)
@@ -56,6 +60,7 @@ func (hdr *Header) Decode(r io.Reader) (msgType MessageType, remainingLength int
 	msgType = MessageType(b & 0xF0 >> 4)
 
 	*hdr = Header{
+		Retain:      b&0x08 > 0,
 		DupFlag:     b&0x04 > 0,
 		AckRequired: b&0x02 > 0,
 		Compressed:  b&0x01 > 0,
@@ -75,6 +80,10 @@ const (
 	MsgPingReq
 	MsgPingResp
 	MsgDisconnect
+	MsgSubscribe
+	MsgSubAck
+	MsgUnsubscribe
+	MsgUnsubAck
 
 	msgTypeFirstInvalid
 )
@@ -115,6 +124,16 @@ func (p Props) Decode(r io.Reader, packetRemaining *int32) error {
 	return nil
 }
 
+// decodeOptionalProps decodes Props which are left nil when empty.
+func decodeOptionalProps(r io.Reader, packetRemaining *int32) Props {
+	p := make(Props)
+	p.Decode(r, packetRemaining)
+	if len(p) == 0 {
+		return nil
+	}
+	return p
+}
+
 type Status struct {
 	Code    uint8
 	Message string
@@ -196,6 +215,52 @@ func (mt MessageType) IsValid() bool {
 	return mt >= MsgConnect && mt < msgTypeFirstInvalid
 }
 
+// headEncoder is implemented by the messages carrying a payload. encodeHead
+// writes the frame up to the payload, which follows it on the wire.
+type headEncoder interface {
+	encodeHead(w io.Writer) error
+}
+
+// EncodeHead encodes msg apart from its payload, so that the payload can be
+// written along with the head without being copied. The frame is the head
+// followed by the payload, which is nil for messages without one.
+func EncodeHead(msg Message) ([]byte, Payload, error) {
+	buf := new(bytes.Buffer)
+	he, ok := msg.(headEncoder)
+	if !ok {
+		err := msg.Encode(buf)
+		return buf.Bytes(), nil, err
+	}
+	if err := he.encodeHead(buf); err != nil {
+		return nil, nil, err
+	}
+	return buf.Bytes(), msg.(PayloadContainer).GetPayload(), nil
+}
+
+// encodeWithPayload writes the head of msg then pl. It takes two Write calls,
+// concurrent writers have to be serialized by the caller.
+func encodeWithPayload(w io.Writer, msg headEncoder, pl Payload) error {
+	buf := new(bytes.Buffer)
+	if err := msg.encodeHead(buf); err != nil {
+		return err
+	}
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if pl != nil && pl.Len() > 0 {
+		_, err := w.Write(pl.ReadOnlyData())
+		return err
+	}
+	return nil
+}
+
+func payloadLen(pl Payload) int32 {
+	if pl == nil {
+		return 0
+	}
+	return int32(pl.Len())
+}
+
 func writeMessage(w io.Writer, msgType MessageType, hdr *Header, payloadBuf *bytes.Buffer, extraLength int32) error {
 	totalPayloadLength := int64(len(payloadBuf.Bytes())) + int64(extraLength)
 	if totalPayloadLength > MaxPayloadSize {
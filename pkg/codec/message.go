@@ -14,6 +14,10 @@ type Publish struct {
 }
 
 func (msg *Publish) Encode(w io.Writer) (err error) {
+	return encodeWithPayload(w, msg, msg.Payload)
+}
+
+func (msg *Publish) encodeHead(w io.Writer) error {
 	buf := new(bytes.Buffer)
 
 	setString(msg.Path, buf)
@@ -22,18 +26,7 @@ func (msg *Publish) Encode(w io.Writer) (err error) {
 	}
 	msg.Props.Encode(buf)
 
-	var pl int32 = 0
-	if msg.Payload != nil {
-		pl = int32(msg.Payload.Len())
-	}
-	if err = writeMessage(w, MsgPublish, &msg.Header, buf, pl); err != nil {
-		return
-	}
-
-	if msg.Payload != nil {
-		_, err = w.Write(msg.Payload.ReadOnlyData())
-	}
-	return
+	return writeMessage(w, MsgPublish, &msg.Header, buf, payloadLen(msg.Payload))
 }
 
 func (msg *Publish) Decode(r io.Reader, hdr Header, packetRemaining int32, builder PayloadBuilder) (err error) {
@@ -70,32 +63,111 @@ func (msg *Publish) SetPayload(p Payload) {
 	msg.Payload = p
 }
 
+// PublishFrame is a Publish encoded once to be sent several times, to
+// several peers, each copy with its own MessageId and DupFlag which are
+// patched into the encoded head. The payload is shared by the copies, it is
+// not copied.
+type PublishFrame struct {
+	head []byte
+	// idOff is the offset of the MessageId in head, -1 without
+	// AckRequired.
+	idOff   int
+	Payload Payload
+}
+
+// NewPublishFrame encodes msg, apart from its MessageId and DupFlag.
+func NewPublishFrame(msg *Publish) (*PublishFrame, error) {
+	vh := new(bytes.Buffer)
+	setString(msg.Path, vh)
+	idOff := -1
+	if msg.Header.AckRequired {
+		idOff = vh.Len()
+		setUint16(0, vh)
+	}
+	msg.Props.Encode(vh)
+
+	hdr := msg.Header
+	hdr.DupFlag = false
+	buf := new(bytes.Buffer)
+	if err := writeMessage(buf, MsgPublish, &hdr, vh, payloadLen(msg.Payload)); err != nil {
+		return nil, err
+	}
+	f := &PublishFrame{head: buf.Bytes(), idOff: idOff, Payload: msg.Payload}
+	if idOff >= 0 {
+		f.idOff += buf.Len() - vh.Len()
+	}
+	return f, nil
+}
+
+// Copy returns the copy of f with id and dup, to be written with EncodeHead.
+// The copies of a frame can be used concurrently.
+func (f *PublishFrame) Copy(id uint16, dup bool) Message {
+	return &publishCopy{frame: f, id: id, dup: dup}
+}
+
+type publishCopy struct {
+	frame *PublishFrame
+	id    uint16
+	dup   bool
+}
+
+func (msg *publishCopy) Encode(w io.Writer) error {
+	return encodeWithPayload(w, msg, msg.frame.Payload)
+}
+
+func (msg *publishCopy) encodeHead(w io.Writer) error {
+	head := append([]byte(nil), msg.frame.head...)
+	if msg.dup {
+		head[0] |= 1 << 2
+	}
+	if off := msg.frame.idOff; off >= 0 {
+		head[off] = byte(msg.id >> 8)
+		head[off+1] = byte(msg.id)
+	}
+	_, err := w.Write(head)
+	return err
+}
+
+func (msg *publishCopy) Decode(io.Reader, Header, int32, PayloadBuilder) error {
+	return errDecodeCopy
+}
+
+func (msg *publishCopy) String() string {
+	return "Publish"
+}
+
+func (msg *publishCopy) GetPayload() Payload {
+	return msg.frame.Payload
+}
+
+// SetPayload does nothing, the payload belongs to the frame.
+func (msg *publishCopy) SetPayload(Payload) {}
+
+// PubAck answers a Publish. Props carries the header and Trailer the
+// trailer of the call the Publish belongs to.
 type PubAck struct {
 	Header
 	MessageId uint16
 	Status    Status
+	Props     Props
+	Trailer   Props
 	Payload   Payload
 }
 
 func (msg *PubAck) Encode(w io.Writer) (err error) {
+	return encodeWithPayload(w, msg, msg.Payload)
+}
+
+func (msg *PubAck) encodeHead(w io.Writer) error {
 	buf := new(bytes.Buffer)
 
 	setUint16(msg.MessageId, buf)
 
 	msg.Status.Encode(buf)
-	pl := int32(0)
-	if msg.Payload != nil {
-		pl = pl + int32(msg.Payload.Len())
-	}
-
-	if err = writeMessage(w, MsgPubAck, &msg.Header, buf, pl); err != nil {
-		return
-	}
+	msg.Props.Encode(buf)
+	msg.Trailer.Encode(buf)
 
-	if msg.Payload != nil {
-		_, err = w.Write(msg.Payload.ReadOnlyData())
-	}
-	return
+	return writeMessage(w, MsgPubAck, &msg.Header, buf, payloadLen(msg.Payload))
 }
 
 func (msg *PubAck) Decode(r io.Reader, hdr Header, packetRemaining int32, builder PayloadBuilder) (err error) {
@@ -107,6 +179,8 @@ func (msg *PubAck) Decode(r io.Reader, hdr Header, packetRemaining int32, builde
 
 	msg.MessageId = getUint16(r, &packetRemaining)
 	msg.Status.Decode(r, &packetRemaining)
+	msg.Props = decodeOptionalProps(r, &packetRemaining)
+	msg.Trailer = decodeOptionalProps(r, &packetRemaining)
 
 	if packetRemaining > 0 {
 		payloadReader := &io.LimitedReader{R: r, N: int64(packetRemaining)}
@@ -351,3 +425,147 @@ func (msg *Disconnect) Decode(r io.Reader, hdr Header, packetRemaining int32, bu
 func (msg *Disconnect) String() string {
 	return "Disconnect"
 }
+
+// TopicQos is a topic filter of a Subscribe along with the QoS requested for
+// the messages matching it.
+type TopicQos struct {
+	Topic string
+	Qos   QosLevel
+}
+
+// Subscribe subscribes the client to the messages published on the topics
+// matching its filters. It is answered by a SubAck with the same MessageId.
+type Subscribe struct {
+	Header
+	MessageId uint16
+	Topics    []TopicQos
+}
+
+func (msg *Subscribe) Encode(w io.Writer) error {
+	buf := new(bytes.Buffer)
+	setUint16(msg.MessageId, buf)
+	for _, t := range msg.Topics {
+		setString(t.Topic, buf)
+		setUint8(uint8(t.Qos), buf)
+	}
+	return writeMessage(w, MsgSubscribe, &msg.Header, buf, 0)
+}
+
+func (msg *Subscribe) Decode(r io.Reader, hdr Header, packetRemaining int32, builder PayloadBuilder) (err error) {
+	defer func() {
+		err = recoverError(err, recover())
+	}()
+
+	msg.Header = hdr
+	msg.MessageId = getUint16(r, &packetRemaining)
+	msg.Topics = nil
+	for packetRemaining > 0 {
+		topic := getString(r, &packetRemaining)
+		qos := QosLevel(getUint8(r, &packetRemaining))
+		msg.Topics = append(msg.Topics, TopicQos{Topic: topic, Qos: qos})
+	}
+	return nil
+}
+
+func (msg *Subscribe) String() string {
+	return "Subscribe"
+}
+
+// SubAck answers a Subscribe with the QoS granted for each of its topic
+// filters, in order, QosFailure for the refused ones.
+type SubAck struct {
+	Header
+	MessageId uint16
+	TopicsQos []QosLevel
+}
+
+func (msg *SubAck) Encode(w io.Writer) error {
+	buf := new(bytes.Buffer)
+	setUint16(msg.MessageId, buf)
+	for _, q := range msg.TopicsQos {
+		setUint8(uint8(q), buf)
+	}
+	return writeMessage(w, MsgSubAck, &msg.Header, buf, 0)
+}
+
+func (msg *SubAck) Decode(r io.Reader, hdr Header, packetRemaining int32, builder PayloadBuilder) (err error) {
+	defer func() {
+		err = recoverError(err, recover())
+	}()
+
+	msg.Header = hdr
+	msg.MessageId = getUint16(r, &packetRemaining)
+	msg.TopicsQos = nil
+	for packetRemaining > 0 {
+		msg.TopicsQos = append(msg.TopicsQos, QosLevel(getUint8(r, &packetRemaining)))
+	}
+	return nil
+}
+
+func (msg *SubAck) String() string {
+	return "SubAck"
+}
+
+// Unsubscribe removes topic filters of the client. It is answered by an
+// UnsubAck with the same MessageId.
+type Unsubscribe struct {
+	Header
+	MessageId uint16
+	Topics    []string
+}
+
+func (msg *Unsubscribe) Encode(w io.Writer) error {
+	buf := new(bytes.Buffer)
+	setUint16(msg.MessageId, buf)
+	for _, t := range msg.Topics {
+		setString(t, buf)
+	}
+	return writeMessage(w, MsgUnsubscribe, &msg.Header, buf, 0)
+}
+
+func (msg *Unsubscribe) Decode(r io.Reader, hdr Header, packetRemaining int32, builder PayloadBuilder) (err error) {
+	defer func() {
+		err = recoverError(err, recover())
+	}()
+
+	msg.Header = hdr
+	msg.MessageId = getUint16(r, &packetRemaining)
+	msg.Topics = nil
+	for packetRemaining > 0 {
+		msg.Topics = append(msg.Topics, getString(r, &packetRemaining))
+	}
+	return nil
+}
+
+func (msg *Unsubscribe) String() string {
+	return "Unsubscribe"
+}
+
+// UnsubAck answers an Unsubscribe.
+type UnsubAck struct {
+	Header
+	MessageId uint16
+}
+
+func (msg *UnsubAck) Encode(w io.Writer) error {
+	buf := new(bytes.Buffer)
+	setUint16(msg.MessageId, buf)
+	return writeMessage(w, MsgUnsubAck, &msg.Header, buf, 0)
+}
+
+func (msg *UnsubAck) Decode(r io.Reader, hdr Header, packetRemaining int32, builder PayloadBuilder) (err error) {
+	defer func() {
+		err = recoverError(err, recover())
+	}()
+
+	msg.Header = hdr
+	msg.MessageId = getUint16(r, &packetRemaining)
+	if packetRemaining != 0 {
+		return errMsgTooLong
+	}
+	return nil
+}
+
+func (msg *UnsubAck) String() string {
+	return "UnsubAck"
+}
@@ -0,0 +1,593 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/stonefire-oss/stonefire-im/pkg/codec"
+	"github.com/stonefire-oss/stonefire-im/pkg/utils"
+)
+
+// The log of a File store is a sequence of records, each made of the length
+// and the CRC-32 of its body, both 4 bytes big endian, followed by the body.
+// The body starts with the record type:
+//
+//	append: recipient, seq, expires, compressed, path, props, payload, time
+//	ack:    recipient, seq
+//
+// Strings, byte slices and props are prefixed by their length as a uvarint,
+// seq is a uvarint, expires and time the Unix time in nanoseconds as a
+// varint, expires zero for none. A record cut short by a crash ends the log,
+// it is truncated when the store is opened.
+const (
+	recordAppend byte = iota + 1
+	recordAck
+
+	recordHeaderSize = 8
+	maxRecordSize    = 64 << 20
+
+	logName = "messages.log"
+	// compactThreshold is the size the dead records must reach before the
+	// log is compacted.
+	compactThreshold = 4 << 20
+)
+
+var errCorrupted = errors.New("store: corrupted record")
+
+// File is a MessageStore which keeps the messages in an append-only log on
+// disk. An index of the messages not acknowledged yet is kept in memory,
+// rebuilt from the log when the store is opened. The log is rewritten
+// without the dropped messages once they take more room than the others.
+type File struct {
+	opts options
+	path string
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	dead   int64
+	queues map[string]*fileQueue
+}
+
+type fileQueue struct {
+	lastSeq uint64
+	entries []fileEntry
+	bytes   int64
+}
+
+// fileEntry locates an append record of the log.
+type fileEntry struct {
+	seq        uint64
+	off        int64
+	size       int64 // of the whole record
+	payloadLen int
+	expires    time.Time
+}
+
+// OpenFile opens the store kept in dir, creating it if needed.
+func OpenFile(dir string, opts ...Option) (*File, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &File{
+		opts: newOptions(opts),
+		path: filepath.Join(dir, logName),
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// open opens the log and rebuilds the index.
+func (s *File) open() error {
+	f, err := os.OpenFile(s.path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	s.f = f
+	s.size, s.dead = 0, 0
+	s.queues = make(map[string]*fileQueue)
+
+	r := bufio.NewReader(f)
+	now := time.Now()
+	for {
+		body, n, err := readRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// The tail of the log was not written completely.
+			if err := f.Truncate(s.size); err != nil {
+				f.Close()
+				return err
+			}
+			break
+		}
+		if err := s.replay(body, s.size, int64(n), now); err != nil {
+			f.Close()
+			return fmt.Errorf("%w at offset %d", err, s.size)
+		}
+		s.size += int64(n)
+	}
+	if _, err := f.Seek(s.size, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	return nil
+}
+
+// replay applies the record of body, found at off, to the index.
+func (s *File) replay(body []byte, off, size int64, now time.Time) error {
+	d := decoder{b: body[1:]}
+	recipient := d.string()
+	seq := d.uvarint()
+	if d.err != nil {
+		return d.err
+	}
+	q := s.queue(recipient)
+	q.lastSeq = max(q.lastSeq, seq)
+
+	switch body[0] {
+	case recordAppend:
+		msg := decodeMessage(&d)
+		if d.err != nil {
+			return d.err
+		}
+		q.entries = append(q.entries, fileEntry{
+			seq:        seq,
+			off:        off,
+			size:       size,
+			payloadLen: len(msg.Payload),
+			expires:    msg.Expires,
+		})
+		q.bytes += int64(len(msg.Payload))
+		s.purge(q, now)
+	case recordAck:
+		// Acks are not counted as dead, those written by a compaction
+		// keep the last seq of the recipients.
+		s.ack(q, seq)
+	default:
+		return errCorrupted
+	}
+	return nil
+}
+
+func (s *File) queue(recipient string) *fileQueue {
+	q, ok := s.queues[recipient]
+	if !ok {
+		q = &fileQueue{}
+		s.queues[recipient] = q
+	}
+	return q
+}
+
+func (s *File) Append(recipient string, msg *Message) (uint64, error) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return 0, ErrClosed
+	}
+	q := s.queue(recipient)
+	s.purge(q, now)
+	if err := s.opts.checkQuota(len(q.entries), q.bytes, len(msg.Payload)); err != nil {
+		return 0, err
+	}
+
+	seq := q.lastSeq + 1
+	expires := s.opts.expires(now)
+	var e encoder
+	e.byte(recordAppend)
+	e.string(recipient)
+	e.uvarint(seq)
+	e.varint(utils.UnixNano(expires))
+	e.bool(msg.Compressed)
+	e.string(msg.Path)
+	e.props(msg.Props)
+	e.bytes(msg.Payload)
+	e.varint(now.UnixNano())
+	if len(e.b) > maxRecordSize {
+		// It could not be read back, the log would end before it.
+		return 0, ErrTooLarge
+	}
+	off, size, err := s.write(e.b)
+	if err != nil {
+		return 0, err
+	}
+
+	q.lastSeq = seq
+	q.entries = append(q.entries, fileEntry{
+		seq:        seq,
+		off:        off,
+		size:       size,
+		payloadLen: len(msg.Payload),
+		expires:    expires,
+	})
+	q.bytes += int64(len(msg.Payload))
+	return seq, nil
+}
+
+func (s *File) Fetch(recipient string, after uint64, limit int) ([]*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil, ErrClosed
+	}
+	q, ok := s.queues[recipient]
+	if !ok {
+		return nil, nil
+	}
+	s.purge(q, time.Now())
+	var res []*Message
+	for _, e := range q.entries {
+		if len(res) == limit {
+			break
+		}
+		if e.seq <= after {
+			continue
+		}
+		msg, err := s.read(e)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, msg)
+	}
+	return res, nil
+}
+
+func (s *File) Ack(recipient string, seq uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return ErrClosed
+	}
+	q, ok := s.queues[recipient]
+	if !ok || len(q.entries) == 0 || q.entries[0].seq > seq {
+		return nil
+	}
+
+	var e encoder
+	e.byte(recordAck)
+	e.string(recipient)
+	e.uvarint(min(seq, q.lastSeq))
+	_, size, err := s.write(e.b)
+	if err != nil {
+		return err
+	}
+	s.dead += size
+	s.ack(q, seq)
+	return s.maybeCompact()
+}
+
+func (s *File) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return ErrClosed
+	}
+	err := s.f.Sync()
+	if cerr := s.f.Close(); err == nil {
+		err = cerr
+	}
+	s.f = nil
+	return err
+}
+
+// ack drops the entries of q up to seq.
+func (s *File) ack(q *fileQueue, seq uint64) {
+	for len(q.entries) > 0 && q.entries[0].seq <= seq {
+		s.drop(q)
+	}
+}
+
+// purge drops the expired entries of q, the oldest ones first.
+func (s *File) purge(q *fileQueue, now time.Time) {
+	for len(q.entries) > 0 && expired(q.entries[0].expires, now) {
+		s.drop(q)
+	}
+}
+
+// drop drops the oldest entry of q.
+func (s *File) drop(q *fileQueue) {
+	e := q.entries[0]
+	q.entries = q.entries[1:]
+	q.bytes -= int64(e.payloadLen)
+	s.dead += e.size
+}
+
+// write appends a record with body to the log and returns its offset and
+// size.
+func (s *File) write(body []byte) (int64, int64, error) {
+	rec := makeRecord(body)
+	off := s.size
+	if _, err := s.f.Write(rec); err != nil {
+		// Drop what was written of the record, so that the log stays
+		// readable.
+		s.f.Truncate(off)
+		s.f.Seek(off, io.SeekStart)
+		return 0, 0, err
+	}
+	if s.opts.syncWrites {
+		if err := s.f.Sync(); err != nil {
+			return 0, 0, err
+		}
+	}
+	s.size += int64(len(rec))
+	return off, int64(len(rec)), nil
+}
+
+// read reads the message of e.
+func (s *File) read(e fileEntry) (*Message, error) {
+	rec := make([]byte, e.size)
+	if _, err := s.f.ReadAt(rec, e.off); err != nil {
+		return nil, err
+	}
+	body, _, err := readRecord(bytes.NewReader(rec))
+	if err != nil {
+		return nil, err
+	}
+	d := decoder{b: body[1:]}
+	d.string()
+	seq := d.uvarint()
+	msg := decodeMessage(&d)
+	if d.err != nil {
+		return nil, d.err
+	}
+	msg.Seq = seq
+	return msg, nil
+}
+
+// maybeCompact rewrites the log without the dead records once they take
+// more room than the live ones.
+func (s *File) maybeCompact() error {
+	if s.dead < compactThreshold || s.dead < s.size-s.dead {
+		return nil
+	}
+
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	err = s.writeLive(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	s.f.Close()
+	if err := s.open(); err != nil {
+		// The store is left closed.
+		s.f = nil
+		return err
+	}
+	return nil
+}
+
+// writeLive writes the records of the messages kept to w, and for the
+// recipients left without any an ack record keeping their last seq.
+func (s *File) writeLive(w io.Writer) error {
+	for recipient, q := range s.queues {
+		if len(q.entries) == 0 {
+			var e encoder
+			e.byte(recordAck)
+			e.string(recipient)
+			e.uvarint(q.lastSeq)
+			if _, err := w.Write(makeRecord(e.b)); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, e := range q.entries {
+			rec := make([]byte, e.size)
+			if _, err := s.f.ReadAt(rec, e.off); err != nil {
+				return err
+			}
+			if _, err := w.Write(rec); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// makeRecord returns the record with body.
+func makeRecord(body []byte) []byte {
+	rec := make([]byte, recordHeaderSize, recordHeaderSize+len(body))
+	binary.BigEndian.PutUint32(rec, uint32(len(body)))
+	binary.BigEndian.PutUint32(rec[4:], crc32.ChecksumIEEE(body))
+	return append(rec, body...)
+}
+
+// readRecord reads a record and returns its body and size.
+func readRecord(r io.Reader) ([]byte, int, error) {
+	var hdr [recordHeaderSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, 0, errCorrupted
+		}
+		return nil, 0, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n == 0 || n > maxRecordSize {
+		return nil, 0, errCorrupted
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, 0, errCorrupted
+	}
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(hdr[4:]) {
+		return nil, 0, errCorrupted
+	}
+	return body, recordHeaderSize + int(n), nil
+}
+
+func decodeMessage(d *decoder) *Message {
+	msg := &Message{}
+	if ns := d.varint(); ns != 0 {
+		msg.Expires = time.Unix(0, ns)
+	}
+	msg.Compressed = d.bool()
+	msg.Path = d.string()
+	msg.Props = d.props()
+	msg.Payload = d.bytes()
+	msg.Time = time.Unix(0, d.varint())
+	return msg
+}
+
+type encoder struct {
+	b []byte
+}
+
+func (e *encoder) byte(v byte) {
+	e.b = append(e.b, v)
+}
+
+func (e *encoder) bool(v bool) {
+	if v {
+		e.byte(1)
+	} else {
+		e.byte(0)
+	}
+}
+
+func (e *encoder) uvarint(v uint64) {
+	e.b = binary.AppendUvarint(e.b, v)
+}
+
+func (e *encoder) varint(v int64) {
+	e.b = binary.AppendVarint(e.b, v)
+}
+
+func (e *encoder) bytes(v []byte) {
+	e.uvarint(uint64(len(v)))
+	e.b = append(e.b, v...)
+}
+
+func (e *encoder) string(v string) {
+	e.uvarint(uint64(len(v)))
+	e.b = append(e.b, v...)
+}
+
+func (e *encoder) props(p codec.Props) {
+	e.uvarint(uint64(len(p)))
+	for k, vs := range p {
+		e.string(k)
+		e.uvarint(uint64(len(vs)))
+		for _, v := range vs {
+			e.string(v)
+		}
+	}
+}
+
+// decoder decodes what encoder encodes. The first error sticks, the values
+// decoded after it are zero.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) fail() {
+	if d.err == nil {
+		d.err = errCorrupted
+	}
+	d.b = nil
+}
+
+func (d *decoder) byte() byte {
+	if len(d.b) < 1 {
+		d.fail()
+		return 0
+	}
+	v := d.b[0]
+	d.b = d.b[1:]
+	return v
+}
+
+func (d *decoder) bool() bool {
+	return d.byte() != 0
+}
+
+func (d *decoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uvarint()
+	if n > uint64(len(d.b)) {
+		d.fail()
+		return nil
+	}
+	v := d.b[:n:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+func (d *decoder) props() codec.Props {
+	n := d.uvarint()
+	if n == 0 {
+		return nil
+	}
+	if n > uint64(len(d.b)) {
+		d.fail()
+		return nil
+	}
+	p := make(codec.Props, n)
+	for range n {
+		k := d.string()
+		vn := d.uvarint()
+		if vn > uint64(len(d.b)) {
+			d.fail()
+			return nil
+		}
+		vs := make([]string, 0, vn)
+		for range vn {
+			vs = append(vs, d.string())
+		}
+		p[k] = vs
+	}
+	return p
+}
@@ -0,0 +1,200 @@
+package store
+
+import (
+	"cmp"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Memory is a HistoryStore which keeps the messages in memory, they are lost
+// when the process exits.
+type Memory struct {
+	opts options
+
+	mu     sync.Mutex
+	queues map[string]*memoryQueue
+	closed bool
+}
+
+var _ HistoryStore = (*Memory)(nil)
+
+type memoryQueue struct {
+	lastSeq uint64
+	msgs    []*Message
+	bytes   int64
+	// deleted are the seqs of the messages each viewer deleted.
+	deleted map[string]map[uint64]bool
+}
+
+// NewMemory returns an empty Memory store.
+func NewMemory(opts ...Option) *Memory {
+	return &Memory{
+		opts:   newOptions(opts),
+		queues: make(map[string]*memoryQueue),
+	}
+}
+
+func (m *Memory) Append(recipient string, msg *Message) (uint64, error) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return 0, ErrClosed
+	}
+	q, ok := m.queues[recipient]
+	if !ok {
+		q = &memoryQueue{}
+		m.queues[recipient] = q
+	}
+	q.purge(now)
+	if err := m.opts.checkQuota(len(q.msgs), q.bytes, len(msg.Payload)); err != nil {
+		return 0, err
+	}
+
+	q.lastSeq++
+	c := &Message{
+		Seq:        q.lastSeq,
+		Path:       msg.Path,
+		Props:      maps.Clone(msg.Props),
+		Payload:    append([]byte(nil), msg.Payload...),
+		Compressed: msg.Compressed,
+		Expires:    m.opts.expires(now),
+		Time:       now,
+	}
+	q.msgs = append(q.msgs, c)
+	q.bytes += int64(len(c.Payload))
+	return c.Seq, nil
+}
+
+func (m *Memory) Fetch(recipient string, after uint64, limit int) ([]*Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+	q, ok := m.queues[recipient]
+	if !ok {
+		return nil, nil
+	}
+	q.purge(time.Now())
+	var res []*Message
+	for _, msg := range q.msgs {
+		if len(res) == limit {
+			break
+		}
+		if msg.Seq > after {
+			res = append(res, msg)
+		}
+	}
+	return res, nil
+}
+
+func (m *Memory) Ack(recipient string, seq uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return ErrClosed
+	}
+	q, ok := m.queues[recipient]
+	if !ok {
+		return nil
+	}
+	for len(q.msgs) > 0 && q.msgs[0].Seq <= seq {
+		q.drop()
+	}
+	return nil
+}
+
+func (m *Memory) History(recipient string, hq HistoryQuery) ([]*Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+	q, ok := m.queues[recipient]
+	if !ok {
+		return nil, nil
+	}
+	q.purge(time.Now())
+
+	// The messages are sorted by seq, msgs[lo:hi] are those within the seq
+	// bounds.
+	lo, _ := slices.BinarySearchFunc(q.msgs, hq.After+1, compareSeq)
+	hi := len(q.msgs)
+	if hq.Before > 0 {
+		hi, _ = slices.BinarySearchFunc(q.msgs, hq.Before, compareSeq)
+	}
+	deleted := q.deleted[hq.Viewer]
+	var res []*Message
+	for i := range max(hi-lo, 0) {
+		if hq.Limit > 0 && len(res) == hq.Limit {
+			break
+		}
+		msg := q.msgs[lo+i]
+		if hq.Backward {
+			msg = q.msgs[hi-1-i]
+		}
+		if hq.inTime(msg.Time) && !deleted[msg.Seq] {
+			res = append(res, msg)
+		}
+	}
+	return res, nil
+}
+
+func compareSeq(m *Message, seq uint64) int {
+	return cmp.Compare(m.Seq, seq)
+}
+
+func (m *Memory) Delete(recipient, viewer string, seqs ...uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return ErrClosed
+	}
+	q, ok := m.queues[recipient]
+	if !ok {
+		return nil
+	}
+	if q.deleted == nil {
+		q.deleted = make(map[string]map[uint64]bool)
+	}
+	deleted, ok := q.deleted[viewer]
+	if !ok {
+		deleted = make(map[uint64]bool, len(seqs))
+		q.deleted[viewer] = deleted
+	}
+	for _, seq := range seqs {
+		if _, ok := slices.BinarySearchFunc(q.msgs, seq, compareSeq); ok {
+			deleted[seq] = true
+		}
+	}
+	return nil
+}
+
+func (m *Memory) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	m.queues = nil
+	return nil
+}
+
+// purge drops the expired messages. They all expire after the same TTL, the
+// oldest ones first.
+func (q *memoryQueue) purge(now time.Time) {
+	for len(q.msgs) > 0 && expired(q.msgs[0].Expires, now) {
+		q.drop()
+	}
+}
+
+// drop drops the oldest message.
+func (q *memoryQueue) drop() {
+	for _, deleted := range q.deleted {
+		delete(deleted, q.msgs[0].Seq)
+	}
+	q.bytes -= int64(len(q.msgs[0].Payload))
+	q.msgs[0] = nil
+	q.msgs = q.msgs[1:]
+}
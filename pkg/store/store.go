@@ -0,0 +1,186 @@
+// Package store keeps the messages pushed to the clients which are not
+// connected, until they connect again and get them.
+//
+// The messages of a recipient are numbered by a sequence which starts at 1
+// and never goes back, even once the messages were acknowledged. A store
+// bounds the messages it keeps for each recipient, see MaxMessages and
+// MaxBytes, and drops them once their TTL passed.
+package store
+
+import (
+	"errors"
+	"time"
+
+	"github.com/stonefire-oss/stonefire-im/pkg/codec"
+)
+
+var (
+	// ErrQuotaExceeded is returned by Append when the recipient has as many
+	// messages or bytes stored as allowed.
+	ErrQuotaExceeded = errors.New("store: quota exceeded")
+	// ErrTooLarge is returned by Append for a message larger than the store
+	// can keep, whatever its quota.
+	ErrTooLarge = errors.New("store: message too large")
+	// ErrClosed is returned once the store is closed.
+	ErrClosed = errors.New("store: closed")
+)
+
+// Message is a message stored for a recipient.
+type Message struct {
+	// Seq is set by Append.
+	Seq        uint64
+	Path       string
+	Props      codec.Props
+	Payload    []byte
+	Compressed bool
+	// Expires is set by Append if the store has a TTL. The message is dropped
+	// once it passed.
+	Expires time.Time
+	// Time is set by Append to the time the message was stored.
+	Time time.Time
+}
+
+// MessageStore stores messages per recipient. Implementations are safe for
+// concurrent use.
+type MessageStore interface {
+	// Append stores a copy of msg for recipient and returns its sequence
+	// number.
+	Append(recipient string, msg *Message) (uint64, error)
+	// Fetch returns at most limit messages of recipient, oldest first, whose
+	// sequence number is greater than after. The messages must not be
+	// modified.
+	Fetch(recipient string, after uint64, limit int) ([]*Message, error)
+	// Ack drops the messages of recipient up to seq included.
+	Ack(recipient string, seq uint64) error
+	// Close releases the resources of the store.
+	Close() error
+}
+
+// HistoryQuery selects the messages of a recipient returned by History.
+type HistoryQuery struct {
+	// After and Before bound the seqs of the messages, both excluded. Zero
+	// is no bound.
+	After, Before uint64
+	// Since and Until bound the times of the messages, Since included and
+	// Until excluded. The zero time is no bound.
+	Since, Until time.Time
+	// Backward returns the newest messages first.
+	Backward bool
+	// Limit bounds how many messages are returned, zero is no limit.
+	Limit int
+	// Viewer is the client reading the messages, those it deleted are
+	// skipped, see HistoryStore.Delete.
+	Viewer string
+}
+
+// inTime reports whether t is within the time bounds of q.
+func (q *HistoryQuery) inTime(t time.Time) bool {
+	return (q.Since.IsZero() || !t.Before(q.Since)) && (q.Until.IsZero() || t.Before(q.Until))
+}
+
+// HistoryStore is a MessageStore which also pages through the messages of a
+// recipient, the conversations of a server, and lets each client delete
+// messages for itself.
+type HistoryStore interface {
+	MessageStore
+	// History returns the messages of recipient matching q, oldest first
+	// unless q.Backward. The messages must not be modified.
+	History(recipient string, q HistoryQuery) ([]*Message, error)
+	// Delete hides the messages seqs of recipient from viewer, History
+	// skips them. The other clients still get them.
+	Delete(recipient, viewer string, seqs ...uint64) error
+}
+
+// Option configures a store.
+type Option interface {
+	apply(*options)
+}
+
+type options struct {
+	maxMessages int
+	maxBytes    int64
+	ttl         time.Duration
+	syncWrites  bool
+}
+
+type funcOption struct {
+	f func(*options)
+}
+
+func (fo *funcOption) apply(o *options) {
+	fo.f(o)
+}
+
+func newFuncOption(f func(*options)) *funcOption {
+	return &funcOption{f: f}
+}
+
+// MaxMessages returns an Option which sets how many messages a recipient may
+// have stored. Zero means no limit. The default is 1000.
+func MaxMessages(n int) Option {
+	return newFuncOption(func(o *options) {
+		o.maxMessages = n
+	})
+}
+
+// MaxBytes returns an Option which sets how many bytes of payload a recipient
+// may have stored. Zero means no limit. The default is 16MiB.
+func MaxBytes(n int64) Option {
+	return newFuncOption(func(o *options) {
+		o.maxBytes = n
+	})
+}
+
+// TTL returns an Option which sets how long a message is kept. Zero keeps
+// the messages until they are acknowledged. The default is 7 days.
+func TTL(d time.Duration) Option {
+	return newFuncOption(func(o *options) {
+		o.ttl = d
+	})
+}
+
+// SyncWrites returns an Option which makes a file store flush every write to
+// stable storage before returning. It has no effect on a memory store.
+func SyncWrites(sync bool) Option {
+	return newFuncOption(func(o *options) {
+		o.syncWrites = sync
+	})
+}
+
+var defaultOptions = options{
+	maxMessages: 1000,
+	maxBytes:    16 << 20,
+	ttl:         time.Hour * 24 * 7,
+}
+
+func newOptions(opts []Option) options {
+	o := defaultOptions
+	for _, opt := range opts {
+		opt.apply(&o)
+	}
+	return o
+}
+
+// checkQuota reports whether a payload of size fits next to count messages
+// of bytes.
+func (o *options) checkQuota(count int, bytes int64, size int) error {
+	if o.maxMessages > 0 && count >= o.maxMessages {
+		return ErrQuotaExceeded
+	}
+	if o.maxBytes > 0 && bytes+int64(size) > o.maxBytes {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// expires returns the expiry of a message appended at now.
+func (o *options) expires(now time.Time) time.Time {
+	if o.ttl <= 0 {
+		return time.Time{}
+	}
+	return now.Add(o.ttl)
+}
+
+func expired(t time.Time, now time.Time) bool {
+	return !t.IsZero() && !now.Before(t)
+}
@@ -0,0 +1,272 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stonefire-oss/stonefire-im/pkg/codec"
+)
+
+// stores returns the implementations under test, opened with opts.
+func stores(t *testing.T, opts ...Option) map[string]MessageStore {
+	t.Helper()
+	f, err := OpenFile(t.TempDir(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return map[string]MessageStore{
+		"memory": NewMemory(opts...),
+		"file":   f,
+	}
+}
+
+func seqs(msgs []*Message) []uint64 {
+	var res []uint64
+	for _, m := range msgs {
+		res = append(res, m.Seq)
+	}
+	return res
+}
+
+func TestStore(t *testing.T) {
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			want := &Message{
+				Path:       "/chat",
+				Props:      codec.Props{"k": {"v"}},
+				Payload:    []byte("hello"),
+				Compressed: true,
+			}
+			for i := 1; i <= 3; i++ {
+				seq, err := s.Append("alice", want)
+				if err != nil {
+					t.Fatalf("Append() error = %v", err)
+				}
+				if seq != uint64(i) {
+					t.Errorf("Append() = %d, want %d", seq, i)
+				}
+			}
+			if _, err := s.Append("bob", want); err != nil {
+				t.Fatalf("Append() error = %v", err)
+			}
+
+			msgs, err := s.Fetch("alice", 0, 2)
+			if err != nil {
+				t.Fatalf("Fetch() error = %v", err)
+			}
+			if got := seqs(msgs); !reflect.DeepEqual(got, []uint64{1, 2}) {
+				t.Errorf("Fetch(0, 2) = %v, want [1 2]", got)
+			}
+			got := *msgs[0]
+			if got.Time.IsZero() {
+				t.Errorf("Fetch() message without time")
+			}
+			got.Seq, got.Expires, got.Time = 0, time.Time{}, time.Time{}
+			if !reflect.DeepEqual(&got, want) {
+				t.Errorf("Fetch() message = %+v, want %+v", &got, want)
+			}
+
+			if err := s.Ack("alice", 2); err != nil {
+				t.Fatalf("Ack() error = %v", err)
+			}
+			msgs, _ = s.Fetch("alice", 0, 10)
+			if got := seqs(msgs); !reflect.DeepEqual(got, []uint64{3}) {
+				t.Errorf("Fetch() after Ack = %v, want [3]", got)
+			}
+			s.Ack("alice", 3)
+			// The sequence goes on after the messages were acknowledged.
+			if seq, _ := s.Append("alice", want); seq != 4 {
+				t.Errorf("Append() after Ack = %d, want 4", seq)
+			}
+		})
+	}
+}
+
+func TestStore_Limits(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		// sizes are the sizes of the payloads appended, the last one after
+		// wait.
+		sizes []int
+		wait  time.Duration
+		// wantErr tells whether the last append fails.
+		wantErr bool
+	}{
+		{name: "max messages", opts: []Option{MaxMessages(2)}, sizes: []int{1, 1, 1}, wantErr: true},
+		{name: "max bytes", opts: []Option{MaxBytes(10)}, sizes: []int{5, 5, 1}, wantErr: true},
+		{name: "expired", opts: []Option{MaxMessages(2), TTL(time.Millisecond * 50)}, sizes: []int{1, 1, 1}, wait: time.Millisecond * 100},
+	}
+	for _, tt := range tests {
+		for name, s := range stores(t, tt.opts...) {
+			t.Run(tt.name+"/"+name, func(t *testing.T) {
+				last := len(tt.sizes) - 1
+				for _, n := range tt.sizes[:last] {
+					if _, err := s.Append("alice", &Message{Payload: make([]byte, n)}); err != nil {
+						t.Fatalf("Append() error = %v", err)
+					}
+				}
+				time.Sleep(tt.wait)
+				_, err := s.Append("alice", &Message{Payload: make([]byte, tt.sizes[last])})
+				if tt.wantErr != errors.Is(err, ErrQuotaExceeded) {
+					t.Errorf("Append() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				msgs, _ := s.Fetch("alice", 0, 10)
+				if tt.wait > 0 && len(msgs) != 1 {
+					t.Errorf("Fetch() = %v, want the last message only", seqs(msgs))
+				}
+			})
+		}
+	}
+}
+
+func TestFile_Reopen(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		s.Append("alice", &Message{Path: "/chat", Payload: []byte("hi")})
+	}
+	s.Ack("alice", 1)
+	s.Close()
+
+	// A record cut short.
+	f, err := os.OpenFile(filepath.Join(dir, logName), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 42, 1, 2})
+	f.Close()
+
+	s, err = OpenFile(dir)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	defer s.Close()
+	msgs, err := s.Fetch("alice", 0, 10)
+	if err != nil {
+		t.Fatalf("Fetch() error = %v", err)
+	}
+	if got := seqs(msgs); !reflect.DeepEqual(got, []uint64{2, 3}) {
+		t.Errorf("Fetch() = %v, want [2 3]", got)
+	}
+	if seq, err := s.Append("alice", &Message{}); err != nil || seq != 4 {
+		t.Errorf("Append() = %d, %v, want 4", seq, err)
+	}
+}
+
+func TestFile_TooLarge(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenFile(dir, MaxBytes(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Append("alice", &Message{Payload: []byte("before")})
+	if _, err := s.Append("alice", &Message{Payload: make([]byte, maxRecordSize)}); err != ErrTooLarge {
+		t.Errorf("Append(too large) error = %v, want %v", err, ErrTooLarge)
+	}
+	s.Append("alice", &Message{Payload: []byte("after")})
+	s.Append("bob", &Message{Payload: []byte("after")})
+	s.Close()
+
+	s, err = OpenFile(dir)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	defer s.Close()
+	if msgs, _ := s.Fetch("alice", 0, 10); !reflect.DeepEqual(seqs(msgs), []uint64{1, 2}) {
+		t.Errorf("Fetch(alice) = %v, want [1 2]", seqs(msgs))
+	}
+	if msgs, _ := s.Fetch("bob", 0, 10); len(msgs) != 1 {
+		t.Errorf("Fetch(bob) = %v, want 1 message", msgs)
+	}
+}
+
+func TestFile_Compact(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenFile(dir, MaxBytes(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	big := bytes.Repeat([]byte{1}, 1<<20)
+	for range 5 {
+		s.Append("alice", &Message{Payload: big})
+	}
+	s.Append("bob", &Message{Payload: []byte("kept")})
+	if err := s.Ack("alice", 5); err != nil {
+		t.Fatalf("Ack() error = %v", err)
+	}
+	fi, err := os.Stat(filepath.Join(dir, logName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() > 1024 {
+		t.Errorf("log size after compaction = %d", fi.Size())
+	}
+	s.Close()
+
+	s, err = OpenFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if msgs, _ := s.Fetch("bob", 0, 10); len(msgs) != 1 || string(msgs[0].Payload) != "kept" {
+		t.Errorf("Fetch(bob) = %v after compaction", msgs)
+	}
+	if seq, _ := s.Append("alice", &Message{}); seq != 6 {
+		t.Errorf("Append() after compaction = %d, want 6", seq)
+	}
+}
+
+func TestMemory_History(t *testing.T) {
+	s := NewMemory()
+	for i := 1; i <= 6; i++ {
+		if i == 4 {
+			// The messages from 4 on are stored later than the others.
+			time.Sleep(time.Millisecond)
+		}
+		s.Append("room", &Message{Path: "/chat"})
+	}
+	if err := s.Delete("room", "alice", 2, 5, 42); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	all, _ := s.Fetch("room", 0, 10)
+	since := all[3].Time
+
+	tests := []struct {
+		name string
+		q    HistoryQuery
+		want []uint64
+	}{
+		{name: "all", q: HistoryQuery{}, want: []uint64{1, 2, 3, 4, 5, 6}},
+		{name: "limit", q: HistoryQuery{Limit: 2}, want: []uint64{1, 2}},
+		{name: "after", q: HistoryQuery{After: 4}, want: []uint64{5, 6}},
+		{name: "backward", q: HistoryQuery{Backward: true, Limit: 4}, want: []uint64{6, 5, 4, 3}},
+		{name: "backward before", q: HistoryQuery{Backward: true, Before: 3}, want: []uint64{2, 1}},
+		{name: "bounds", q: HistoryQuery{After: 1, Before: 5}, want: []uint64{2, 3, 4}},
+		{name: "since", q: HistoryQuery{Since: since}, want: []uint64{4, 5, 6}},
+		{name: "until", q: HistoryQuery{Until: since, Backward: true}, want: []uint64{3, 2, 1}},
+		{name: "deleted", q: HistoryQuery{Viewer: "alice"}, want: []uint64{1, 3, 4, 6}},
+		{name: "deleted limit", q: HistoryQuery{Viewer: "alice", Backward: true, Limit: 2}, want: []uint64{6, 4}},
+		{name: "empty", q: HistoryQuery{After: 6}, want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msgs, err := s.History("room", tt.q)
+			if err != nil {
+				t.Fatalf("History() error = %v", err)
+			}
+			if got := seqs(msgs); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("History() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
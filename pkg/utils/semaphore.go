@@ -1,17 +1,34 @@
 package utils
 
-import "sync/atomic"
+import (
+	"context"
+	"sync/atomic"
+)
 
 type AtomicSemaphore struct {
 	n    atomic.Int64
 	wait chan struct{}
 }
 
-func (q *AtomicSemaphore) Acquire() {
-	if q.n.Add(-1) < 0 {
-		// We ran out of quota.  Block until a release happens.
+// Acquire takes a unit of quota, waiting for a release if there is none
+// left. It gives up and returns the error of ctx once ctx is done.
+func (q *AtomicSemaphore) Acquire(ctx context.Context) error {
+	if q.n.Add(-1) >= 0 {
+		return nil
+	}
+	// We ran out of quota.  Block until a release happens.
+	select {
+	case <-q.wait:
+		return nil
+	case <-ctx.Done():
+	}
+	// Give the unit back.  If a release came in meanwhile it has sent, or
+	// is about to send, on wait for us: take it back so that the next
+	// acquire does not find it there.
+	if q.n.Add(1) > 0 {
 		<-q.wait
 	}
+	return ctx.Err()
 }
 
 func (q *AtomicSemaphore) Release() {
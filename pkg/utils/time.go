@@ -0,0 +1,11 @@
+package utils
+
+import "time"
+
+// UnixNano returns t as Unix time in nanoseconds, zero for the zero time.
+func UnixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
@@ -0,0 +1,131 @@
+package qrpc
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/stonefire-oss/stonefire-im/pkg/codec"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	ProtocolName    = "QRPC"
+	ProtocolVersion = 1
+)
+
+// Authenticator validates the Connect frame which opens every connection.
+//
+// Authenticate returns the identity of the client, which is made available
+// to the handlers of the connection by IdentityFromContext. A rejection is
+// reported as a gRPC status error, whose code selects the ReturnCode of the
+// ConnAck: Unauthenticated for bad credentials, PermissionDenied for a client
+// which may not connect, InvalidArgument for a rejected ClientId and
+// Unavailable when the client should retry later.
+type Authenticator interface {
+	Authenticate(ctx context.Context, req *codec.Connect) (identity any, err error)
+}
+
+// AuthenticatorFunc adapts a function to the Authenticator interface.
+type AuthenticatorFunc func(ctx context.Context, req *codec.Connect) (any, error)
+
+func (f AuthenticatorFunc) Authenticate(ctx context.Context, req *codec.Connect) (any, error) {
+	return f(ctx, req)
+}
+
+// IdentityFromContext returns the identity the Authenticator established for
+// the connection the call of ctx arrived on.
+func IdentityFromContext(ctx context.Context) any {
+	if c := qrpcConnFromContext(ctx); c != nil {
+		return c.identity
+	}
+	return nil
+}
+
+// UserAgentFromContext returns the UserAgent announced by the Connect of the
+// connection the call of ctx arrived on.
+func UserAgentFromContext(ctx context.Context) (*UserAgent, bool) {
+	if c := qrpcConnFromContext(ctx); c != nil && c.ua != nil {
+		return c.ua, true
+	}
+	return nil, false
+}
+
+// connectReturnCode maps the error of an Authenticator to the ReturnCode of
+// the ConnAck.
+func connectReturnCode(err error) codec.ReturnCode {
+	switch status.Code(err) {
+	case codes.OK:
+		return codec.RetCodeAccepted
+	case codes.Unauthenticated:
+		return codec.RetCodeBadUsernameOrPassword
+	case codes.InvalidArgument:
+		return codec.RetCodeIdentifierRejected
+	case codes.Unavailable, codes.ResourceExhausted:
+		return codec.RetCodeServerUnavailable
+	case codes.FailedPrecondition:
+		return codec.RetCodeUnacceptableProtocolVersion
+	default:
+		return codec.RetCodeNotAuthorized
+	}
+}
+
+// connectError converts a refused ConnAck into the gRPC error returned by Dial.
+func connectError(rc codec.ReturnCode) error {
+	var c codes.Code
+	switch rc {
+	case codec.RetCodeAccepted:
+		return nil
+	case codec.RetCodeBadUsernameOrPassword:
+		c = codes.Unauthenticated
+	case codec.RetCodeIdentifierRejected, codec.RetCodeBadWill:
+		c = codes.InvalidArgument
+	case codec.RetCodeServerUnavailable:
+		c = codes.Unavailable
+	case codec.RetCodeUnacceptableProtocolVersion:
+		c = codes.FailedPrecondition
+	case codec.RetCodeClientIdInUse:
+		c = codes.AlreadyExists
+	default:
+		c = codes.PermissionDenied
+	}
+	return status.Errorf(c, "qrpc: connection refused: %v", rc)
+}
+
+// authenticate checks req and returns the ConnAck answering it.
+func (c *qrpcConn) authenticate(ctx context.Context, req *codec.Connect) *codec.ConnAck {
+	ack := &codec.ConnAck{
+		KeepAliveTimer: uint16(c.maxConnectionIdle.Seconds()),
+	}
+
+	switch {
+	case req.ProtocolName != ProtocolName || req.ProtocolVersion != ProtocolVersion:
+		ack.ReturnCode = codec.RetCodeUnacceptableProtocolVersion
+		return ack
+	case req.ClientId == "":
+		ack.ReturnCode = codec.RetCodeIdentifierRejected
+		return ack
+	}
+
+	var identity any
+	if c.auth != nil {
+		id, err := c.auth.Authenticate(ctx, req)
+		if err != nil {
+			ack.ReturnCode = connectReturnCode(err)
+			return ack
+		}
+		identity = id
+	}
+
+	c.identity = identity
+	c.ua = &UserAgent{
+		Protocal:      fmt.Sprintf("%s/%d", req.ProtocolName, req.ProtocolVersion),
+		ClientId:      req.ClientId,
+		ClientVersion: req.ClientVersion,
+		OSType:        req.OSType,
+		DeviceId:      deviceId(req.Props),
+		Props:         req.Props,
+	}
+	ack.ReturnCode = codec.RetCodeAccepted
+	return ack
+}
@@ -0,0 +1,117 @@
+package qrpc
+
+import (
+	"context"
+	"crypto/tls"
+	"sync"
+	"testing"
+
+	"github.com/quic-go/quic-go"
+	"github.com/stonefire-oss/stonefire-im/demo/pb"
+	"github.com/stonefire-oss/stonefire-im/pkg/codec"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func tokenAuthenticator(ctx context.Context, req *codec.Connect) (any, error) {
+	if req.Authorization != "secret" {
+		return nil, status.Error(codes.Unauthenticated, "bad token")
+	}
+	return "user:" + req.ClientId, nil
+}
+
+func TestServer_Auth(t *testing.T) {
+	var (
+		mu          sync.Mutex
+		gotIdentity any
+		gotUA       *UserAgent
+	)
+	capture := func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		mu.Lock()
+		gotIdentity = IdentityFromContext(ctx)
+		gotUA, _ = UserAgentFromContext(ctx)
+		mu.Unlock()
+		return handler(ctx, req)
+	}
+	_, addr := newTestServer(t, Auth(AuthenticatorFunc(tokenAuthenticator)), UnaryInterceptor(capture))
+
+	tests := []struct {
+		name     string
+		opts     []DialOption
+		wantCode codes.Code
+	}{
+		{
+			name:     "accepted",
+			opts:     []DialOption{WithClientId("alice"), WithAuthorization("secret"), WithClientInfo("1.0", "ios")},
+			wantCode: codes.OK,
+		},
+		{
+			name:     "bad token",
+			opts:     []DialOption{WithClientId("alice"), WithAuthorization("guess")},
+			wantCode: codes.Unauthenticated,
+		},
+		{
+			name:     "no token",
+			opts:     []DialOption{WithClientId("alice")},
+			wantCode: codes.Unauthenticated,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsConf := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{testALPN}}
+			cc, err := Dial(context.Background(), addr, tlsConf, tt.opts...)
+			if got := status.Code(err); got != tt.wantCode {
+				t.Fatalf("Dial() code = %v, want %v (%v)", got, tt.wantCode, err)
+			}
+			if err != nil {
+				return
+			}
+			defer cc.Close()
+
+			client := pb.NewStudentServiceClient(cc)
+			if _, err := client.CreateStudent(context.Background(), &pb.Student{}); err != nil {
+				t.Fatal(err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if gotIdentity != "user:alice" {
+				t.Errorf("IdentityFromContext() = %v, want %v", gotIdentity, "user:alice")
+			}
+			if gotUA == nil || gotUA.ClientId != "alice" || gotUA.ClientVersion != "1.0" || gotUA.OSType != "ios" {
+				t.Errorf("UserAgentFromContext() = %+v", gotUA)
+			}
+		})
+	}
+}
+
+func TestServer_PublishBeforeConnect(t *testing.T) {
+	_, addr := newTestServer(t)
+	tlsConf := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{testALPN}}
+	conn, err := quic.DialAddr(context.Background(), addr, tlsConf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseWithError(0, "")
+
+	stream, err := conn.OpenStreamSync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := codec.Publish{
+		Header:    codec.Header{AckRequired: true},
+		MessageId: 1,
+		Path:      pb.StudentService_CreateStudent_FullMethodName,
+	}
+	pub.Encode(stream)
+	stream.Close()
+
+	msg, err := codec.DecodeOneMessage(stream, codec.SlicePayloadBuiler{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ack, ok := msg.(*codec.PubAck)
+	if !ok || Code(ack.Status.Code) != Unauthenticated {
+		t.Errorf("reply = %#v, want a PubAck with %v", msg, Unauthenticated)
+	}
+}
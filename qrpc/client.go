@@ -0,0 +1,947 @@
+package qrpc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/stonefire-oss/stonefire-im/pkg/codec"
+	"github.com/stonefire-oss/stonefire-im/pkg/utils"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/mem"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultClientKeepaliveTime = time.Second
+)
+
+type DialOption interface {
+	apply(*dialOptions)
+}
+
+type dialOptions struct {
+	quicConfig    *quic.Config
+	callOptions   []grpc.CallOption
+	keepaliveTime time.Duration
+	onDisconnect  func(DisconnectReason)
+	onPush        PushHandler
+	onReceipt     ReceiptHandler
+	onDatagram    DatagramHandler
+	connect       codec.Connect
+	deviceId      string
+	will          *willOptions
+
+	bufferPool mem.BufferPool
+}
+
+type funcDialOption struct {
+	f func(*dialOptions)
+}
+
+func (fdo *funcDialOption) apply(do *dialOptions) {
+	fdo.f(do)
+}
+
+func newFuncDialOption(f func(*dialOptions)) *funcDialOption {
+	return &funcDialOption{f: f}
+}
+
+// WithQuicConfig returns a DialOption which sets the quic.Config used to
+// establish the connection.
+func WithQuicConfig(c *quic.Config) DialOption {
+	return newFuncDialOption(func(o *dialOptions) {
+		o.quicConfig = c
+	})
+}
+
+// WithDefaultCallOptions returns a DialOption which sets the default
+// CallOptions for calls over the connection.
+func WithDefaultCallOptions(cos ...grpc.CallOption) DialOption {
+	return newFuncDialOption(func(o *dialOptions) {
+		o.callOptions = append(o.callOptions, cos...)
+	})
+}
+
+// WithKeepaliveTime returns a DialOption which sets the interval of the
+// Ping frames that keep the connection from being reaped as idle by the
+// server. It should be shorter than the server's connection idle timeout.
+func WithKeepaliveTime(d time.Duration) DialOption {
+	return newFuncDialOption(func(o *dialOptions) {
+		o.keepaliveTime = d
+	})
+}
+
+// WithClientId returns a DialOption which sets the ClientId sent in the
+// Connect. Without it a random ClientId is used.
+func WithClientId(id string) DialOption {
+	return newFuncDialOption(func(o *dialOptions) {
+		o.connect.ClientId = id
+	})
+}
+
+// WithAuthorization returns a DialOption which sets the credentials sent in
+// the Connect for the server's Authenticator.
+func WithAuthorization(auth string) DialOption {
+	return newFuncDialOption(func(o *dialOptions) {
+		o.connect.Authorization = auth
+		o.connect.AuthFlag = true
+	})
+}
+
+// WithClientInfo returns a DialOption which sets the client version and OS
+// type sent in the Connect.
+func WithClientInfo(version, osType string) DialOption {
+	return newFuncDialOption(func(o *dialOptions) {
+		o.connect.ClientVersion = version
+		o.connect.ClientVerFlag = version != ""
+		o.connect.OSType = osType
+		o.connect.OSFlag = osType != ""
+	})
+}
+
+// WithConnectProps returns a DialOption which sets the Props sent in the
+// Connect.
+func WithConnectProps(p codec.Props) DialOption {
+	return newFuncDialOption(func(o *dialOptions) {
+		o.connect.Props = p
+	})
+}
+
+// WithCleanSession returns a DialOption which sets the CleanSession flag of
+// the Connect. With false the client resumes the session it left on the
+// server, if it did not expire, and the server keeps it when the connection
+// ends. The default is true.
+func WithCleanSession(clean bool) DialOption {
+	return newFuncDialOption(func(o *dialOptions) {
+		o.connect.CleanSession = clean
+	})
+}
+
+// WithDeviceId returns a DialOption which sets the device id sent in the
+// Connect, under the DeviceIdProp key of its Props.
+func WithDeviceId(id string) DialOption {
+	return newFuncDialOption(func(o *dialOptions) {
+		o.deviceId = id
+	})
+}
+
+// WithLastWill returns a DialOption which registers a last will in the
+// Connect: msg is published on topic by the broker of the server if the
+// connection ends without the client closing it. PushQos and PushRetain set
+// how it is published.
+func WithLastWill(topic string, msg any, opts ...PushOption) DialOption {
+	w := &willOptions{topic: topic, msg: msg, po: defaultPushOptions}
+	for _, o := range opts {
+		o.apply(&w.po)
+	}
+	return newFuncDialOption(func(o *dialOptions) {
+		o.will = w
+	})
+}
+
+// WithDisconnectHandler returns a DialOption which sets a function called
+// when the server announces with a Disconnect that it is going away. Calls
+// in flight are allowed to finish, new calls fail with Unavailable.
+func WithDisconnectHandler(f func(DisconnectReason)) DialOption {
+	return newFuncDialOption(func(o *dialOptions) {
+		o.onDisconnect = f
+	})
+}
+
+// PushHandler handles a message the server pushed to the client on path. dec
+// decodes the message into its argument, the metadata sent along is in the
+// incoming metadata of ctx. The returned error is sent back to the server as
+// the status of the push.
+//
+// A push is delivered at least once: a push the server got no PubAck for is
+// sent again, the handler must cope with the few duplicates which are not
+// filtered out.
+type PushHandler func(ctx context.Context, path string, dec func(any) error) error
+
+// WithPushHandler returns a DialOption which sets the handler of the messages
+// pushed by the server. Without one pushes fail with Unimplemented.
+func WithPushHandler(h PushHandler) DialOption {
+	return newFuncDialOption(func(o *dialOptions) {
+		o.onPush = h
+	})
+}
+
+// WithReceiptHandler returns a DialOption which sets the handler of the
+// receipts pushed by the server, see EnableReceipts. Without one they are
+// dropped.
+func WithReceiptHandler(h ReceiptHandler) DialOption {
+	return newFuncDialOption(func(o *dialOptions) {
+		o.onReceipt = h
+	})
+}
+
+// WithDatagramHandler returns a DialOption which sets the handler of the
+// messages the server sends in datagrams, see Server.SendDatagram, and
+// enables datagrams on the connection. Without one they are not received.
+func WithDatagramHandler(h DatagramHandler) DialOption {
+	return newFuncDialOption(func(o *dialOptions) {
+		o.onDatagram = h
+	})
+}
+
+// WithClientBufferPool returns a DialOption which sets the pool used for
+// the payloads of received frames.
+func WithClientBufferPool(p mem.BufferPool) DialOption {
+	return newFuncDialOption(func(o *dialOptions) {
+		o.bufferPool = p
+	})
+}
+
+var defaultDialOptions = dialOptions{
+	keepaliveTime: defaultClientKeepaliveTime,
+	connect:       codec.Connect{CleanSession: true},
+	bufferPool:    mem.DefaultBufferPool(),
+}
+
+// ClientConn is a qrpc connection to a server. It implements
+// grpc.ClientConnInterface, so generated gRPC client stubs can be used
+// unchanged on top of it.
+type ClientConn struct {
+	conn   quic.Connection
+	opts   dialOptions
+	plmk   codec.PayloadBuilder
+	closed *utils.Event
+
+	// draining is fired once the server sent a Disconnect. The connection
+	// is closed as soon as no call is left.
+	draining         *utils.Event
+	disconnectReason atomic.Uint32
+	calls            atomic.Int64
+
+	nextId atomic.Uint32
+	// sessionPresent is the SessionPresent flag of the ConnAck.
+	sessionPresent bool
+	// pushes remembers the status of the recent pushes, a push sent again
+	// is acknowledged with it.
+	pushes *dedupCache
+}
+
+var _ grpc.ClientConnInterface = (*ClientConn)(nil)
+
+// Dial establishes a QUIC connection to addr and returns a ClientConn for it.
+func Dial(ctx context.Context, addr string, tlsConf *tls.Config, opt ...DialOption) (*ClientConn, error) {
+	opts := defaultDialOptions
+	for _, o := range opt {
+		o.apply(&opts)
+	}
+
+	// Datagrams are used if the server enables them too.
+	quicConf := &quic.Config{}
+	if opts.quicConfig != nil {
+		quicConf = opts.quicConfig.Clone()
+	}
+	if opts.onDatagram != nil {
+		quicConf.EnableDatagrams = true
+	}
+	conn, err := quic.DialAddr(ctx, addr, tlsConf, quicConf)
+	if err != nil {
+		return nil, err
+	}
+
+	cc := &ClientConn{
+		conn:   conn,
+		opts:   opts,
+		plmk:   &pooledPLMaker{p: opts.bufferPool},
+		closed: utils.NewEvent(),
+
+		draining: utils.NewEvent(),
+		pushes:   newDedupCache(defaultPushWindowSize * 4),
+	}
+	if err := cc.handshake(ctx); err != nil {
+		conn.CloseWithError(CloseReason(NoError).code(), CloseReason(NoError).String())
+		return nil, err
+	}
+	go cc.acceptStreams()
+	if cc.opts.onDatagram != nil && conn.ConnectionState().SupportsDatagrams {
+		go cc.receiveDatagrams()
+	}
+	if cc.opts.keepaliveTime > 0 {
+		go cc.keepalive()
+	}
+	return cc, nil
+}
+
+// handshake sends the Connect on the first stream of the connection and
+// waits for the ConnAck.
+func (cc *ClientConn) handshake(ctx context.Context) error {
+	req := cc.opts.connect
+	req.ProtocolName = ProtocolName
+	req.ProtocolVersion = ProtocolVersion
+	req.KeepAliveTimer = uint16(cc.opts.keepaliveTime.Seconds())
+	if req.ClientId == "" {
+		req.ClientId = randomClientId()
+	}
+	if cc.opts.deviceId != "" || cc.opts.will != nil {
+		props := make(codec.Props, len(req.Props)+1)
+		for k, v := range req.Props {
+			props[k] = v
+		}
+		if cc.opts.deviceId != "" {
+			props[DeviceIdProp] = []string{cc.opts.deviceId}
+		}
+		if cc.opts.will != nil {
+			if err := cc.opts.will.addProps(props); err != nil {
+				return err
+			}
+		}
+		req.Props = props
+	}
+
+	s, err := cc.conn.OpenStreamSync(ctx)
+	if err != nil {
+		return toRPCErr(ctx, err)
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		s.SetDeadline(dl)
+	}
+	defer s.CancelRead(quic.StreamErrorCode(NoError))
+
+	if err := req.Encode(s); err != nil {
+		return toRPCErr(ctx, err)
+	}
+	s.Close()
+
+	msg, err := codec.DecodeOneMessage(s, cc.plmk)
+	if err != nil {
+		return toRPCErr(ctx, err)
+	}
+	ack, ok := msg.(*codec.ConnAck)
+	if !ok {
+		return status.Errorf(codes.Internal, "qrpc: unexpected %v frame in reply to Connect", msg)
+	}
+	cc.sessionPresent = ack.SessionPresent
+	return connectError(ack.ReturnCode)
+}
+
+// SessionPresent reports whether the connection resumed a session the
+// server kept for the client, see WithCleanSession.
+func (cc *ClientConn) SessionPresent() bool {
+	return cc.sessionPresent
+}
+
+func randomClientId() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return "qrpc-" + hex.EncodeToString(b[:])
+}
+
+// acceptStreams serves the streams opened by the server.
+func (cc *ClientConn) acceptStreams() {
+	for {
+		s, err := cc.conn.AcceptStream(cc.conn.Context())
+		if err != nil {
+			return
+		}
+		go cc.handleServerStream(s)
+	}
+}
+
+func (cc *ClientConn) handleServerStream(s quic.Stream) {
+	defer finishStream(s)
+
+	msg, err := codec.DecodeOneMessage(s, cc.plmk)
+	if err != nil {
+		return
+	}
+	switch vv := msg.(type) {
+	case *codec.Disconnect:
+		cc.disconnectReason.Store(uint32(vv.ReasonCode))
+		if !cc.draining.Fire() {
+			return
+		}
+		if cc.opts.onDisconnect != nil {
+			cc.opts.onDisconnect(DisconnectReason(vv.ReasonCode))
+		}
+		if cc.calls.Load() == 0 {
+			cc.closeDrained()
+		}
+	case *codec.Publish:
+		cc.handlePush(s, vv)
+	case codec.PayloadContainer:
+		FreePayload(vv)
+	}
+}
+
+// handlePush runs the PushHandler for pub and acknowledges it if required.
+// A push sent again is acknowledged with the status of the first delivery,
+// without running the handler again.
+func (cc *ClientConn) handlePush(s quic.Stream, pub *codec.Publish) {
+	if !pub.AckRequired {
+		cc.runPushHandler(pub)
+		return
+	}
+
+	e, dup := cc.pushes.begin(dedupKey{messageId: pub.MessageId}, pub.DupFlag)
+	if dup {
+		FreePayload(pub)
+		<-e.done
+		ack := *e.ack
+		newFrameWriter(s, cc.opts.bufferPool).WriteMessage(&ack)
+		return
+	}
+
+	ws, details := wireStatus(status.Convert(cc.runPushHandler(pub)))
+	ack := &codec.PubAck{
+		Header:    codec.Header{AckRequired: true},
+		MessageId: pub.MessageId,
+		Status:    ws,
+	}
+	if details != "" {
+		ack.Trailer = codec.Props{statusDetailsKey: []string{details}}
+	}
+	cc.pushes.finish(e, ack)
+	newFrameWriter(s, cc.opts.bufferPool).WriteMessage(ack)
+}
+
+func (cc *ClientConn) runPushHandler(pub *codec.Publish) error {
+	defer FreePayload(pub)
+	if pub.Path == receiptPath {
+		rs, err := parseReceipts(pub.Props)
+		if err == nil && cc.opts.onReceipt != nil {
+			cc.opts.onReceipt(cc.conn.Context(), rs)
+		}
+		return err
+	}
+	if cc.opts.onPush == nil {
+		return status.Errorf(codes.Unimplemented, "qrpc: no handler for the push on %s", pub.Path)
+	}
+	ctx := metadata.NewIncomingContext(cc.conn.Context(), propsToMD(pub.Props))
+	ctx = withConversation(ctx, pub.Props)
+	ctx = withSender(ctx, pub.Props)
+	return cc.opts.onPush(ctx, pub.Path, func(v any) error {
+		return DecodePayload(v, pub.Payload, pub.Compressed)
+	})
+}
+
+// Close tells the server the connection is going away and tears it down.
+func (cc *ClientConn) Close() error {
+	if !cc.closed.Fire() {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(cc.conn.Context(), cc.opts.keepaliveTime)
+	defer cancel()
+	if s, err := cc.conn.OpenStreamSync(ctx); err == nil {
+		dis := codec.Disconnect{ReasonCode: NoError}
+		dis.Encode(s)
+		s.Close()
+	}
+	return cc.conn.CloseWithError(CloseReason(NoError).code(), CloseReason(NoError).String())
+}
+
+// closeDrained closes a connection the server asked to leave.
+func (cc *ClientConn) closeDrained() {
+	if cc.closed.Fire() {
+		cc.conn.CloseWithError(CloseReason(NoError).code(), CloseReason(NoError).String())
+	}
+}
+
+func (cc *ClientConn) endCall() {
+	if cc.calls.Add(-1) == 0 && cc.draining.HasFired() {
+		cc.closeDrained()
+	}
+}
+
+// nextMessageId allocates a MessageId for a frame which requires an ack.
+// Ids are never zero.
+func (cc *ClientConn) nextMessageId() uint16 {
+	for {
+		if id := uint16(cc.nextId.Add(1)); id != 0 {
+			return id
+		}
+	}
+}
+
+func (cc *ClientConn) keepalive() {
+	t := time.NewTicker(cc.opts.keepaliveTime)
+
+	defer func() {
+		t.Stop()
+	}()
+
+	for {
+		select {
+		case <-t.C:
+			cc.ping()
+		case <-cc.closed.Fired():
+			return
+		case <-cc.conn.Context().Done():
+			return
+		}
+	}
+}
+
+func (cc *ClientConn) ping() error {
+	ctx, cancel := context.WithTimeout(cc.conn.Context(), cc.opts.keepaliveTime)
+	defer cancel()
+
+	s, err := cc.conn.OpenStreamSync(ctx)
+	if err != nil {
+		return err
+	}
+	dl, _ := ctx.Deadline()
+	s.SetDeadline(dl)
+
+	ping := codec.Ping{}
+	if err := ping.Encode(s); err != nil {
+		s.CancelRead(quic.StreamErrorCode(codes.Canceled))
+		return err
+	}
+	s.Close()
+	defer s.CancelRead(quic.StreamErrorCode(NoError))
+
+	msg, err := codec.DecodeOneMessage(s, cc.plmk)
+	if err != nil {
+		return err
+	}
+	if _, ok := msg.(*codec.PingAck); !ok {
+		return status.Errorf(codes.Internal, "qrpc: unexpected %v frame in reply to Ping", msg)
+	}
+	return nil
+}
+
+type callInfo struct {
+	compressed  bool
+	headerAddr  *metadata.MD
+	trailerAddr *metadata.MD
+}
+
+func (cc *ClientConn) callInfo(opts []grpc.CallOption) (*callInfo, error) {
+	ci := &callInfo{}
+	all := append(cc.opts.callOptions[:len(cc.opts.callOptions):len(cc.opts.callOptions)], opts...)
+	for _, o := range all {
+		switch o := o.(type) {
+		case grpc.CompressorCallOption:
+			switch o.CompressorType {
+			case "gzip":
+				ci.compressed = true
+			case "", "identity":
+				ci.compressed = false
+			default:
+				return nil, status.Errorf(codes.Internal, "qrpc: compressor %q is not supported", o.CompressorType)
+			}
+		case grpc.HeaderCallOption:
+			ci.headerAddr = o.HeaderAddr
+		case grpc.TrailerCallOption:
+			ci.trailerAddr = o.TrailerAddr
+		}
+	}
+	return ci, nil
+}
+
+// newStream opens a QUIC stream for a call and ties its lifetime to ctx. The
+// returned function must be called once the call is over.
+func (cc *ClientConn) newStream(ctx context.Context) (quic.Stream, func(), error) {
+	if cc.draining.HasFired() {
+		r := DisconnectReason(cc.disconnectReason.Load())
+		return nil, nil, status.Errorf(codes.Unavailable, "qrpc: the server is going away: %v", r)
+	}
+	if cc.closed.HasFired() {
+		return nil, nil, status.Error(codes.Canceled, "qrpc: the client connection is closing")
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, nil, status.FromContextError(err).Err()
+	}
+
+	s, err := cc.conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, nil, toRPCErr(ctx, err)
+	}
+
+	if dl, ok := ctx.Deadline(); ok {
+		s.SetDeadline(dl)
+	}
+
+	cc.calls.Add(1)
+	var once sync.Once
+	end := func() {
+		once.Do(cc.endCall)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		s.CancelWrite(quic.StreamErrorCode(codes.Canceled))
+		s.CancelRead(quic.StreamErrorCode(codes.Canceled))
+		end()
+	})
+	return s, func() {
+		stop()
+		end()
+	}, nil
+}
+
+// Invoke sends the request as a single Publish frame and waits for the
+// PubAck carrying the reply.
+func (cc *ClientConn) Invoke(ctx context.Context, method string, args any, reply any, opts ...grpc.CallOption) error {
+	ci, err := cc.callInfo(opts)
+	if err != nil {
+		return err
+	}
+
+	bf, err := EncodePayload(args, ci.compressed)
+	if err != nil {
+		return status.Errorf(codes.Internal, "qrpc: error while marshaling: %v", err)
+	}
+
+	s, stop, err := cc.newStream(ctx)
+	if err != nil {
+		freeBuffer(bf)
+		return err
+	}
+	defer stop()
+
+	req := codec.Publish{
+		Header:    codec.Header{AckRequired: true, Compressed: ci.compressed},
+		MessageId: cc.nextMessageId(),
+		Path:      method,
+		Payload:   bf,
+		Props:     outgoingProps(ctx),
+	}
+	err = newFrameWriter(s, cc.opts.bufferPool).WriteMessage(&req)
+	freeBuffer(bf)
+	if err != nil {
+		s.CancelRead(quic.StreamErrorCode(codes.Canceled))
+		return toRPCErr(ctx, err)
+	}
+	s.Close()
+	defer s.CancelRead(quic.StreamErrorCode(NoError))
+
+	msg, err := codec.DecodeOneMessage(s, cc.plmk)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return status.Error(codes.Internal, "qrpc: stream terminated without a reply")
+		}
+		return toRPCErr(ctx, err)
+	}
+
+	ack, ok := msg.(*codec.PubAck)
+	if !ok {
+		if pc, ok := msg.(codec.PayloadContainer); ok {
+			FreePayload(pc)
+		}
+		return status.Errorf(codes.Internal, "qrpc: unexpected %v frame in reply", msg)
+	}
+	defer FreePayload(ack)
+
+	if ack.MessageId != req.MessageId {
+		return status.Errorf(codes.Internal, "qrpc: reply for message %d, want %d", ack.MessageId, req.MessageId)
+	}
+	if ci.headerAddr != nil {
+		*ci.headerAddr = propsToMD(ack.Props)
+	}
+	if ci.trailerAddr != nil {
+		*ci.trailerAddr = propsToMD(ack.Trailer)
+	}
+	if err := statusError(ack.Status, ack.Trailer); err != nil {
+		return err
+	}
+	if err := DecodePayload(reply, ack.Payload, ack.Compressed); err != nil {
+		return status.Errorf(codes.Internal, "qrpc: failed to unmarshal the received message: %v", err)
+	}
+	return nil
+}
+
+// NewStream opens a streaming call. The stream is opened by a Publish frame
+// carrying only the method path; every message is then sent in a Publish of
+// its own. The client half-closes the call by closing its side of the QUIC
+// stream, the server terminates it with a PubAck carrying the final status
+// and the trailer.
+func (cc *ClientConn) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	ci, err := cc.callInfo(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	s, stop, err := cc.newStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	open := codec.Publish{
+		Header:    codec.Header{AckRequired: true, Compressed: ci.compressed},
+		MessageId: cc.nextMessageId(),
+		Path:      method,
+		Props:     outgoingProps(ctx),
+	}
+	fw := newFrameWriter(s, cc.opts.bufferPool)
+	if err := fw.WriteMessage(&open); err != nil {
+		stop()
+		s.CancelRead(quic.StreamErrorCode(codes.Canceled))
+		return nil, toRPCErr(ctx, err)
+	}
+
+	cs := &clientStream{
+		cc:     cc,
+		s:      s,
+		fw:     fw,
+		ctx:    ctx,
+		desc:   desc,
+		method: method,
+		ci:     ci,
+		stop:   stop,
+	}
+	return cs, nil
+}
+
+type clientStream struct {
+	cc     *ClientConn
+	s      quic.Stream
+	fw     *frameWriter
+	ctx    context.Context
+	desc   *grpc.StreamDesc
+	method string
+	ci     *callInfo
+	stop   func()
+
+	mu         sync.Mutex // guards sendClosed
+	sendClosed bool
+
+	recvMu  sync.Mutex // guards the fields below
+	err     error
+	header  metadata.MD
+	trailer metadata.MD
+	// pending is a frame read ahead by Header.
+	pending codec.Message
+}
+
+// Header waits for the header of the call, which comes with the first frame
+// sent by the server.
+func (cs *clientStream) Header() (metadata.MD, error) {
+	cs.recvMu.Lock()
+	defer cs.recvMu.Unlock()
+
+	if cs.header == nil && cs.err == nil && cs.pending == nil {
+		msg, err := cs.recvFrame(true)
+		if err != nil {
+			cs.finish(err)
+		} else {
+			cs.pending = msg
+		}
+	}
+	if cs.header == nil && cs.err != nil && cs.err != io.EOF {
+		return nil, cs.err
+	}
+	return cs.header, nil
+}
+
+// Trailer returns the trailer of the call, once RecvMsg returned an error.
+func (cs *clientStream) Trailer() metadata.MD {
+	cs.recvMu.Lock()
+	defer cs.recvMu.Unlock()
+	return cs.trailer
+}
+
+// CloseSend half-closes the call: the QUIC stream is closed for writing and
+// the server reads io.EOF once it got the messages sent before.
+func (cs *clientStream) CloseSend() error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if cs.sendClosed {
+		return nil
+	}
+	cs.sendClosed = true
+	cs.s.Close()
+	return nil
+}
+
+func (cs *clientStream) Context() context.Context {
+	return cs.ctx
+}
+
+func (cs *clientStream) SendMsg(m any) error {
+	bf, err := EncodePayload(m, cs.ci.compressed)
+	if err != nil {
+		return status.Errorf(codes.Internal, "qrpc: error while marshaling: %v", err)
+	}
+	defer freeBuffer(bf)
+
+	pub := codec.Publish{
+		Header:  codec.Header{Compressed: cs.ci.compressed},
+		Payload: bf,
+	}
+
+	cs.mu.Lock()
+	closed := cs.sendClosed
+	cs.mu.Unlock()
+
+	if closed {
+		return status.Error(codes.Internal, "qrpc: SendMsg called after CloseSend")
+	}
+	if err := cs.fw.WriteMessage(&pub); err != nil {
+		// The reason the stream broke is reported by RecvMsg.
+		return io.EOF
+	}
+	return nil
+}
+
+func (cs *clientStream) RecvMsg(m any) error {
+	cs.recvMu.Lock()
+	defer cs.recvMu.Unlock()
+
+	if cs.err != nil {
+		return cs.err
+	}
+
+	msg, err := cs.recvFrame(false)
+	if err != nil {
+		return cs.finish(err)
+	}
+
+	switch vv := msg.(type) {
+	case *codec.Publish:
+		err := DecodePayload(m, vv.Payload, vv.Compressed)
+		FreePayload(vv)
+		if err != nil {
+			return cs.finish(status.Errorf(codes.Internal, "qrpc: failed to unmarshal the received message: %v", err))
+		}
+		if cs.desc.ServerStreams {
+			return nil
+		}
+		// The single reply of a call which does not stream replies comes
+		// with its status, which is read right away.
+		return cs.recvStatus()
+	case *codec.PubAck:
+		FreePayload(vv)
+		if err := statusError(vv.Status, vv.Trailer); err != nil {
+			return cs.finish(err)
+		}
+		if !cs.desc.ServerStreams {
+			return cs.finish(status.Error(codes.Internal, "qrpc: cardinality violation: no reply for a call which does not stream replies"))
+		}
+		return cs.finish(io.EOF)
+	case codec.PayloadContainer:
+		FreePayload(vv)
+	}
+	return cs.finish(status.Errorf(codes.Internal, "qrpc: unexpected %v frame in stream", msg))
+}
+
+// recvStatus reads the PubAck which must follow the reply of a call which
+// does not stream replies.
+func (cs *clientStream) recvStatus() error {
+	msg, err := cs.recvFrame(false)
+	if err != nil {
+		return cs.finish(err)
+	}
+	ack, ok := msg.(*codec.PubAck)
+	if !ok {
+		if pc, ok := msg.(codec.PayloadContainer); ok {
+			FreePayload(pc)
+		}
+		return cs.finish(status.Error(codes.Internal, "qrpc: cardinality violation: several replies for a call which does not stream replies"))
+	}
+	FreePayload(ack)
+	if err := statusError(ack.Status, ack.Trailer); err != nil {
+		return cs.finish(err)
+	}
+	cs.finish(io.EOF)
+	return nil
+}
+
+// recvFrame returns the next frame carrying a message or the final status
+// of the call, recording the header and trailer on the way. With headerOnly
+// it returns a nil frame as soon as the header is known.
+func (cs *clientStream) recvFrame(headerOnly bool) (codec.Message, error) {
+	if msg := cs.pending; msg != nil {
+		cs.pending = nil
+		return msg, nil
+	}
+
+	for {
+		msg, err := codec.DecodeOneMessage(cs.s, cs.cc.plmk)
+		if err != nil {
+			if errors.Is(err, io.EOF) && cs.ctx.Err() == nil {
+				// Every call ends with a PubAck.
+				return nil, status.Error(codes.Internal, "qrpc: server closed the stream without sending a status")
+			}
+			return nil, toRPCErr(cs.ctx, err)
+		}
+
+		switch vv := msg.(type) {
+		case *codec.Publish:
+			if cs.header == nil {
+				cs.header = propsToMD(vv.Props)
+			}
+			if _, ok := vv.Props[headerOnlyKey]; ok {
+				FreePayload(vv)
+				if headerOnly {
+					return nil, nil
+				}
+				continue
+			}
+		case *codec.PubAck:
+			if cs.header == nil {
+				cs.header = propsToMD(vv.Props)
+			}
+			cs.trailer = propsToMD(vv.Trailer)
+		}
+		return msg, nil
+	}
+}
+
+// finish records the terminal error of the stream and releases it.
+func (cs *clientStream) finish(err error) error {
+	cs.err = err
+	if cs.header == nil {
+		cs.header = metadata.MD{}
+	}
+	if cs.ci.headerAddr != nil {
+		*cs.ci.headerAddr = cs.header
+	}
+	if cs.ci.trailerAddr != nil {
+		*cs.ci.trailerAddr = cs.trailer
+	}
+	cs.stop()
+	if err == io.EOF {
+		cs.s.CancelRead(quic.StreamErrorCode(NoError))
+	} else {
+		cs.s.CancelRead(quic.StreamErrorCode(codes.Canceled))
+	}
+	cs.CloseSend()
+	return err
+}
+
+// toRPCErr converts a transport error into a gRPC status error.
+func toRPCErr(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return status.FromContextError(ctxErr).Err()
+	}
+
+	var (
+		se *quic.StreamError
+		ne net.Error
+	)
+	switch {
+	case errors.As(err, &se):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.As(err, &ne) && ne.Timeout():
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	return status.Error(codes.Unavailable, err.Error())
+}
+
+func freeBuffer(bf mem.Buffer) {
+	if bf != nil {
+		bf.Free()
+	}
+}
@@ -0,0 +1,165 @@
+package qrpc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/stonefire-oss/stonefire-im/demo/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const testALPN = "qrpc-test"
+
+type testStudentSrv struct {
+	pb.UnimplementedStudentServiceServer
+}
+
+// CreateStudent echoes the name of st. A name which parses as a duration
+// makes the call take that long.
+func (s *testStudentSrv) CreateStudent(ctx context.Context, st *pb.Student) (*pb.Result, error) {
+	if d, err := time.ParseDuration(st.Name); err == nil {
+		time.Sleep(d)
+	}
+	return &pb.Result{Code: int32(len(st.Scores)), Message: st.Name}, nil
+}
+
+func (s *testStudentSrv) Hello(stream grpc.BidiStreamingServer[pb.Student, pb.Echo]) error {
+	for {
+		stu, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(&pb.Echo{Name: stu.Name, Msg: "OK"}); err != nil {
+			return err
+		}
+	}
+}
+
+func testTLSConfig(t testing.TB) *tls.Config {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{SerialNumber: big.NewInt(1)}
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+
+	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{tlsCert},
+		NextProtos:   []string{testALPN},
+	}
+}
+
+// newTestServer starts a Server serving the student service on a loopback
+// listener and returns its address.
+func newTestServer(t testing.TB, opt ...ServerOption) (*Server, string) {
+	s := NewServer(opt...)
+	pb.RegisterStudentServiceServer(s, &testStudentSrv{})
+
+	ls, err := quic.ListenAddr("127.0.0.1:0", testTLSConfig(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ls)
+	t.Cleanup(s.Stop)
+	return s, ls.Addr().String()
+}
+
+func newTestClient(t testing.TB, addr string, opt ...DialOption) *ClientConn {
+	tlsConf := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{testALPN}}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	cc, err := Dial(ctx, addr, tlsConf, opt...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cc.Close() })
+	return cc
+}
+
+func TestClientConn_Invoke(t *testing.T) {
+	_, addr := newTestServer(t)
+	cc := newTestClient(t, addr)
+	client := pb.NewStudentServiceClient(cc)
+
+	tests := []struct {
+		name string
+		opts []grpc.CallOption
+	}{
+		{name: "plain"},
+		{name: "gzip", opts: []grpc.CallOption{grpc.UseCompressor("gzip")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 200; i++ {
+				res, err := client.CreateStudent(context.Background(), &pb.Student{Name: tt.name, Scores: []int32{1, 2}}, tt.opts...)
+				if err != nil {
+					t.Fatalf("CreateStudent() error = %v", err)
+				}
+				if res.Message != tt.name || res.Code != 2 {
+					t.Fatalf("CreateStudent() = %v", res)
+				}
+			}
+		})
+	}
+}
+
+func TestClientConn_Unimplemented(t *testing.T) {
+	_, addr := newTestServer(t)
+	cc := newTestClient(t, addr)
+
+	err := cc.Invoke(context.Background(), "/pb.StudentService/Missing", &pb.Student{}, &pb.Result{})
+	if got := status.Code(err); got != codes.Unimplemented {
+		t.Errorf("Invoke() code = %v, want %v", got, codes.Unimplemented)
+	}
+}
+
+func TestClientConn_NewStream(t *testing.T) {
+	_, addr := newTestServer(t)
+	cc := newTestClient(t, addr)
+	client := pb.NewStudentServiceClient(cc)
+
+	stream, err := client.Hello(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{"a", "b", "c"}
+	for _, n := range names {
+		if err := stream.Send(&pb.Student{Name: n}); err != nil {
+			t.Fatalf("Send() error = %v", err)
+		}
+		echo, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Recv() error = %v", err)
+		}
+		if echo.Name != n {
+			t.Errorf("Recv() = %v, want %v", echo.Name, n)
+		}
+	}
+	stream.CloseSend()
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Errorf("Recv() after CloseSend error = %v, want EOF", err)
+	}
+}
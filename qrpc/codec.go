@@ -6,8 +6,10 @@ import (
 	"io"
 
 	"github.com/stonefire-oss/stonefire-im/pkg/codec"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/encoding"
 	"google.golang.org/grpc/mem"
+	"google.golang.org/grpc/status"
 )
 
 func compressPayload(bs mem.BufferSlice) (mem.Buffer, error) {
@@ -27,7 +29,10 @@ func compressPayload(bs mem.BufferSlice) (mem.Buffer, error) {
 	return wb.MaterializeToBuffer(pl), nil
 }
 
-func decompressPayload(rp codec.Payload) (mem.BufferSlice, error) {
+// decompressPayload inflates rp. Unless maxSize is zero, a message larger
+// than maxSize once inflated fails with ResourceExhausted, without inflating
+// more than maxSize+1 bytes of it.
+func decompressPayload(rp codec.Payload, maxSize int) (mem.BufferSlice, error) {
 	rs := []byte{0, 0}
 	pl := mem.DefaultBufferPool()
 	wb := make(mem.BufferSlice, 0)
@@ -38,24 +43,43 @@ func decompressPayload(rp codec.Payload) (mem.BufferSlice, error) {
 	if err != nil {
 		return nil, err
 	}
-	if _, err := io.Copy(wr, zr); err != nil {
+	var r io.Reader = zr
+	if maxSize > 0 {
+		r = io.LimitReader(zr, int64(maxSize)+1)
+	}
+	if _, err := io.Copy(wr, r); err != nil {
+		wb.Free()
 		return nil, err
 	}
+	if maxSize > 0 && wb.Len() > maxSize {
+		wb.Free()
+		return nil, status.Errorf(codes.ResourceExhausted, "qrpc: received message after decompression larger than max %d", maxSize)
+	}
 	return wb, nil
 }
 
-func DecodePayload(v any, pl codec.Payload, z bool) (err error) {
+// DecodePayload unmarshals pl into v, inflating it first if z is set.
+func DecodePayload(v any, pl codec.Payload, z bool) error {
+	return decodePayload(v, pl, z, 0)
+}
+
+// decodePayload is DecodePayload failing with ResourceExhausted for a
+// message larger than maxSize once inflated, unless maxSize is zero.
+func decodePayload(v any, pl codec.Payload, z bool, maxSize int) (err error) {
 	if pl == nil || pl.Len() <= 0 {
 		return nil
 	}
 
 	var out mem.BufferSlice
 	if z {
-		out, err = decompressPayload(pl)
+		out, err = decompressPayload(pl, maxSize)
 	} else {
 		pd := pl.ReadOnlyData()
 		out = mem.BufferSlice{mem.NewBuffer(&pd, nil)}
 	}
+	if err != nil {
+		return err
+	}
 
 	defer func() {
 		out.Free()
@@ -88,8 +112,11 @@ func EncodePayload(v any, z bool) (mem.Buffer, error) {
 	return bf, nil
 }
 
+// pooledPLMaker builds payloads from the buffer pool. Payloads larger than
+// maxSize are rejected before anything is allocated for them.
 type pooledPLMaker struct {
-	p mem.BufferPool
+	p       mem.BufferPool
+	maxSize int
 }
 
 type pooledSlicePayload struct {
@@ -105,13 +132,21 @@ func (p *pooledSlicePayload) Release() {
 }
 
 func (p pooledPLMaker) MakePayload(r io.Reader, l int) (codec.Payload, error) {
+	if p.maxSize > 0 && l > p.maxSize {
+		return nil, status.Errorf(codes.ResourceExhausted, "qrpc: received message larger than max (%d vs. %d)", l, p.maxSize)
+	}
 	if p.p == nil || mem.IsBelowBufferPoolingThreshold(l) {
 		b := make(codec.SlicePayload, l)
-		io.ReadFull(r, b)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
 		return &pooledSlicePayload{SlicePayload: b}, nil
 	}
 	b := p.p.Get(l)
-	io.ReadFull(r, *b)
+	if _, err := io.ReadFull(r, *b); err != nil {
+		p.p.Put(b)
+		return nil, err
+	}
 	pl := pooledSlicePayload{SlicePayload: *b, p: p.p}
 	return &pl, nil
 }
@@ -10,7 +10,8 @@ import (
 
 func Test_decompressPayload(t *testing.T) {
 	type args struct {
-		rp codec.Payload
+		rp      codec.Payload
+		maxSize int
 	}
 	rp := []byte("0123456789")
 	bs := mem.BufferSlice{mem.NewBuffer(&rp, nil)}
@@ -31,10 +32,21 @@ func Test_decompressPayload(t *testing.T) {
 			want:    bs,
 			wantErr: false,
 		},
+		{
+			name:    "within limit",
+			args:    args{rp: bf, maxSize: 10},
+			want:    bs,
+			wantErr: false,
+		},
+		{
+			name:    "over limit",
+			args:    args{rp: bf, maxSize: 9},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := decompressPayload(tt.args.rp)
+			got, err := decompressPayload(tt.args.rp, tt.args.maxSize)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("decompressPayload() error = %v, wantErr %v", err, tt.wantErr)
 				return
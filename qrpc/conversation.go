@@ -0,0 +1,435 @@
+package qrpc
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/stonefire-oss/stonefire-im/pkg/codec"
+	"github.com/stonefire-oss/stonefire-im/pkg/store"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// The messages of a conversation are numbered by a 64-bit sequence which
+// never goes back, assigned by the conversation store of the server, see
+// ConversationStore. Every message pushed with PushConversation carries the
+// id of its conversation and its seq in its Props, which the PushHandler
+// gets with ConversationFromContext. A client spotting a gap in the seqs, see
+// SeqTracker, fetches the messages it missed with SyncConversation.
+const (
+	// ConversationIdProp is the Props key carrying the id of the
+	// conversation of a message.
+	ConversationIdProp = "qrpc-conv-id"
+	// ConversationSeqProp is the Props key carrying the seq of a message in
+	// its conversation, in decimal.
+	ConversationSeqProp = "qrpc-conv-seq"
+	// ConversationTimeProp is the Props key carrying the time a message was
+	// stored in its conversation, in Unix milliseconds. Only the messages
+	// read back from the conversation store carry it.
+	ConversationTimeProp = "qrpc-conv-time"
+
+	// syncMethod is the path of the sync call, which the server answers
+	// with the messages asked for, one Publish each, and a PubAck.
+	syncMethod = "/qrpc.Conversation/Sync"
+	// The Props of the sync call: the messages after syncAfterKey, up to
+	// syncToKey if set, at most syncLimitKey of them.
+	syncAfterKey = "qrpc-sync-after"
+	syncToKey    = "qrpc-sync-to"
+	syncLimitKey = "qrpc-sync-limit"
+
+	// maxSyncBatch bounds the messages returned by a sync call.
+	maxSyncBatch = 256
+)
+
+// PushConversation appends msg to the conversation conv, then pushes it like
+// Push to each of clientIds along with the id of the conversation and the
+// seq it was given, which it returns. The message is kept in the
+// conversation even if some of the pushes fail, PushConversation returns the
+// first error among them.
+func (s *Server) PushConversation(ctx context.Context, conv string, clientIds []string, path string, msg any, opts ...PushOption) (uint64, error) {
+	if s.opts.conversations == nil {
+		return 0, status.Error(codes.FailedPrecondition, "qrpc: no conversation store")
+	}
+	po := defaultPushOptions
+	for _, o := range opts {
+		o.apply(&po)
+	}
+	if !po.qos.IsValid() {
+		return 0, status.Errorf(codes.InvalidArgument, "qrpc: invalid QoS %d", po.qos)
+	}
+
+	bf, err := EncodePayload(msg, po.compressed)
+	if err != nil {
+		return 0, status.Errorf(codes.Internal, "qrpc: error while marshaling: %v", err)
+	}
+	defer freeBuffer(bf)
+
+	stored := &store.Message{
+		Path:       path,
+		Props:      po.props(ctx),
+		Compressed: po.compressed,
+	}
+	if bf != nil {
+		stored.Payload = bf.ReadOnlyData()
+	}
+	seq, err := s.appendConversation(conv, stored)
+	if err != nil {
+		return 0, err
+	}
+
+	stored.Seq = seq
+	pub := conversationPublish(conv, stored)
+	errs := make([]error, len(clientIds))
+	var wg sync.WaitGroup
+	for i, clientId := range clientIds {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = s.push(ctx, clientId, pub, po.qos)
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return seq, err
+		}
+	}
+	return seq, nil
+}
+
+// appendConversation appends m to conv and returns its seq. A conversation
+// over the quota of the store has its oldest messages dropped to make room,
+// the appends to conv are serialized so that each drops no more than it
+// needs.
+func (s *Server) appendConversation(conv string, m *store.Message) (uint64, error) {
+	unlock := s.convLocks.lock(conv)
+	defer unlock()
+	st := s.opts.conversations
+	for {
+		seq, err := st.Append(conv, m)
+		if err == nil {
+			return seq, nil
+		}
+		if err == store.ErrTooLarge {
+			return 0, status.Errorf(codes.ResourceExhausted, "qrpc: conversation %q: %v", conv, err)
+		}
+		if err != store.ErrQuotaExceeded {
+			return 0, status.Errorf(codes.Internal, "qrpc: conversation %q: %v", conv, err)
+		}
+		oldest, err := st.Fetch(conv, 0, 1)
+		if err != nil {
+			return 0, status.Errorf(codes.Internal, "qrpc: conversation %q: %v", conv, err)
+		}
+		if len(oldest) == 0 {
+			// The message alone is over the quota.
+			return 0, status.Errorf(codes.ResourceExhausted, "qrpc: conversation %q: %v", conv, store.ErrQuotaExceeded)
+		}
+		if err := st.Ack(conv, oldest[0].Seq); err != nil {
+			return 0, status.Errorf(codes.Internal, "qrpc: conversation %q: %v", conv, err)
+		}
+	}
+}
+
+// convLocks is a mutex per conversation, kept while it is held or waited
+// for. The zero value is ready to use.
+type convLocks struct {
+	mu    sync.Mutex
+	locks map[string]*convLock
+}
+
+type convLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lock locks conv and returns the function unlocking it.
+func (l *convLocks) lock(conv string) (unlock func()) {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*convLock)
+	}
+	cl, ok := l.locks[conv]
+	if !ok {
+		cl = &convLock{}
+		l.locks[conv] = cl
+	}
+	cl.refs++
+	l.mu.Unlock()
+
+	cl.Lock()
+	return func() {
+		cl.Unlock()
+		l.mu.Lock()
+		if cl.refs--; cl.refs == 0 {
+			delete(l.locks, conv)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// conversationPublish returns the Publish carrying m, a message of conv.
+func conversationPublish(conv string, m *store.Message) *codec.Publish {
+	props := make(codec.Props, len(m.Props)+3)
+	for k, v := range m.Props {
+		props[k] = v
+	}
+	props[ConversationIdProp] = []string{conv}
+	props[ConversationSeqProp] = []string{strconv.FormatUint(m.Seq, 10)}
+	if !m.Time.IsZero() {
+		props[ConversationTimeProp] = []string{strconv.FormatInt(m.Time.UnixMilli(), 10)}
+	}
+	pub := &codec.Publish{
+		Header: codec.Header{Compressed: m.Compressed},
+		Path:   m.Path,
+		Props:  props,
+	}
+	if len(m.Payload) > 0 {
+		pub.Payload = codec.SlicePayload(m.Payload)
+	}
+	return pub
+}
+
+// handleSync serves a sync call, the messages are written before the reply.
+func (s *Server) handleSync(ctx context.Context, req *codec.Publish, fw *frameWriter) (codec.Props, error) {
+	if s.opts.conversations == nil {
+		return nil, status.Error(Unimplemented, "qrpc: no conversation store")
+	}
+	conv := propValue(req.Props, ConversationIdProp)
+	after, err1 := strconv.ParseUint(propValue(req.Props, syncAfterKey), 10, 64)
+	to, err2 := strconv.ParseUint(propValue(req.Props, syncToKey), 10, 64)
+	limit, err3 := strconv.Atoi(propValue(req.Props, syncLimitKey))
+	if conv == "" || err1 != nil || err2 != nil || err3 != nil || limit <= 0 {
+		return nil, status.Error(InvalidArgument, "qrpc: malformed sync request")
+	}
+	if s.opts.conversationAccess == nil {
+		return nil, status.Error(PermissionDenied, "qrpc: conversations cannot be synced")
+	}
+	if err := s.opts.conversationAccess(ctx, conv); err != nil {
+		return nil, err
+	}
+
+	msgs, err := s.opts.conversations.Fetch(conv, after, min(limit, maxSyncBatch))
+	if err != nil {
+		return nil, status.Error(Internal, err.Error())
+	}
+	for _, m := range msgs {
+		if to > 0 && m.Seq > to {
+			break
+		}
+		if err := fw.WriteMessage(conversationPublish(conv, m)); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+func propValue(p codec.Props, key string) string {
+	if v := p[key]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// ConversationMessage is a message of a conversation returned by
+// SyncConversation or History.
+type ConversationMessage struct {
+	Seq  uint64
+	Path string
+	// Time is the time the message was stored, zero if the conversation
+	// store does not keep it.
+	Time   time.Time
+	Header metadata.MD
+
+	payload    []byte
+	compressed bool
+}
+
+// Decode unmarshals the payload of the message into v.
+func (m *ConversationMessage) Decode(v any) error {
+	var pl codec.Payload
+	if m.payload != nil {
+		pl = codec.SlicePayload(m.payload)
+	}
+	return DecodePayload(v, pl, m.compressed)
+}
+
+// SyncConversation returns the messages of the conversation conv whose seq
+// is greater than after, up to to included unless it is zero, oldest first.
+// The server returns at most limit of them, and may return fewer: a client
+// syncs again after the last one it got until it has them all.
+func (cc *ClientConn) SyncConversation(ctx context.Context, conv string, after, to uint64, limit int) ([]*ConversationMessage, error) {
+	req := &codec.Publish{
+		Header:    codec.Header{AckRequired: true},
+		MessageId: cc.nextMessageId(),
+		Path:      syncMethod,
+		Props:     outgoingProps(ctx),
+	}
+	if req.Props == nil {
+		req.Props = make(codec.Props)
+	}
+	req.Props[ConversationIdProp] = []string{conv}
+	req.Props[syncAfterKey] = []string{strconv.FormatUint(after, 10)}
+	req.Props[syncToKey] = []string{strconv.FormatUint(to, 10)}
+	req.Props[syncLimitKey] = []string{strconv.Itoa(limit)}
+	res, _, err := cc.fetchConversation(ctx, req, "Sync")
+	return res, err
+}
+
+// fetchConversation sends req, a call answered with messages of a
+// conversation followed by a PubAck, and returns the messages and the Props
+// of the PubAck. name is the name of the call in the errors.
+func (cc *ClientConn) fetchConversation(ctx context.Context, req *codec.Publish, name string) ([]*ConversationMessage, codec.Props, error) {
+	s, stop, err := cc.newStream(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer stop()
+
+	if err := newFrameWriter(s, cc.opts.bufferPool).WriteMessage(req); err != nil {
+		s.CancelRead(quic.StreamErrorCode(codes.Canceled))
+		return nil, nil, toRPCErr(ctx, err)
+	}
+	s.Close()
+	defer s.CancelRead(quic.StreamErrorCode(NoError))
+
+	var res []*ConversationMessage
+	for {
+		msg, err := codec.DecodeOneMessage(s, cc.plmk)
+		if err == io.EOF {
+			return nil, nil, status.Error(codes.Internal, "qrpc: stream terminated without a reply")
+		}
+		if err != nil {
+			return nil, nil, toRPCErr(ctx, err)
+		}
+		switch m := msg.(type) {
+		case *codec.Publish:
+			seq, err := strconv.ParseUint(propValue(m.Props, ConversationSeqProp), 10, 64)
+			if err != nil {
+				FreePayload(m)
+				return nil, nil, status.Errorf(codes.Internal, "qrpc: %s reply without seq", name)
+			}
+			cm := &ConversationMessage{
+				Seq:        seq,
+				Path:       m.Path,
+				Header:     propsToMD(m.Props),
+				compressed: m.Compressed,
+			}
+			if ms, err := strconv.ParseInt(propValue(m.Props, ConversationTimeProp), 10, 64); err == nil {
+				cm.Time = time.UnixMilli(ms)
+			}
+			if m.Payload != nil {
+				cm.payload = append([]byte(nil), m.Payload.ReadOnlyData()...)
+			}
+			FreePayload(m)
+			res = append(res, cm)
+		case *codec.PubAck:
+			defer FreePayload(m)
+			if m.MessageId != req.MessageId {
+				return nil, nil, status.Errorf(codes.Internal, "qrpc: unexpected %v frame in reply to %s", msg, name)
+			}
+			if err := statusError(m.Status, m.Trailer); err != nil {
+				return nil, nil, err
+			}
+			return res, m.Props, nil
+		default:
+			return nil, nil, status.Errorf(codes.Internal, "qrpc: unexpected %v frame in reply to %s", msg, name)
+		}
+	}
+}
+
+type conversationKey struct{}
+
+type conversationInfo struct {
+	conv string
+	seq  uint64
+}
+
+// withConversation returns ctx carrying the conversation of the message
+// with props, if it belongs to one.
+func withConversation(ctx context.Context, props codec.Props) context.Context {
+	conv := propValue(props, ConversationIdProp)
+	if conv == "" {
+		return ctx
+	}
+	seq, err := strconv.ParseUint(propValue(props, ConversationSeqProp), 10, 64)
+	if err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, conversationKey{}, conversationInfo{conv: conv, seq: seq})
+}
+
+// ConversationFromContext returns the conversation and the seq of the
+// message a PushHandler was called for, false if it belongs to none.
+func ConversationFromContext(ctx context.Context) (conv string, seq uint64, ok bool) {
+	ci, ok := ctx.Value(conversationKey{}).(conversationInfo)
+	return ci.conv, ci.seq, ok
+}
+
+// SeqTracker follows the seqs of the messages a client receives in each
+// conversation and detects the gaps. It is safe for concurrent use.
+type SeqTracker struct {
+	mu    sync.Mutex
+	convs map[string]*convSeqs
+}
+
+// convSeqs are the seqs received in a conversation: all of them up to last,
+// and those in ahead.
+type convSeqs struct {
+	last  uint64
+	ahead map[uint64]bool
+}
+
+// NewSeqTracker returns a SeqTracker which saw no message yet.
+func NewSeqTracker() *SeqTracker {
+	return &SeqTracker{convs: make(map[string]*convSeqs)}
+}
+
+// Last returns the seq up to which every message of conv was received, the
+// after of the SyncConversation catching up with it.
+func (t *SeqTracker) Last(conv string) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if c, ok := t.convs[conv]; ok {
+		return c.last
+	}
+	return 0
+}
+
+// Set records that every message of conv up to last was received, for a
+// client which starts following a conversation midway.
+func (t *SeqTracker) Set(conv string, last uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.convs[conv] = &convSeqs{last: last, ahead: make(map[uint64]bool)}
+}
+
+// Observe records the message seq of conv. It reports false if the message
+// was received already. Otherwise, if messages before it are missing, it
+// returns the range (after, to] of the missing ones, both zero if none is.
+func (t *SeqTracker) Observe(conv string, seq uint64) (after, to uint64, fresh bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c, ok := t.convs[conv]
+	if !ok {
+		c = &convSeqs{ahead: make(map[uint64]bool)}
+		t.convs[conv] = c
+	}
+	if seq <= c.last || c.ahead[seq] {
+		return 0, 0, false
+	}
+	if seq > c.last+1 {
+		c.ahead[seq] = true
+		return c.last, seq - 1, true
+	}
+	c.last = seq
+	for c.ahead[c.last+1] {
+		delete(c.ahead, c.last+1)
+		c.last++
+	}
+	return 0, 0, true
+}
@@ -0,0 +1,145 @@
+package qrpc
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stonefire-oss/stonefire-im/demo/pb"
+	"github.com/stonefire-oss/stonefire-im/pkg/store"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestServer_Conversation(t *testing.T) {
+	access := func(ctx context.Context, conv string) error {
+		if ua, ok := UserAgentFromContext(ctx); ok && ua.ClientId == "alice" {
+			return nil
+		}
+		return status.Error(codes.PermissionDenied, "not a member")
+	}
+	s, addr := newTestServer(t, ConversationStore(store.NewMemory()), ConversationAccess(access))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	seqs := make(chan uint64, 3)
+	alice := newTestClient(t, addr, WithClientId("alice"), WithPushHandler(func(ctx context.Context, path string, dec func(any) error) error {
+		if conv, seq, ok := ConversationFromContext(ctx); ok && conv == "room" {
+			seqs <- seq
+		}
+		return nil
+	}))
+	for i, name := range []string{"a", "b", "c"} {
+		seq, err := s.PushConversation(ctx, "room", []string{"alice"}, testPushPath, &pb.Student{Name: name})
+		if err != nil {
+			t.Fatalf("PushConversation() error = %v", err)
+		}
+		if want := uint64(i + 1); seq != want || <-seqs != want {
+			t.Errorf("PushConversation() seq = %d, want %d", seq, want)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		after, to uint64
+		limit     int
+		want      []string
+	}{
+		{name: "all", limit: 10, want: []string{"a", "b", "c"}},
+		{name: "after", after: 1, limit: 10, want: []string{"b", "c"}},
+		{name: "range", after: 1, to: 2, limit: 10, want: []string{"b"}},
+		{name: "limit", limit: 2, want: []string{"a", "b"}},
+		{name: "none", after: 3, limit: 10},
+	}
+	for _, tt := range tests {
+		msgs, err := alice.SyncConversation(ctx, "room", tt.after, tt.to, tt.limit)
+		if err != nil {
+			t.Fatalf("%s: SyncConversation() error = %v", tt.name, err)
+		}
+		var got []string
+		for i, m := range msgs {
+			var st pb.Student
+			if err := m.Decode(&st); err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			if want := tt.after + uint64(i) + 1; m.Seq != want {
+				t.Errorf("%s: seq = %d, want %d", tt.name, m.Seq, want)
+			}
+			got = append(got, st.Name)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: SyncConversation() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	tlsConf := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{testALPN}}
+	bob, err := Dial(ctx, addr, tlsConf, WithClientId("bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	if _, err := bob.SyncConversation(ctx, "room", 0, 0, 10); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("SyncConversation() of a stranger error = %v, want %v", err, codes.PermissionDenied)
+	}
+}
+
+func TestServer_ConversationQuota(t *testing.T) {
+	st := store.NewMemory(store.MaxMessages(3), store.MaxBytes(64))
+	s, _ := newTestServer(t, ConversationStore(st))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	for i := range 5 {
+		if _, err := s.PushConversation(ctx, "room", nil, testPushPath, &pb.Student{Name: fmt.Sprint(i + 1)}); err != nil {
+			t.Fatalf("PushConversation() error = %v", err)
+		}
+	}
+	msgs, err := st.Fetch("room", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seqs []uint64
+	for _, m := range msgs {
+		seqs = append(seqs, m.Seq)
+	}
+	if want := []uint64{3, 4, 5}; !reflect.DeepEqual(seqs, want) {
+		t.Errorf("kept %v, want %v", seqs, want)
+	}
+
+	large := &pb.Student{Name: strings.Repeat("x", 100)}
+	if _, err := s.PushConversation(ctx, "room", nil, testPushPath, large); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("PushConversation() over the quota alone error = %v, want %v", err, codes.ResourceExhausted)
+	}
+}
+
+func TestSeqTracker(t *testing.T) {
+	tr := NewSeqTracker()
+	steps := []struct {
+		seq       uint64
+		after, to uint64
+		fresh     bool
+		last      uint64
+	}{
+		{seq: 1, fresh: true, last: 1},
+		{seq: 2, fresh: true, last: 2},
+		{seq: 2, last: 2},
+		{seq: 5, after: 2, to: 4, fresh: true, last: 2},
+		{seq: 3, fresh: true, last: 3},
+		{seq: 4, fresh: true, last: 5},
+		{seq: 5, last: 5},
+		{seq: 6, fresh: true, last: 6},
+	}
+	for _, st := range steps {
+		after, to, fresh := tr.Observe("room", st.seq)
+		if after != st.after || to != st.to || fresh != st.fresh {
+			t.Errorf("Observe(%d) = %d, %d, %v, want %d, %d, %v", st.seq, after, to, fresh, st.after, st.to, st.fresh)
+		}
+		if last := tr.Last("room"); last != st.last {
+			t.Errorf("Last() after %d = %d, want %d", st.seq, last, st.last)
+		}
+	}
+}
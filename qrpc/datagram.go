@@ -0,0 +1,195 @@
+package qrpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/stonefire-oss/stonefire-im/pkg/codec"
+	"github.com/stonefire-oss/stonefire-im/pkg/utils"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Datagrams carry the messages which are not worth a stream, typing
+// indicators and the like, in QUIC DATAGRAM frames (RFC 9221). A datagram
+// holds a single QoS 0 Publish, encoded as on a stream: without AckRequired
+// the frame has no MessageId, it is just the fixed header, the path, the
+// props and the payload. A datagram is never acknowledged nor sent again, it
+// may be lost, reordered or dropped by a peer which receives too many, and
+// it must fit in a QUIC packet, about 1200 bytes.
+//
+// Both peers must enable datagrams in their quic.Config to receive them. A
+// client enables them with a DatagramHandler, see WithDatagramHandler, or
+// with EnableDatagrams set in the config given to WithQuicConfig. The server
+// needs a listener created with EnableDatagrams set.
+// The server runs the handler set by HandleDatagrams for the datagrams of a
+// connection at most at the rate set by DatagramRateLimit, the others are
+// dropped.
+
+const (
+	defaultDatagramRate  = 20
+	defaultDatagramBurst = 40
+)
+
+// DatagramHandler handles a message received in a datagram on path. dec
+// decodes the message into its argument, the metadata sent along is in the
+// incoming metadata of ctx. On the server ctx also carries the UserAgent of
+// the client, see UserAgentFromContext.
+type DatagramHandler func(ctx context.Context, path string, dec func(any) error)
+
+// errNotDatagram is returned for a datagram which is not a QoS 0 Publish.
+var errNotDatagram = errors.New("qrpc: datagram is not a QoS 0 Publish")
+
+// SendDatagram sends msg on path to every connection of clientId in a
+// datagram, along with the outgoing metadata of ctx. PushCompressed and
+// PushSender apply, the other PushOptions are ignored.
+//
+// SendDatagram fails with Unavailable if the client is not connected, with
+// FailedPrecondition if its connections do not support datagrams, and with
+// ResourceExhausted if the message does not fit in a datagram. It returns
+// the first error of the connections.
+func (s *Server) SendDatagram(ctx context.Context, clientId, path string, msg any, opts ...PushOption) error {
+	po := defaultPushOptions
+	for _, o := range opts {
+		o.apply(&po)
+	}
+	conns := s.clientConns(clientId)
+	if len(conns) == 0 {
+		return status.Errorf(codes.Unavailable, "qrpc: client %q is not connected", clientId)
+	}
+	data, err := encodeDatagram(path, msg, po.props(ctx), po.compressed)
+	if err != nil {
+		return err
+	}
+	var first error
+	for _, c := range conns {
+		if err := sendDatagram(c.conn, data); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// SendDatagram sends msg on path to the server in a datagram, along with the
+// outgoing metadata of ctx. It fails with FailedPrecondition if the server
+// does not support datagrams, and with ResourceExhausted if the message does
+// not fit in a datagram. The server drops the datagram if it has no
+// DatagramHandler.
+func (cc *ClientConn) SendDatagram(ctx context.Context, path string, msg any) error {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	data, err := encodeDatagram(path, msg, mdToProps(md), false)
+	if err != nil {
+		return err
+	}
+	return sendDatagram(cc.conn, data)
+}
+
+// receiveDatagrams runs the DatagramHandler of the server for the datagrams
+// of the client, until the connection ends. The datagrams over the rate
+// limit and the malformed ones are dropped.
+func (c *qrpcConn) receiveDatagrams(ctx context.Context) {
+	limit := utils.NewTokenBucket(c.srv.opts.datagramRate, c.srv.opts.datagramBurst)
+	for {
+		data, err := c.conn.ReceiveDatagram(c.ctx)
+		if err != nil {
+			return
+		}
+		if !limit.Allow(time.Now()) {
+			continue
+		}
+		pub, err := decodeDatagram(data, c.plmk)
+		if err != nil {
+			continue
+		}
+		c.touch()
+		c.seen(true)
+		runDatagramHandler(ctx, c.srv.opts.onDatagram, pub, c.maxReceiveMessageSize)
+	}
+}
+
+// receiveDatagrams runs the DatagramHandler of the client for the datagrams
+// of the server, until the connection ends.
+func (cc *ClientConn) receiveDatagrams() {
+	ctx := cc.conn.Context()
+	for {
+		data, err := cc.conn.ReceiveDatagram(ctx)
+		if err != nil {
+			return
+		}
+		pub, err := decodeDatagram(data, cc.plmk)
+		if err != nil {
+			continue
+		}
+		runDatagramHandler(withSender(ctx, pub.Props), cc.opts.onDatagram, pub, 0)
+	}
+}
+
+// runDatagramHandler runs h for pub, whose message dec fails to decode if
+// it is larger than maxSize once inflated, unless maxSize is zero.
+func runDatagramHandler(ctx context.Context, h DatagramHandler, pub *codec.Publish, maxSize int) {
+	defer FreePayload(pub)
+	ctx = metadata.NewIncomingContext(ctx, propsToMD(pub.Props))
+	h(ctx, pub.Path, func(v any) error {
+		return decodePayload(v, pub.Payload, pub.Compressed, maxSize)
+	})
+}
+
+// encodeDatagram marshals msg and encodes it in the Publish carried by a
+// datagram.
+func encodeDatagram(path string, msg any, props codec.Props, compressed bool) ([]byte, error) {
+	bf, err := EncodePayload(msg, compressed)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "qrpc: error while marshaling: %v", err)
+	}
+	defer freeBuffer(bf)
+
+	pub := &codec.Publish{
+		Header: codec.Header{Compressed: compressed},
+		Path:   path,
+		Props:  props,
+	}
+	if bf != nil {
+		pub.Payload = bf
+	}
+	var buf bytes.Buffer
+	if err := pub.Encode(&buf); err != nil {
+		return nil, status.Errorf(codes.Internal, "qrpc: error while encoding: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeDatagram decodes the Publish carried by data.
+func decodeDatagram(data []byte, plmk codec.PayloadBuilder) (*codec.Publish, error) {
+	msg, err := codec.DecodeOneMessage(bytes.NewReader(data), plmk)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := msg.(*codec.Publish)
+	if !ok || pub.AckRequired {
+		if pc, ok := msg.(codec.PayloadContainer); ok {
+			FreePayload(pc)
+		}
+		return nil, errNotDatagram
+	}
+	return pub, nil
+}
+
+// sendDatagram sends data on conn in a datagram.
+func sendDatagram(conn quic.Connection, data []byte) error {
+	if !conn.ConnectionState().SupportsDatagrams {
+		return status.Error(codes.FailedPrecondition, "qrpc: datagrams are not supported by the peer")
+	}
+	err := conn.SendDatagram(data)
+	var tooLarge *quic.DatagramTooLargeError
+	if errors.As(err, &tooLarge) {
+		return status.Errorf(codes.ResourceExhausted, "qrpc: datagram of %d bytes larger than %d", len(data), tooLarge.MaxDatagramPayloadSize)
+	}
+	if err != nil {
+		return status.Errorf(codes.Unavailable, "qrpc: error while sending a datagram: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package qrpc
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/stonefire-oss/stonefire-im/demo/pb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestDatagrams(t *testing.T) {
+	received := make(chan string, 16)
+	s := NewServer(
+		HandleDatagrams(func(ctx context.Context, path string, dec func(any) error) {
+			var st pb.Student
+			if err := dec(&st); err != nil {
+				t.Errorf("dec() error = %v", err)
+				return
+			}
+			ua, _ := UserAgentFromContext(ctx)
+			md, _ := metadata.FromIncomingContext(ctx)
+			received <- ua.ClientId + " " + path + " " + st.Name + " " + strings.Join(md.Get("state"), ",")
+		}),
+		// A single datagram is let through every 10s past the first three.
+		DatagramRateLimit(0.1, 3),
+	)
+	ls, err := quic.ListenAddr("127.0.0.1:0", testTLSConfig(t), &quic.Config{EnableDatagrams: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ls)
+	t.Cleanup(s.Stop)
+	addr := ls.Addr().String()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	pushed := make(chan string, 1)
+	alice := newTestClient(t, addr, WithClientId("alice"),
+		WithDatagramHandler(func(ctx context.Context, path string, dec func(any) error) {
+			var st pb.Student
+			if err := dec(&st); err != nil {
+				t.Errorf("dec() error = %v", err)
+				return
+			}
+			sender, _ := SenderFromContext(ctx)
+			pushed <- sender + " " + path + " " + st.Name
+		}),
+	)
+
+	typing := metadata.AppendToOutgoingContext(ctx, "state", "typing")
+	for range 10 {
+		if err := alice.SendDatagram(typing, "/chat/typing", &pb.Student{Name: "room"}); err != nil {
+			t.Fatalf("ClientConn.SendDatagram() error = %v", err)
+		}
+	}
+	for range 3 {
+		select {
+		case got := <-received:
+			if want := "alice /chat/typing room typing"; got != want {
+				t.Errorf("received %q, want %q", got, want)
+			}
+		case <-ctx.Done():
+			t.Fatal("datagram not received")
+		}
+	}
+	select {
+	case got := <-received:
+		t.Errorf("received %q over the rate limit", got)
+	case <-time.After(time.Millisecond * 200):
+	}
+
+	if err := s.SendDatagram(ctx, "alice", "/chat/typing", &pb.Student{Name: "room"}, PushSender("bob")); err != nil {
+		t.Fatalf("Server.SendDatagram() error = %v", err)
+	}
+	select {
+	case got := <-pushed:
+		if want := "bob /chat/typing room"; got != want {
+			t.Errorf("pushed %q, want %q", got, want)
+		}
+	case <-ctx.Done():
+		t.Fatal("datagram not pushed")
+	}
+
+	large := &pb.Student{Name: strings.Repeat("x", 2000)}
+	if err := s.SendDatagram(ctx, "alice", "/chat/typing", large); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Server.SendDatagram() of a large message error = %v, want %v", err, codes.ResourceExhausted)
+	}
+	if err := s.SendDatagram(ctx, "nobody", "/chat/typing", &pb.Student{}); status.Code(err) != codes.Unavailable {
+		t.Errorf("Server.SendDatagram() to a client not connected error = %v, want %v", err, codes.Unavailable)
+	}
+
+	// A client enables datagrams only with a handler, or when asked to.
+	newTestClient(t, addr, WithClientId("bob"))
+	if err := s.SendDatagram(ctx, "bob", "/chat/typing", &pb.Student{}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Server.SendDatagram() to a client without a handler error = %v, want %v", err, codes.FailedPrecondition)
+	}
+	newTestClient(t, addr, WithClientId("carol"), WithQuicConfig(&quic.Config{EnableDatagrams: true}))
+	if err := s.SendDatagram(ctx, "carol", "/chat/typing", &pb.Student{}); err != nil {
+		t.Errorf("Server.SendDatagram() to a client with datagrams enabled error = %v", err)
+	}
+
+	// The test server does not enable datagrams.
+	_, addr = newTestServer(t)
+	cc := newTestClient(t, addr)
+	if err := cc.SendDatagram(ctx, "/chat/typing", &pb.Student{}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("ClientConn.SendDatagram() without support error = %v, want %v", err, codes.FailedPrecondition)
+	}
+}
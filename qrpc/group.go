@@ -0,0 +1,183 @@
+package qrpc
+
+import (
+	"context"
+	"slices"
+
+	"github.com/stonefire-oss/stonefire-im/pkg/codec"
+	"github.com/stonefire-oss/stonefire-im/pkg/store"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// A group is a set of ClientIds kept by the server, see AddGroupMembers,
+// which SendGroupMessage pushes a message to. The membership lives in memory,
+// the application restores it when the server starts.
+//
+// The message of a group is marshaled, compressed and encoded once: every
+// connection of the members gets the same frame, only its MessageId differs,
+// and the push windows share its payload by reference rather than copying it.
+// With a conversation store the message is also appended to the conversation
+// of the group, whose id is the name of the group, and carries its seq like
+// the messages of PushConversation.
+
+// AddGroupMembers adds clientIds to the members of group, creating it if
+// needed.
+func (s *Server) AddGroupMembers(group string, clientIds ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	members, ok := s.groups[group]
+	if !ok {
+		members = make(map[string]bool, len(clientIds))
+		s.groups[group] = members
+	}
+	for _, clientId := range clientIds {
+		members[clientId] = true
+	}
+}
+
+// RemoveGroupMembers removes clientIds from the members of group. The group
+// goes away with its last member.
+func (s *Server) RemoveGroupMembers(group string, clientIds ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	members, ok := s.groups[group]
+	if !ok {
+		return
+	}
+	for _, clientId := range clientIds {
+		delete(members, clientId)
+	}
+	if len(members) == 0 {
+		delete(s.groups, group)
+	}
+}
+
+// GroupMembers returns the ClientIds of the members of group, sorted.
+func (s *Server) GroupMembers(group string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	members := make([]string, 0, len(s.groups[group]))
+	for clientId := range s.groups[group] {
+		members = append(members, clientId)
+	}
+	slices.Sort(members)
+	return members
+}
+
+// SendGroupMessage pushes msg on path to every connection of the members of
+// group, along with the outgoing metadata of ctx, and returns the seq of the
+// message in the conversation of the group, zero without a conversation
+// store. It fails with NotFound if the group has no member.
+//
+// SendGroupMessage does not wait for the members to acknowledge the message,
+// it returns once the message is in the push windows of the connected
+// members. A QoS 1 message for a member which is not connected is stored if
+// the server has an offline store, SendGroupMessage then returns the first
+// error storing it. Otherwise the member misses it, and fetches it with
+// SyncConversation if the message was kept in a conversation.
+func (s *Server) SendGroupMessage(ctx context.Context, group, path string, msg any, opts ...PushOption) (uint64, error) {
+	po := defaultPushOptions
+	for _, o := range opts {
+		o.apply(&po)
+	}
+	if !po.qos.IsValid() {
+		return 0, status.Errorf(codes.InvalidArgument, "qrpc: invalid QoS %d", po.qos)
+	}
+	if len(s.GroupMembers(group)) == 0 {
+		return 0, status.Errorf(codes.NotFound, "qrpc: group %q has no member", group)
+	}
+
+	bf, err := EncodePayload(msg, po.compressed)
+	if err != nil {
+		return 0, status.Errorf(codes.Internal, "qrpc: error while marshaling: %v", err)
+	}
+	defer freeBuffer(bf)
+
+	pub := &codec.Publish{
+		Header: codec.Header{Compressed: po.compressed},
+		Path:   path,
+		Props:  po.props(ctx),
+	}
+	var seq uint64
+	if s.opts.conversations != nil {
+		stored := &store.Message{
+			Path:       path,
+			Props:      pub.Props,
+			Compressed: po.compressed,
+		}
+		if bf != nil {
+			stored.Payload = bf.ReadOnlyData()
+		}
+		if seq, err = s.appendConversation(group, stored); err != nil {
+			return 0, err
+		}
+		stored.Seq = seq
+		pub = conversationPublish(group, stored)
+	}
+	pub.Payload = nil
+	if bf != nil {
+		pub.Payload = bf
+	}
+	return seq, s.fanOut(group, pub, po.qos)
+}
+
+// fanOut queues pub in the push windows of the connections of the members of
+// group, it is encoded once for all of them. The windows take a reference on
+// the payload of the frame until their pushes complete.
+func (s *Server) fanOut(group string, pub *codec.Publish, qos codec.QosLevel) error {
+	pub.AckRequired = qos == codec.QosAtLeastOnce
+	f, err := codec.NewPublishFrame(pub)
+	if err != nil {
+		return status.Errorf(codes.Internal, "qrpc: error while encoding: %v", err)
+	}
+
+	var (
+		windows []*pushWindow
+		offline []string
+	)
+	storeAway := s.opts.offline != nil && qos == codec.QosAtLeastOnce
+	s.mu.Lock()
+	for clientId := range s.groups[group] {
+		devices := s.clients[clientId]
+		if len(devices) == 0 || storeAway && s.backlogs[clientId] {
+			offline = append(offline, clientId)
+			continue
+		}
+		windows = s.appendWindows(windows, devices)
+	}
+	s.mu.Unlock()
+
+	// The members away are stored for, unless they are back meanwhile.
+	var first error
+	if storeAway {
+		for _, clientId := range offline {
+			live, err := s.storeOffline(clientId, pub)
+			if err != nil && first == nil {
+				first = err
+			}
+			if live {
+				s.mu.Lock()
+				windows = s.appendWindows(windows, s.clients[clientId])
+				s.mu.Unlock()
+			}
+		}
+	}
+
+	// A member too far behind misses the message, as if it was away.
+	for _, w := range windows {
+		w.postFrame(f, pub.Props, qos)
+	}
+	return first
+}
+
+// appendWindows appends the push windows of the sessions of devices to
+// windows. s.mu must be held.
+func (s *Server) appendWindows(windows []*pushWindow, devices map[string]*qrpcConn) []*pushWindow {
+	for _, c := range devices {
+		if ss, ok := s.sessions[c.session]; ok {
+			windows = append(windows, ss.window)
+		}
+	}
+	return windows
+}
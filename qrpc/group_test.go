@@ -0,0 +1,113 @@
+package qrpc
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stonefire-oss/stonefire-im/demo/pb"
+	"github.com/stonefire-oss/stonefire-im/pkg/codec"
+	"github.com/stonefire-oss/stonefire-im/pkg/store"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestServer_Groups(t *testing.T) {
+	s, addr := newTestServer(t,
+		OfflineStore(store.NewMemory()),
+		ConversationStore(store.NewMemory()),
+	)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	s.AddGroupMembers("room", "alice", "bob", "carol")
+	s.AddGroupMembers("room", "dave")
+	s.RemoveGroupMembers("room", "dave")
+	if got, want := s.GroupMembers("room"), []string{"alice", "bob", "carol"}; !slices.Equal(got, want) {
+		t.Errorf("GroupMembers() = %v, want %v", got, want)
+	}
+
+	received := make(chan string, 8)
+	handler := func(clientId string) DialOption {
+		return WithPushHandler(func(ctx context.Context, path string, dec func(any) error) error {
+			var st pb.Student
+			if err := dec(&st); err != nil {
+				return err
+			}
+			conv, seq, _ := ConversationFromContext(ctx)
+			received <- fmt.Sprintf("%s %s %s/%d", clientId, st.Name, conv, seq)
+			return nil
+		})
+	}
+	newTestClient(t, addr, WithClientId("alice"), handler("alice"))
+	newTestClient(t, addr, WithClientId("bob"), handler("bob"))
+
+	for i, opts := range [][]PushOption{
+		nil,
+		{PushCompressed(true)},
+		{PushQos(codec.QosAtMostOnce)},
+	} {
+		seq, err := s.SendGroupMessage(ctx, "room", testPushPath, &pb.Student{Name: fmt.Sprint(i)}, opts...)
+		if err != nil {
+			t.Fatalf("SendGroupMessage() error = %v", err)
+		}
+		if want := uint64(i + 1); seq != want {
+			t.Errorf("SendGroupMessage() seq = %d, want %d", seq, want)
+		}
+	}
+	// carol gets the QoS 1 messages once connected.
+	newTestClient(t, addr, WithClientId("carol"), handler("carol"))
+
+	want := []string{
+		"alice 0 room/1", "alice 1 room/2", "alice 2 room/3",
+		"bob 0 room/1", "bob 1 room/2", "bob 2 room/3",
+		"carol 0 room/1", "carol 1 room/2",
+	}
+	var got []string
+	for range want {
+		select {
+		case m := <-received:
+			got = append(got, m)
+		case <-ctx.Done():
+			t.Fatalf("received %v, want %v", got, want)
+		}
+	}
+	slices.Sort(got)
+	if !slices.Equal(got, want) {
+		t.Errorf("received %v, want %v", got, want)
+	}
+
+	s.RemoveGroupMembers("room", "alice", "bob", "carol")
+	if _, err := s.SendGroupMessage(ctx, "room", testPushPath, &pb.Student{}); status.Code(err) != codes.NotFound {
+		t.Errorf("SendGroupMessage() to an empty group error = %v, want %v", err, codes.NotFound)
+	}
+}
+
+func TestServer_GroupSlowMember(t *testing.T) {
+	s, addr := newTestServer(t, PushWindowSize(4))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	release := make(chan struct{})
+	defer close(release)
+
+	s.AddGroupMembers("room", "alice")
+	newTestClient(t, addr, WithClientId("alice"), WithPushHandler(func(ctx context.Context, path string, dec func(any) error) error {
+		<-release
+		return nil
+	}))
+
+	before := runtime.NumGoroutine()
+	for i := range 200 {
+		if _, err := s.SendGroupMessage(ctx, "room", testPushPath, &pb.Student{Name: fmt.Sprint(i)}); err != nil {
+			t.Fatalf("SendGroupMessage() error = %v", err)
+		}
+	}
+	time.Sleep(time.Millisecond * 100)
+	// The messages wait in the queue of the window, not in goroutines.
+	if n := runtime.NumGoroutine() - before; n > 50 {
+		t.Errorf("%d more goroutines for the messages of a slow member", n)
+	}
+}
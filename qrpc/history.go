@@ -0,0 +1,366 @@
+package qrpc
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/stonefire-oss/stonefire-im/pkg/codec"
+	"github.com/stonefire-oss/stonefire-im/pkg/store"
+	"github.com/stonefire-oss/stonefire-im/pkg/utils"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The history of a conversation is served from the conversation store of the
+// server when it is a store.HistoryStore, like store.Memory. A client pages
+// through it with History, by seq or by time, forward or backward: every
+// page comes with an opaque cursor, which History takes to get the next one.
+// The cursor holds the query of the first page, narrowed down to the
+// messages past the page. A client can also delete messages for itself with
+// DeleteHistory, History skips them for all its devices from then on.
+const (
+	// historyMethod is the path of the history call, which the server
+	// answers like the sync call, the PubAck carrying the cursor of the
+	// next page.
+	historyMethod = "/qrpc.History/Fetch"
+	// The Props of the history call. historyCursorKey is also set on the
+	// PubAck, unless the page is the last one.
+	historyCursorKey   = "qrpc-history-cursor"
+	historyAfterKey    = "qrpc-history-after"
+	historyBeforeKey   = "qrpc-history-before"
+	historySinceKey    = "qrpc-history-since"
+	historyUntilKey    = "qrpc-history-until"
+	historyBackwardKey = "qrpc-history-backward"
+	historyLimitKey    = "qrpc-history-limit"
+
+	// historyDeleteMethod is the path of the DeleteHistory call, the seqs
+	// deleted are the values of historySeqsKey.
+	historyDeleteMethod = "/qrpc.History/Delete"
+	historySeqsKey      = "qrpc-history-seqs"
+
+	defaultHistoryPage = 50
+	maxHistoryPage     = 200
+
+	historyCursorVersion = 1
+)
+
+var errMalformedCursor = errors.New("qrpc: malformed history cursor")
+
+// HistoryQuery selects a page of the history of a conversation, see
+// ClientConn.History.
+type HistoryQuery struct {
+	// After and Before bound the seqs of the messages, both excluded. Zero
+	// is no bound.
+	After, Before uint64
+	// Since and Until bound the times the messages were stored, Since
+	// included and Until excluded, to the millisecond. The zero time is no
+	// bound.
+	Since, Until time.Time
+	// Backward pages from the newest messages to the oldest ones.
+	Backward bool
+	// Limit is the size of the page, 50 if zero. The server returns at most
+	// 200 messages per page.
+	Limit int
+	// Cursor is the Next of the previous page, it continues the paging
+	// where it ended. The fields above but Limit are ignored then.
+	Cursor string
+}
+
+// HistoryPage is a page of the history of a conversation.
+type HistoryPage struct {
+	// Messages are oldest first, or newest first when paging backward.
+	Messages []*ConversationMessage
+	// Next is the cursor of the next page, empty on the last one.
+	Next string
+}
+
+// History returns a page of the messages of the conversation conv selected
+// by q, leaving out those the client deleted, see DeleteHistory. The server
+// decides which conversations the client can read, see ConversationAccess.
+func (cc *ClientConn) History(ctx context.Context, conv string, q HistoryQuery) (*HistoryPage, error) {
+	req := &codec.Publish{
+		Header:    codec.Header{AckRequired: true},
+		MessageId: cc.nextMessageId(),
+		Path:      historyMethod,
+		Props:     outgoingProps(ctx),
+	}
+	if req.Props == nil {
+		req.Props = make(codec.Props)
+	}
+	req.Props[ConversationIdProp] = []string{conv}
+	if q.Limit > 0 {
+		req.Props[historyLimitKey] = []string{strconv.Itoa(q.Limit)}
+	}
+	if q.Cursor != "" {
+		req.Props[historyCursorKey] = []string{q.Cursor}
+	} else {
+		if q.After > 0 {
+			req.Props[historyAfterKey] = []string{strconv.FormatUint(q.After, 10)}
+		}
+		if q.Before > 0 {
+			req.Props[historyBeforeKey] = []string{strconv.FormatUint(q.Before, 10)}
+		}
+		if !q.Since.IsZero() {
+			req.Props[historySinceKey] = []string{strconv.FormatInt(q.Since.UnixMilli(), 10)}
+		}
+		if !q.Until.IsZero() {
+			req.Props[historyUntilKey] = []string{strconv.FormatInt(q.Until.UnixMilli(), 10)}
+		}
+		if q.Backward {
+			req.Props[historyBackwardKey] = []string{"1"}
+		}
+	}
+	msgs, props, err := cc.fetchConversation(ctx, req, "History")
+	if err != nil {
+		return nil, err
+	}
+	return &HistoryPage{Messages: msgs, Next: propValue(props, historyCursorKey)}, nil
+}
+
+// DeleteHistory deletes the messages seqs of the conversation conv for the
+// client: History leaves them out for all its devices, the other members of
+// the conversation still get them.
+func (cc *ClientConn) DeleteHistory(ctx context.Context, conv string, seqs ...uint64) error {
+	req := &codec.Publish{
+		Header:    codec.Header{AckRequired: true},
+		MessageId: cc.nextMessageId(),
+		Path:      historyDeleteMethod,
+		Props:     outgoingProps(ctx),
+	}
+	if req.Props == nil {
+		req.Props = make(codec.Props)
+	}
+	req.Props[ConversationIdProp] = []string{conv}
+	for _, seq := range seqs {
+		req.Props[historySeqsKey] = append(req.Props[historySeqsKey], strconv.FormatUint(seq, 10))
+	}
+	reply, err := cc.roundTrip(ctx, req)
+	if err != nil {
+		return err
+	}
+	ack, ok := reply.(*codec.PubAck)
+	if !ok || ack.MessageId != req.MessageId {
+		return status.Errorf(codes.Internal, "qrpc: unexpected %v frame in reply to DeleteHistory", reply)
+	}
+	defer FreePayload(ack)
+	return statusError(ack.Status, ack.Trailer)
+}
+
+// historyStore returns the conversation store of the server if it serves
+// the history of the conversations.
+func (s *Server) historyStore() (store.HistoryStore, bool) {
+	hs, ok := s.opts.conversations.(store.HistoryStore)
+	return hs, ok
+}
+
+// handleHistory serves a history call, the messages of the page are written
+// before the reply, which carries the cursor of the next page.
+func (s *Server) handleHistory(ctx context.Context, req *codec.Publish, fw *frameWriter) (codec.Props, error) {
+	hs, ok := s.historyStore()
+	if !ok {
+		return nil, status.Error(Unimplemented, "qrpc: no history store")
+	}
+	conv := propValue(req.Props, ConversationIdProp)
+	q, err := parseHistoryQuery(conv, req.Props)
+	if conv == "" || err != nil {
+		return nil, status.Error(InvalidArgument, "qrpc: malformed History request")
+	}
+	if s.opts.conversationAccess == nil {
+		return nil, status.Error(PermissionDenied, "qrpc: conversations cannot be read")
+	}
+	if err := s.opts.conversationAccess(ctx, conv); err != nil {
+		return nil, err
+	}
+
+	// One more message than the page tells whether there is a next one.
+	limit := q.Limit
+	q.Limit++
+	q.Viewer = qrpcConnFromContext(ctx).session.clientId
+	msgs, err := hs.History(conv, q)
+	if err != nil {
+		return nil, status.Error(Internal, err.Error())
+	}
+	var props codec.Props
+	if len(msgs) > limit {
+		msgs = msgs[:limit]
+		props = codec.Props{historyCursorKey: {nextHistoryCursor(conv, q, msgs[limit-1])}}
+	}
+	for _, m := range msgs {
+		if err := fw.WriteMessage(conversationPublish(conv, m)); err != nil {
+			return nil, err
+		}
+	}
+	return props, nil
+}
+
+// handleHistoryDelete serves a DeleteHistory call.
+func (s *Server) handleHistoryDelete(ctx context.Context, req *codec.Publish, fw *frameWriter) (codec.Props, error) {
+	hs, ok := s.historyStore()
+	if !ok {
+		return nil, status.Error(Unimplemented, "qrpc: no history store")
+	}
+	conv := propValue(req.Props, ConversationIdProp)
+	seqs := make([]uint64, 0, len(req.Props[historySeqsKey]))
+	for _, v := range req.Props[historySeqsKey] {
+		seq, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return nil, status.Error(InvalidArgument, "qrpc: malformed DeleteHistory request")
+		}
+		seqs = append(seqs, seq)
+	}
+	if conv == "" {
+		return nil, status.Error(InvalidArgument, "qrpc: malformed DeleteHistory request")
+	}
+	if s.opts.conversationAccess == nil {
+		return nil, status.Error(PermissionDenied, "qrpc: the history of conversations cannot be deleted")
+	}
+	if err := s.opts.conversationAccess(ctx, conv); err != nil {
+		return nil, err
+	}
+
+	if err := hs.Delete(conv, qrpcConnFromContext(ctx).session.clientId, seqs...); err != nil {
+		return nil, status.Error(Internal, err.Error())
+	}
+	return nil, nil
+}
+
+// parseHistoryQuery returns the query of a history call on conv, its Limit
+// set to the size of the page.
+func parseHistoryQuery(conv string, p codec.Props) (store.HistoryQuery, error) {
+	var q store.HistoryQuery
+	limit := defaultHistoryPage
+	if v := propValue(p, historyLimitKey); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return q, errors.New("qrpc: malformed history limit")
+		}
+		limit = min(n, maxHistoryPage)
+	}
+
+	if cursor := propValue(p, historyCursorKey); cursor != "" {
+		cconv, cq, err := decodeHistoryCursor(cursor)
+		if err != nil || cconv != conv {
+			return q, errMalformedCursor
+		}
+		q = cq
+	} else {
+		var err1, err2, err3, err4 error
+		q.After, err1 = parseUintProp(p, historyAfterKey)
+		q.Before, err2 = parseUintProp(p, historyBeforeKey)
+		q.Since, err3 = parseTimeProp(p, historySinceKey)
+		q.Until, err4 = parseTimeProp(p, historyUntilKey)
+		if err := errors.Join(err1, err2, err3, err4); err != nil {
+			return q, err
+		}
+		q.Backward = propValue(p, historyBackwardKey) == "1"
+	}
+	q.Limit = limit
+	return q, nil
+}
+
+// parseUintProp parses the value of key in p, zero if it is not set.
+func parseUintProp(p codec.Props, key string) (uint64, error) {
+	v := propValue(p, key)
+	if v == "" {
+		return 0, nil
+	}
+	return strconv.ParseUint(v, 10, 64)
+}
+
+// parseTimeProp parses the value of key in p, in Unix milliseconds, the
+// zero time if it is not set.
+func parseTimeProp(p codec.Props, key string) (time.Time, error) {
+	v := propValue(p, key)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	ms, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.UnixMilli(ms), nil
+}
+
+// nextHistoryCursor returns the cursor of the page after the one of q
+// ending with last.
+func nextHistoryCursor(conv string, q store.HistoryQuery, last *store.Message) string {
+	if q.Backward {
+		q.Before = last.Seq
+	} else {
+		q.After = last.Seq
+	}
+	return encodeHistoryCursor(conv, q)
+}
+
+// encodeHistoryCursor returns the cursor of the query q on conv: its
+// version, conv, the seq bounds as uvarints, the time bounds in Unix
+// nanoseconds as varints, zero for none, and whether it is backward,
+// encoded in base64.
+func encodeHistoryCursor(conv string, q store.HistoryQuery) string {
+	b := []byte{historyCursorVersion}
+	b = binary.AppendUvarint(b, uint64(len(conv)))
+	b = append(b, conv...)
+	b = binary.AppendUvarint(b, q.After)
+	b = binary.AppendUvarint(b, q.Before)
+	b = binary.AppendVarint(b, utils.UnixNano(q.Since))
+	b = binary.AppendVarint(b, utils.UnixNano(q.Until))
+	if q.Backward {
+		b = append(b, 1)
+	} else {
+		b = append(b, 0)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeHistoryCursor returns the conversation and the query of cursor.
+func decodeHistoryCursor(cursor string) (string, store.HistoryQuery, error) {
+	var q store.HistoryQuery
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(b) == 0 || b[0] != historyCursorVersion {
+		return "", q, errMalformedCursor
+	}
+	b = b[1:]
+	failed := false
+	uvarint := func() uint64 {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			failed = true
+			return 0
+		}
+		b = b[n:]
+		return v
+	}
+	varint := func() int64 {
+		v, n := binary.Varint(b)
+		if n <= 0 {
+			failed = true
+			return 0
+		}
+		b = b[n:]
+		return v
+	}
+
+	n := uvarint()
+	if failed || n > uint64(len(b)) {
+		return "", q, errMalformedCursor
+	}
+	conv := string(b[:n])
+	b = b[n:]
+	q.After = uvarint()
+	q.Before = uvarint()
+	if ns := varint(); ns != 0 {
+		q.Since = time.Unix(0, ns)
+	}
+	if ns := varint(); ns != 0 {
+		q.Until = time.Unix(0, ns)
+	}
+	if failed || len(b) != 1 || b[0] > 1 {
+		return "", q, errMalformedCursor
+	}
+	q.Backward = b[0] == 1
+	return conv, q, nil
+}
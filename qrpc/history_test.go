@@ -0,0 +1,101 @@
+package qrpc
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stonefire-oss/stonefire-im/demo/pb"
+	"github.com/stonefire-oss/stonefire-im/pkg/store"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestClientConn_History(t *testing.T) {
+	access := func(ctx context.Context, conv string) error {
+		if ua, ok := UserAgentFromContext(ctx); ok && ua.ClientId != "bob" {
+			return nil
+		}
+		return status.Error(codes.PermissionDenied, "not a member")
+	}
+	s, addr := newTestServer(t, ConversationStore(store.NewMemory()), ConversationAccess(access))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	for i := range 7 {
+		if _, err := s.PushConversation(ctx, "room", nil, testPushPath, &pb.Student{Name: fmt.Sprint(i + 1)}); err != nil {
+			t.Fatalf("PushConversation() error = %v", err)
+		}
+	}
+	alice := newTestClient(t, addr, WithClientId("alice"))
+	if err := alice.DeleteHistory(ctx, "room", 3); err != nil {
+		t.Fatalf("DeleteHistory() error = %v", err)
+	}
+
+	// pages returns the seqs of the pages of the history of room from q on.
+	pages := func(cc *ClientConn, q HistoryQuery) [][]uint64 {
+		t.Helper()
+		var res [][]uint64
+		for {
+			page, err := cc.History(ctx, "room", q)
+			if err != nil {
+				t.Fatalf("History() error = %v", err)
+			}
+			var seqs []uint64
+			for _, m := range page.Messages {
+				var st pb.Student
+				if err := m.Decode(&st); err != nil {
+					t.Fatalf("Decode() error = %v", err)
+				}
+				if st.Name != fmt.Sprint(m.Seq) || m.Time.IsZero() {
+					t.Errorf("History() message %d = %q at %v", m.Seq, st.Name, m.Time)
+				}
+				seqs = append(seqs, m.Seq)
+			}
+			res = append(res, seqs)
+			if page.Next == "" {
+				return res
+			}
+			q.Cursor = page.Next
+		}
+	}
+	tests := []struct {
+		name string
+		cc   *ClientConn
+		q    HistoryQuery
+		want [][]uint64
+	}{
+		{name: "forward", cc: alice, q: HistoryQuery{Limit: 3}, want: [][]uint64{{1, 2, 4}, {5, 6, 7}}},
+		{name: "backward", cc: alice, q: HistoryQuery{Backward: true, Limit: 4}, want: [][]uint64{{7, 6, 5, 4}, {2, 1}}},
+		{name: "range", cc: alice, q: HistoryQuery{After: 1, Before: 6, Limit: 2}, want: [][]uint64{{2, 4}, {5}}},
+		{name: "until", cc: alice, q: HistoryQuery{Until: time.Now().Add(-time.Hour)}, want: [][]uint64{nil}},
+		{name: "not deleted for others", cc: newTestClient(t, addr, WithClientId("carol")), q: HistoryQuery{After: 2, Before: 4}, want: [][]uint64{{3}}},
+	}
+	for _, tt := range tests {
+		if got := pages(tt.cc, tt.q); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: History() pages = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	page, err := alice.History(ctx, "room", HistoryQuery{Limit: 1})
+	if err != nil {
+		t.Fatalf("History() error = %v", err)
+	}
+	for _, cursor := range []string{"garbage", page.Next} {
+		if _, err := alice.History(ctx, "other", HistoryQuery{Cursor: cursor}); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("History() with cursor %q error = %v, want %v", cursor, err, codes.InvalidArgument)
+		}
+	}
+	bob := newTestClient(t, addr, WithClientId("bob"))
+	if _, err := bob.History(ctx, "room", HistoryQuery{}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("History() of a stranger error = %v, want %v", err, codes.PermissionDenied)
+	}
+
+	_, addr = newTestServer(t)
+	cc := newTestClient(t, addr)
+	if _, err := cc.History(ctx, "room", HistoryQuery{}); status.Code(err) != codes.Unimplemented {
+		t.Errorf("History() without a history store error = %v, want %v", err, codes.Unimplemented)
+	}
+}
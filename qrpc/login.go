@@ -0,0 +1,128 @@
+package qrpc
+
+import (
+	"fmt"
+
+	"github.com/stonefire-oss/stonefire-im/pkg/codec"
+)
+
+// DeviceIdProp is the Connect.Props key carrying the device id of a client,
+// which tells its connections apart under the MultiDevice policy.
+const DeviceIdProp = "qrpc-device-id"
+
+func deviceId(p codec.Props) string {
+	if v := p[DeviceIdProp]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// LoginPolicy decides what happens when a client connects with the ClientId
+// of a connected one.
+type LoginPolicy uint8
+
+const (
+	// KickOld lets the new connection in. The old one is sent a Disconnect
+	// with DisconnectSessionTakenOver and is closed once the client hung up
+	// or the idle timeout passed.
+	KickOld LoginPolicy = iota
+	// RejectNew refuses the new connection with RetCodeClientIdInUse, Dial
+	// fails with AlreadyExists. A client whose connection broke without
+	// closing is refused until the server reaped it as idle.
+	RejectNew
+	// MultiDevice lets a client connect from several devices at once,
+	// distinguished by the DeviceIdProp of their Connect. A second connection
+	// from the same device kicks the first one as with KickOld.
+	MultiDevice
+)
+
+func (p LoginPolicy) String() string {
+	switch p {
+	case KickOld:
+		return "kick old"
+	case RejectNew:
+		return "reject new"
+	case MultiDevice:
+		return "multi device"
+	default:
+		return fmt.Sprintf("unknown policy %d", p)
+	}
+}
+
+// sessionKey identifies the session of a connection: its ClientId and, under
+// the MultiDevice policy, its device id.
+type sessionKey struct {
+	clientId string
+	deviceId string
+}
+
+// addClient registers c as the connection of its session according to the
+// login policy, and opens the session. It reports false if c is refused, and
+// whether an existing session was resumed.
+func (s *Server) addClient(c *qrpcConn, clean bool) (ok, sessionPresent bool) {
+	c.session = sessionKey{clientId: c.ua.ClientId}
+	if s.opts.loginPolicy == MultiDevice {
+		c.session.deviceId = c.ua.DeviceId
+	}
+
+	s.mu.Lock()
+	devices := s.clients[c.session.clientId]
+	old := devices[c.session.deviceId]
+	if old != nil && s.opts.loginPolicy == RejectNew {
+		s.mu.Unlock()
+		return false, false
+	}
+	if devices == nil {
+		devices = make(map[string]*qrpcConn)
+		s.clients[c.session.clientId] = devices
+	}
+	devices[c.session.deviceId] = c
+	if s.opts.offline != nil && !s.backlogs[c.session.clientId] {
+		// The messages pushed from now on are stored after the backlog
+		// until it is delivered.
+		s.backlogs[c.session.clientId] = true
+		c.backlog = true
+	}
+	s.mu.Unlock()
+
+	if old != nil {
+		go old.kick()
+	}
+	return true, s.openSession(c, clean)
+}
+
+// removeClient unregisters c once it is closed.
+func (s *Server) removeClient(c *qrpcConn) {
+	s.mu.Lock()
+	if devices := s.clients[c.session.clientId]; devices[c.session.deviceId] == c {
+		delete(devices, c.session.deviceId)
+		if len(devices) == 0 {
+			delete(s.clients, c.session.clientId)
+		}
+	}
+	s.mu.Unlock()
+	if s.presence != nil {
+		s.presence.disconnected(c.session.clientId)
+	}
+	s.closeSession(c)
+}
+
+// clientConns returns the connections of clientId, one per device.
+func (s *Server) clientConns(clientId string) []*qrpcConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	devices := s.clients[clientId]
+	conns := make([]*qrpcConn, 0, len(devices))
+	for _, c := range devices {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// kick disconnects a connection whose session was taken over by another
+// one.
+func (c *qrpcConn) kick() {
+	c.will.Store(nil)
+	c.disconnect(DisconnectSessionTakenOver)
+	c.lingerClose(SessionTakenOverErr)
+}
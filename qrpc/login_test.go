@@ -0,0 +1,84 @@
+package qrpc
+
+import (
+	"context"
+	"crypto/tls"
+	"slices"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestServer_DuplicateLogin(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy LoginPolicy
+		first  string // device id of the first connection
+		second string // device id of the second connection
+		// wantCode is the code of the second Dial.
+		wantCode codes.Code
+		// wantKick tells whether the first connection is kicked.
+		wantKick bool
+		// wantPushed lists the connections the pushes reach.
+		wantPushed []string
+	}{
+		{name: "kick old", policy: KickOld, wantKick: true, wantPushed: []string{"second"}},
+		{name: "kick old ignores devices", policy: KickOld, first: "phone", second: "laptop", wantKick: true, wantPushed: []string{"second"}},
+		{name: "reject new", policy: RejectNew, wantCode: codes.AlreadyExists, wantPushed: []string{"first"}},
+		{name: "multi device", policy: MultiDevice, first: "phone", second: "laptop", wantPushed: []string{"first", "second"}},
+		{name: "multi device same device", policy: MultiDevice, first: "phone", second: "phone", wantKick: true, wantPushed: []string{"second"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, addr := newTestServer(t, DuplicateLogin(tt.policy))
+			pushed := make(chan string, 2)
+			handler := func(name string) DialOption {
+				return WithPushHandler(func(ctx context.Context, path string, dec func(any) error) error {
+					pushed <- name
+					return nil
+				})
+			}
+			reasons := make(chan DisconnectReason, 1)
+			newTestClient(t, addr, WithClientId("alice"), WithDeviceId(tt.first), handler("first"),
+				WithDisconnectHandler(func(r DisconnectReason) { reasons <- r }))
+
+			tlsConf := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{testALPN}}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+			defer cancel()
+			second, err := Dial(ctx, addr, tlsConf, WithClientId("alice"), WithDeviceId(tt.second), handler("second"))
+			if c := status.Code(err); c != tt.wantCode {
+				t.Fatalf("second Dial() code = %v, want %v (%v)", c, tt.wantCode, err)
+			}
+			if err == nil {
+				t.Cleanup(func() { second.Close() })
+			}
+
+			select {
+			case r := <-reasons:
+				if !tt.wantKick {
+					t.Errorf("first connection disconnected: %v", r)
+				} else if r != DisconnectSessionTakenOver {
+					t.Errorf("Disconnect reason = %v, want %v", r, DisconnectSessionTakenOver)
+				}
+			case <-time.After(time.Millisecond * 200):
+				if tt.wantKick {
+					t.Error("the first connection was not kicked")
+				}
+			}
+
+			if err := testPush(s, "alice", "bob"); err != nil {
+				t.Fatalf("Push() error = %v", err)
+			}
+			var got []string
+			for range tt.wantPushed {
+				got = append(got, <-pushed)
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.wantPushed) {
+				t.Errorf("pushed to %v, want %v", got, tt.wantPushed)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package qrpc
+
+import (
+	"github.com/stonefire-oss/stonefire-im/pkg/codec"
+	"github.com/stonefire-oss/stonefire-im/pkg/store"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// A server with an offline store, see OfflineStore, keeps the QoS 1 pushes
+// to the clients which are not connected instead of failing them. Once a
+// client connects, the messages stored for its ClientId are pushed to it
+// one after the other, oldest first, and dropped from the store as it
+// acknowledges them. A client connected from several devices gets them on
+// the first one which connects, or on another one if it goes away first.
+// Until the backlog is delivered the messages to the client are stored
+// after it rather than pushed, so that they do not overtake it.
+
+// backlogBatch is the number of stored messages fetched at once.
+const backlogBatch = 64
+
+// storeOffline stores pub for the client clientId, unless the client is
+// connected and its backlog delivered: it then reports true and pub is to
+// be pushed.
+func (s *Server) storeOffline(clientId string, pub *codec.Publish) (live bool, err error) {
+	s.offlineMu.Lock()
+	defer s.offlineMu.Unlock()
+	s.mu.Lock()
+	live = len(s.clients[clientId]) > 0 && !s.backlogs[clientId]
+	s.mu.Unlock()
+	if live {
+		return true, nil
+	}
+
+	msg := &store.Message{
+		Path:       pub.Path,
+		Props:      pub.Props,
+		Compressed: pub.Compressed,
+	}
+	if pub.Payload != nil {
+		msg.Payload = pub.Payload.ReadOnlyData()
+	}
+	if _, err := s.opts.offline.Append(clientId, msg); err != nil {
+		if err == store.ErrQuotaExceeded || err == store.ErrTooLarge {
+			return false, status.Errorf(codes.ResourceExhausted, "qrpc: offline messages of client %q: %v", clientId, err)
+		}
+		return false, status.Errorf(codes.Unavailable, "qrpc: client %q is not connected and its message could not be stored: %v", clientId, err)
+	}
+	return false, nil
+}
+
+// deliverBacklog pushes the messages stored for the client of c over c,
+// until there are none left or c goes away. The messages stored meanwhile
+// are delivered too.
+func (s *Server) deliverBacklog(c *qrpcConn) {
+	clientId := c.session.clientId
+	var after uint64
+	for {
+		s.offlineMu.Lock()
+		msgs, err := s.opts.offline.Fetch(clientId, after, backlogBatch)
+		if err != nil || len(msgs) == 0 {
+			s.mu.Lock()
+			delete(s.backlogs, clientId)
+			s.mu.Unlock()
+			s.offlineMu.Unlock()
+			return
+		}
+		s.offlineMu.Unlock()
+
+		for _, m := range msgs {
+			pub := &codec.Publish{
+				Header: codec.Header{Compressed: m.Compressed},
+				Path:   m.Path,
+				Props:  m.Props,
+			}
+			if len(m.Payload) > 0 {
+				pub.Payload = codec.SlicePayload(m.Payload)
+			}
+			// The status of the PushHandler does not matter, the message
+			// was delivered.
+			err := s.publish(c.ctx, c.session, pub)
+			if c.ctx.Err() != nil || err == errSessionEnded || s.quit.HasFired() {
+				s.handOverBacklog(c)
+				return
+			}
+			if err := s.opts.offline.Ack(clientId, m.Seq); err != nil {
+				s.handOverBacklog(c)
+				return
+			}
+			after = m.Seq
+		}
+	}
+}
+
+// handOverBacklog hands the delivery of the backlog of the client of c,
+// which gave up, to another connection of the client if there is one.
+func (s *Server) handOverBacklog(c *qrpcConn) {
+	clientId := c.session.clientId
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.quit.HasFired() {
+		for _, other := range s.clients[clientId] {
+			if other != c && other.ctx.Err() == nil {
+				go s.deliverBacklog(other)
+				return
+			}
+		}
+	}
+	delete(s.backlogs, clientId)
+}
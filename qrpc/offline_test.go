@@ -0,0 +1,114 @@
+package qrpc
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stonefire-oss/stonefire-im/demo/pb"
+	"github.com/stonefire-oss/stonefire-im/pkg/codec"
+	"github.com/stonefire-oss/stonefire-im/pkg/store"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestServer_OfflineStore(t *testing.T) {
+	st := store.NewMemory(store.MaxMessages(3))
+	s, addr := newTestServer(t, OfflineStore(st))
+
+	names := []string{"1", "2", "3"}
+	for _, n := range names {
+		if err := testPush(s, "alice", n); err != nil {
+			t.Fatalf("Push(%s) error = %v", n, err)
+		}
+	}
+	if c := status.Code(testPush(s, "alice", "4")); c != codes.ResourceExhausted {
+		t.Errorf("Push() over quota code = %v, want %v", c, codes.ResourceExhausted)
+	}
+	if c := status.Code(testPush(s, "alice", "5", PushQos(codec.QosAtMostOnce))); c != codes.Unavailable {
+		t.Errorf("Push(QosAtMostOnce) code = %v, want %v", c, codes.Unavailable)
+	}
+
+	var (
+		mu  sync.Mutex
+		got []string
+	)
+	done := make(chan struct{})
+	newTestClient(t, addr, WithClientId("alice"), WithPushHandler(func(ctx context.Context, path string, dec func(any) error) error {
+		var m pb.Student
+		if err := dec(&m); err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, m.Name)
+		if len(got) == len(names) {
+			close(done)
+		}
+		return nil
+	}))
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("the backlog was not delivered")
+	}
+	mu.Lock()
+	if !slices.Equal(got, names) {
+		t.Errorf("delivered %v, want %v", got, names)
+	}
+	mu.Unlock()
+
+	// The messages are dropped from the store once acknowledged.
+	time.Sleep(time.Millisecond * 50)
+	if msgs, _ := st.Fetch("alice", 0, 10); len(msgs) != 0 {
+		t.Errorf("%d messages left in the store", len(msgs))
+	}
+}
+
+func TestServer_OfflineBacklogOrder(t *testing.T) {
+	s, addr := newTestServer(t, OfflineStore(store.NewMemory()))
+	for _, n := range []string{"1", "2", "3"} {
+		if err := testPush(s, "alice", n); err != nil {
+			t.Fatalf("Push(%s) error = %v", n, err)
+		}
+	}
+
+	var (
+		mu  sync.Mutex
+		got []string
+	)
+	done := make(chan struct{})
+	newTestClient(t, addr, WithClientId("alice"), WithPushHandler(func(ctx context.Context, path string, dec func(any) error) error {
+		var m pb.Student
+		if err := dec(&m); err != nil {
+			return err
+		}
+		// Slow enough for the next push to be made before the backlog is
+		// delivered.
+		time.Sleep(time.Millisecond * 50)
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, m.Name)
+		if len(got) == 4 {
+			close(done)
+		}
+		return nil
+	}))
+	if err := testPush(s, "alice", "4"); err != nil {
+		t.Fatalf("Push(4) error = %v", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("the messages were not delivered")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"1", "2", "3", "4"}; !slices.Equal(got, want) {
+		t.Errorf("delivered %v, want %v", got, want)
+	}
+}
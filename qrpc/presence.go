@@ -0,0 +1,464 @@
+package qrpc
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/stonefire-oss/stonefire-im/pkg/codec"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// A server with presence enabled, see EnablePresence, follows whether every
+// ClientId is online, away or offline, and when it was last seen.
+//
+// A client is online from its Connect on, and stays so as long as it makes
+// calls, publishes or subscribes. One which only sends Pings, such as an
+// application left in the background, is away once PresenceAwayTimeout
+// passed since the last of those, and online again with the next one. The
+// client goes offline when its last connection closes, after
+// PresenceDebounce: a mobile client whose connection flaps and comes back
+// within that time is seen online all along. Every frame of the client, Pings
+// included, updates its last seen time.
+//
+// Clients follow the presence of their contacts with WatchPresence, which
+// PresenceAccess allows.
+
+// PresenceStatus is the presence of a client.
+type PresenceStatus uint8
+
+const (
+	PresenceOffline PresenceStatus = iota
+	PresenceOnline
+	PresenceAway
+)
+
+func (p PresenceStatus) String() string {
+	switch p {
+	case PresenceOffline:
+		return "offline"
+	case PresenceOnline:
+		return "online"
+	case PresenceAway:
+		return "away"
+	default:
+		return fmt.Sprintf("unknown presence %d", p)
+	}
+}
+
+// Presence is the presence of the client ClientId. LastSeen is the time of
+// its last frame, zero if it was never seen.
+type Presence struct {
+	ClientId string
+	Status   PresenceStatus
+	LastSeen time.Time
+}
+
+const (
+	defaultPresenceAwayTimeout = time.Minute * 5
+	defaultPresenceDebounce    = time.Second * 10
+
+	// presenceMethod is the path of the watch call, which the server answers
+	// with a Publish for the presence of each client watched, then one for
+	// each change, until the call ends.
+	presenceMethod = "/qrpc.Presence/Watch"
+	// presenceIdKey holds the ClientIds to watch in the request, and the
+	// ClientId of the presence in the Publish frames, along with its status
+	// in decimal and its last seen time in Unix milliseconds.
+	presenceIdKey       = "qrpc-presence-id"
+	presenceStatusKey   = "qrpc-presence-status"
+	presenceLastSeenKey = "qrpc-presence-last-seen"
+)
+
+// presenceTracker follows the presence of the clients.
+type presenceTracker struct {
+	awayTimeout time.Duration
+	debounce    time.Duration
+
+	mu      sync.Mutex
+	clients map[string]*presenceEntry
+	watches map[string]map[*presenceWatch]bool
+}
+
+type presenceEntry struct {
+	status     PresenceStatus
+	lastSeen   time.Time
+	lastActive time.Time
+	conns      int
+	// timer checks whether the client went away while it has connections,
+	// and ends the grace period before it goes offline otherwise. gen tells
+	// the current timer from the stopped ones which fired already.
+	timer *time.Timer
+	gen   uint64
+}
+
+func newPresenceTracker(awayTimeout, debounce time.Duration) *presenceTracker {
+	return &presenceTracker{
+		awayTimeout: awayTimeout,
+		debounce:    debounce,
+		clients:     make(map[string]*presenceEntry),
+		watches:     make(map[string]map[*presenceWatch]bool),
+	}
+}
+
+func (t *presenceTracker) entry(clientId string) *presenceEntry {
+	e, ok := t.clients[clientId]
+	if !ok {
+		e = &presenceEntry{}
+		t.clients[clientId] = e
+	}
+	return e
+}
+
+// connected records a new connection of clientId.
+func (t *presenceTracker) connected(clientId string) {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e := t.entry(clientId)
+	e.conns++
+	e.lastSeen, e.lastActive = now, now
+	t.setTimer(clientId, e, t.awayTimeout, t.checkAway)
+	t.set(clientId, e, PresenceOnline)
+}
+
+// disconnected records the end of a connection of clientId.
+func (t *presenceTracker) disconnected(clientId string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e := t.entry(clientId)
+	e.conns--
+	e.lastSeen = time.Now()
+	if e.conns > 0 {
+		return
+	}
+	if t.debounce <= 0 {
+		t.stopTimer(e)
+		t.set(clientId, e, PresenceOffline)
+		return
+	}
+	t.setTimer(clientId, e, t.debounce, func(clientId string, gen uint64) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if e := t.clients[clientId]; e != nil && e.gen == gen {
+			t.set(clientId, e, PresenceOffline)
+		}
+	})
+}
+
+// seen records a frame of clientId, active unless it is a Ping.
+func (t *presenceTracker) seen(clientId string, active bool) {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.clients[clientId]
+	if !ok || e.conns == 0 {
+		return
+	}
+	e.lastSeen = now
+	if !active {
+		return
+	}
+	e.lastActive = now
+	if e.status == PresenceAway {
+		t.setTimer(clientId, e, t.awayTimeout, t.checkAway)
+		t.set(clientId, e, PresenceOnline)
+	}
+}
+
+// checkAway is the timer of a connected client, which is away if it was not
+// active for the away timeout.
+func (t *presenceTracker) checkAway(clientId string, gen uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e := t.clients[clientId]
+	if e == nil || e.gen != gen {
+		return
+	}
+	if idle := time.Since(e.lastActive); idle < t.awayTimeout {
+		t.setTimer(clientId, e, t.awayTimeout-idle, t.checkAway)
+		return
+	}
+	t.set(clientId, e, PresenceAway)
+}
+
+// setTimer replaces the timer of e with one calling f after d, none if d is
+// not positive. t.mu must be held.
+func (t *presenceTracker) setTimer(clientId string, e *presenceEntry, d time.Duration, f func(clientId string, gen uint64)) {
+	t.stopTimer(e)
+	if d <= 0 {
+		return
+	}
+	gen := e.gen
+	e.timer = time.AfterFunc(d, func() { f(clientId, gen) })
+}
+
+func (t *presenceTracker) stopTimer(e *presenceEntry) {
+	if e.timer != nil {
+		e.timer.Stop()
+		e.timer = nil
+	}
+	e.gen++
+}
+
+// set sets the status of clientId and tells the watches if it changed. t.mu
+// must be held.
+func (t *presenceTracker) set(clientId string, e *presenceEntry, st PresenceStatus) {
+	if e.status == st {
+		return
+	}
+	if st == PresenceOffline {
+		t.stopTimer(e)
+	}
+	e.status = st
+	p := Presence{ClientId: clientId, Status: st, LastSeen: e.lastSeen}
+	for w := range t.watches[clientId] {
+		w.notify(p)
+	}
+}
+
+// get returns the presence of clientId. t.mu must be held.
+func (t *presenceTracker) get(clientId string) Presence {
+	p := Presence{ClientId: clientId}
+	if e, ok := t.clients[clientId]; ok {
+		p.Status, p.LastSeen = e.status, e.lastSeen
+	}
+	return p
+}
+
+// watch returns a watch of the presence of clientIds, which starts with
+// their current presence.
+func (t *presenceTracker) watch(clientIds []string) *presenceWatch {
+	w := &presenceWatch{
+		clientIds: clientIds,
+		pending:   make(map[string]Presence, len(clientIds)),
+		wake:      make(chan struct{}, 1),
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, clientId := range clientIds {
+		ws, ok := t.watches[clientId]
+		if !ok {
+			ws = make(map[*presenceWatch]bool)
+			t.watches[clientId] = ws
+		}
+		ws[w] = true
+		w.notify(t.get(clientId))
+	}
+	return w
+}
+
+func (t *presenceTracker) unwatch(w *presenceWatch) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, clientId := range w.clientIds {
+		delete(t.watches[clientId], w)
+		if len(t.watches[clientId]) == 0 {
+			delete(t.watches, clientId)
+		}
+	}
+}
+
+// presenceWatch holds the changes not sent yet to a watcher. A client whose
+// presence changes several times meanwhile is sent only the last one.
+type presenceWatch struct {
+	clientIds []string
+
+	mu      sync.Mutex
+	pending map[string]Presence
+	// wake is signaled when pending is not empty.
+	wake chan struct{}
+}
+
+func (w *presenceWatch) notify(p Presence) {
+	w.mu.Lock()
+	w.pending[p.ClientId] = p
+	w.mu.Unlock()
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// take returns the pending changes, ordered by ClientId.
+func (w *presenceWatch) take() []Presence {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	ps := make([]Presence, 0, len(w.pending))
+	for _, p := range w.pending {
+		ps = append(ps, p)
+	}
+	clear(w.pending)
+	slices.SortFunc(ps, func(a, b Presence) int {
+		return cmp.Compare(a.ClientId, b.ClientId)
+	})
+	return ps
+}
+
+// Presence returns the presence of clientId, offline if presence is not
+// enabled.
+func (s *Server) Presence(clientId string) Presence {
+	if s.presence == nil {
+		return Presence{ClientId: clientId}
+	}
+	s.presence.mu.Lock()
+	defer s.presence.mu.Unlock()
+	return s.presence.get(clientId)
+}
+
+// handlePresence serves a watch call, until the client ends it or the
+// server stops.
+func (s *Server) handlePresence(ctx context.Context, req *codec.Publish, fw *frameWriter) (codec.Props, error) {
+	if s.presence == nil {
+		return nil, status.Error(Unimplemented, "qrpc: presence is not enabled")
+	}
+	clientIds := req.Props[presenceIdKey]
+	if len(clientIds) == 0 {
+		return nil, status.Error(InvalidArgument, "qrpc: no client to watch")
+	}
+	if s.opts.presenceAccess == nil {
+		return nil, status.Error(PermissionDenied, "qrpc: presence cannot be watched")
+	}
+	for _, clientId := range clientIds {
+		if err := s.opts.presenceAccess(ctx, clientId); err != nil {
+			return nil, err
+		}
+	}
+
+	w := s.presence.watch(clientIds)
+	defer s.presence.unwatch(w)
+	for {
+		select {
+		case <-w.wake:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-s.quit.Fired():
+			return nil, errServerStopping
+		}
+		for _, p := range w.take() {
+			pub := &codec.Publish{
+				Path: presenceMethod,
+				Props: codec.Props{
+					presenceIdKey:       {p.ClientId},
+					presenceStatusKey:   {strconv.Itoa(int(p.Status))},
+					presenceLastSeenKey: {strconv.FormatInt(unixMilli(p.LastSeen), 10)},
+				},
+			}
+			if err := fw.WriteMessage(pub); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+func unixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+// PresenceWatcher receives the presence of the clients watched with
+// WatchPresence.
+type PresenceWatcher struct {
+	s    quic.Stream
+	stop func()
+	ctx  context.Context
+	plmk codec.PayloadBuilder
+	id   uint16
+	once sync.Once
+}
+
+// WatchPresence watches the presence of clientIds. The PresenceWatcher
+// receives the current presence of each of them first, then their changes;
+// a client whose presence changes several times in a row may be received
+// only the last one. The server decides which clients can be watched, see
+// PresenceAccess, the call fails on the first Recv otherwise. The watch goes
+// on until ctx is done or the PresenceWatcher is closed.
+func (cc *ClientConn) WatchPresence(ctx context.Context, clientIds ...string) (*PresenceWatcher, error) {
+	s, stop, err := cc.newStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &codec.Publish{
+		Header:    codec.Header{AckRequired: true},
+		MessageId: cc.nextMessageId(),
+		Path:      presenceMethod,
+		Props:     outgoingProps(ctx),
+	}
+	if req.Props == nil {
+		req.Props = make(codec.Props)
+	}
+	req.Props[presenceIdKey] = clientIds
+	if err := newFrameWriter(s, cc.opts.bufferPool).WriteMessage(req); err != nil {
+		s.CancelRead(quic.StreamErrorCode(codes.Canceled))
+		stop()
+		return nil, toRPCErr(ctx, err)
+	}
+	s.Close()
+	return &PresenceWatcher{s: s, stop: stop, ctx: ctx, plmk: cc.plmk, id: req.MessageId}, nil
+}
+
+// Recv returns the next presence received. It returns io.EOF once the
+// server ended the watch without error.
+func (w *PresenceWatcher) Recv() (p Presence, err error) {
+	defer func() {
+		if err != nil {
+			w.end(quic.StreamErrorCode(NoError))
+		}
+	}()
+	msg, err := codec.DecodeOneMessage(w.s, w.plmk)
+	if err == io.EOF {
+		return Presence{}, status.Error(codes.Internal, "qrpc: stream terminated without a reply")
+	}
+	if err != nil {
+		return Presence{}, toRPCErr(w.ctx, err)
+	}
+	switch m := msg.(type) {
+	case *codec.Publish:
+		FreePayload(m)
+		st, err1 := strconv.ParseUint(propValue(m.Props, presenceStatusKey), 10, 8)
+		ms, err2 := strconv.ParseInt(propValue(m.Props, presenceLastSeenKey), 10, 64)
+		clientId := propValue(m.Props, presenceIdKey)
+		if clientId == "" || err1 != nil || err2 != nil {
+			return Presence{}, status.Error(codes.Internal, "qrpc: malformed presence")
+		}
+		p := Presence{ClientId: clientId, Status: PresenceStatus(st)}
+		if ms != 0 {
+			p.LastSeen = time.UnixMilli(ms)
+		}
+		return p, nil
+	case *codec.PubAck:
+		defer FreePayload(m)
+		if m.MessageId != w.id {
+			return Presence{}, status.Errorf(codes.Internal, "qrpc: unexpected %v frame in reply to Watch", msg)
+		}
+		if err := statusError(m.Status, m.Trailer); err != nil {
+			return Presence{}, err
+		}
+		return Presence{}, io.EOF
+	default:
+		return Presence{}, status.Errorf(codes.Internal, "qrpc: unexpected %v frame in reply to Watch", msg)
+	}
+}
+
+// Close ends the watch.
+func (w *PresenceWatcher) Close() error {
+	w.end(quic.StreamErrorCode(codes.Canceled))
+	return nil
+}
+
+func (w *PresenceWatcher) end(code quic.StreamErrorCode) {
+	w.once.Do(func() {
+		w.s.CancelRead(code)
+		w.stop()
+	})
+}
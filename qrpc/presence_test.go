@@ -0,0 +1,76 @@
+package qrpc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stonefire-oss/stonefire-im/demo/pb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestServer_Presence(t *testing.T) {
+	access := func(ctx context.Context, clientId string) error {
+		if ua, ok := UserAgentFromContext(ctx); ok && ua.ClientId == "alice" {
+			return nil
+		}
+		return status.Error(codes.PermissionDenied, "not a contact")
+	}
+	s, addr := newTestServer(t,
+		EnablePresence(true),
+		PresenceAwayTimeout(time.Millisecond*200),
+		PresenceDebounce(time.Millisecond*300),
+		PresenceAccess(access),
+	)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	alice := newTestClient(t, addr, WithClientId("alice"))
+	w, err := alice.WatchPresence(ctx, "bob")
+	if err != nil {
+		t.Fatalf("WatchPresence() error = %v", err)
+	}
+	defer w.Close()
+	expect := func(want PresenceStatus) {
+		t.Helper()
+		p, err := w.Recv()
+		if err != nil {
+			t.Fatalf("Recv() error = %v", err)
+		}
+		if p.ClientId != "bob" || p.Status != want {
+			t.Fatalf("Recv() = %s %v, want bob %v", p.ClientId, p.Status, want)
+		}
+		if want != PresenceOffline && p.LastSeen.IsZero() {
+			t.Errorf("Recv() LastSeen is zero")
+		}
+	}
+	expect(PresenceOffline)
+
+	bob := newTestClient(t, addr, WithClientId("bob"))
+	expect(PresenceOnline)
+	expect(PresenceAway)
+	if _, err := pb.NewStudentServiceClient(bob).CreateStudent(ctx, &pb.Student{Name: "bob"}); err != nil {
+		t.Fatalf("CreateStudent() error = %v", err)
+	}
+	expect(PresenceOnline)
+
+	// A connection coming back within the debounce does not make bob
+	// offline.
+	bob.Close()
+	bob = newTestClient(t, addr, WithClientId("bob"))
+	bob.Close()
+	expect(PresenceOffline)
+	if p := s.Presence("bob"); p.Status != PresenceOffline || p.LastSeen.IsZero() {
+		t.Errorf("Presence() = %v, want offline with a last seen time", p)
+	}
+
+	mallory := newTestClient(t, addr, WithClientId("mallory"))
+	mw, err := mallory.WatchPresence(ctx, "bob")
+	if err != nil {
+		t.Fatalf("WatchPresence() error = %v", err)
+	}
+	if _, err := mw.Recv(); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Recv() of a stranger error = %v, want %v", err, codes.PermissionDenied)
+	}
+}
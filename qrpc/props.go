@@ -0,0 +1,253 @@
+package qrpc
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/stonefire-oss/stonefire-im/pkg/codec"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Props keys starting with "qrpc-" are reserved for the protocol.
+const (
+	// timeoutKey carries the timeout of a call, encoded like grpc-timeout:
+	// at most 8 digits followed by a unit out of "HMSmun".
+	timeoutKey = "qrpc-timeout"
+	// headerOnlyKey marks a Publish which carries the header of a streaming
+	// call ahead of its first message.
+	headerOnlyKey = "qrpc-header-only"
+
+	reservedPrefix = "qrpc-"
+)
+
+const maxTimeoutValue int64 = 100000000 - 1
+
+// encodeTimeout encodes t with the most precise unit which keeps it within
+// 8 digits. Timeouts are rounded up.
+func encodeTimeout(t time.Duration) string {
+	if t <= 0 {
+		return "0n"
+	}
+	units := []struct {
+		d time.Duration
+		u string
+	}{
+		{time.Nanosecond, "n"},
+		{time.Microsecond, "u"},
+		{time.Millisecond, "m"},
+		{time.Second, "S"},
+		{time.Minute, "M"},
+		{time.Hour, "H"},
+	}
+	for _, u := range units {
+		v := int64(t / u.d)
+		if t%u.d > 0 {
+			v++
+		}
+		if v <= maxTimeoutValue {
+			return strconv.FormatInt(v, 10) + u.u
+		}
+	}
+	return strconv.FormatInt(maxTimeoutValue, 10) + "H"
+}
+
+func decodeTimeout(s string) (time.Duration, error) {
+	size := len(s)
+	if size < 2 || size > 9 {
+		return 0, fmt.Errorf("qrpc: malformed timeout %q", s)
+	}
+	var d time.Duration
+	switch s[size-1] {
+	case 'H':
+		d = time.Hour
+	case 'M':
+		d = time.Minute
+	case 'S':
+		d = time.Second
+	case 'm':
+		d = time.Millisecond
+	case 'u':
+		d = time.Microsecond
+	case 'n':
+		d = time.Nanosecond
+	default:
+		return 0, fmt.Errorf("qrpc: timeout unit is not recognized: %q", s)
+	}
+	t, err := strconv.ParseInt(s[:size-1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if t > int64(math.MaxInt64/d) {
+		return time.Duration(math.MaxInt64), nil
+	}
+	return d * time.Duration(t), nil
+}
+
+// outgoingProps returns the Props opening a call made with ctx: the outgoing
+// metadata of ctx and its deadline.
+func outgoingProps(ctx context.Context) codec.Props {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	dl, hasDeadline := ctx.Deadline()
+	if len(md) == 0 && !hasDeadline {
+		return nil
+	}
+
+	p := mdToProps(md)
+	if p == nil {
+		p = make(codec.Props)
+	}
+	if hasDeadline {
+		p[timeoutKey] = []string{encodeTimeout(time.Until(dl))}
+	}
+	return p
+}
+
+// mdToProps copies md into Props, leaving out the reserved keys.
+func mdToProps(md metadata.MD) codec.Props {
+	if len(md) == 0 {
+		return nil
+	}
+	p := make(codec.Props, len(md))
+	for k, v := range md {
+		if strings.HasPrefix(k, reservedPrefix) {
+			continue
+		}
+		p[k] = append([]string(nil), v...)
+	}
+	return p
+}
+
+// propsToMD returns the metadata carried by p, leaving out the reserved keys.
+func propsToMD(p codec.Props) metadata.MD {
+	md := make(metadata.MD, len(p))
+	for k, v := range p {
+		if strings.HasPrefix(k, reservedPrefix) {
+			continue
+		}
+		md[strings.ToLower(k)] = v
+	}
+	return md
+}
+
+// callMetadata collects the header and trailer of a call on the server. It
+// implements grpc.ServerTransportStream, so grpc.SetHeader, grpc.SendHeader
+// and grpc.SetTrailer work on the context of the call.
+//
+// The header travels in the Props of the first frame the server sends on the
+// stream and the trailer in the Trailer of the PubAck ending the call.
+type callMetadata struct {
+	method string
+	// sendHeader sends the header ahead of the reply, nil for unary calls
+	// whose header always goes with the PubAck.
+	sendHeader func() error
+
+	mu         sync.Mutex
+	header     metadata.MD
+	trailer    metadata.MD
+	headerSent bool
+}
+
+var errHeaderSent = status.Error(codes.Internal, "qrpc: the header was already sent")
+
+func (m *callMetadata) Method() string {
+	return m.method
+}
+
+func (m *callMetadata) SetHeader(md metadata.MD) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.headerSent {
+		return errHeaderSent
+	}
+	m.header = metadata.Join(m.header, md)
+	return nil
+}
+
+func (m *callMetadata) SendHeader(md metadata.MD) error {
+	if err := m.SetHeader(md); err != nil {
+		return err
+	}
+	if m.sendHeader == nil {
+		return nil
+	}
+	return m.sendHeader()
+}
+
+func (m *callMetadata) SetTrailer(md metadata.MD) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.trailer = metadata.Join(m.trailer, md)
+	return nil
+}
+
+// takeHeader returns the header to attach to the frame being sent, false if
+// it was sent already.
+func (m *callMetadata) takeHeader() (metadata.MD, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.headerSent {
+		return nil, false
+	}
+	m.headerSent = true
+	return m.header, true
+}
+
+func (m *callMetadata) getTrailer() metadata.MD {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.trailer
+}
+
+// finalAck returns the PubAck ending the call opened by req with st, carrying
+// the trailer and the header if it was not sent yet.
+func (m *callMetadata) finalAck(req *codec.Publish, st *status.Status) *codec.PubAck {
+	ws, details := wireStatus(st)
+	ack := &codec.PubAck{
+		Header:    codec.Header{AckRequired: req.AckRequired},
+		MessageId: req.MessageId,
+		Status:    ws,
+		Trailer:   mdToProps(m.getTrailer()),
+	}
+	if details != "" {
+		if ack.Trailer == nil {
+			ack.Trailer = make(codec.Props)
+		}
+		ack.Trailer[statusDetailsKey] = []string{details}
+	}
+	if header, ok := m.takeHeader(); ok {
+		ack.Props = mdToProps(header)
+	}
+	return ack
+}
+
+// newStreamContext derives the context of a call from the context of its
+// connection. It carries the incoming metadata and the deadline requested by
+// the client and is canceled when the client resets the stream.
+func newStreamContext(ctx context.Context, req *codec.Publish, stream quic.Stream) (context.Context, context.CancelFunc) {
+	var cancel context.CancelFunc
+	if v := req.Props[timeoutKey]; len(v) > 0 {
+		if timeout, err := decodeTimeout(v[0]); err == nil {
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+		}
+	}
+	if cancel == nil {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	ctx = metadata.NewIncomingContext(ctx, propsToMD(req.Props))
+
+	// The write side of the stream is closed once the client cancels its
+	// read side, which it does when it gives up on the call.
+	stop := context.AfterFunc(stream.Context(), cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
@@ -0,0 +1,79 @@
+package qrpc
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/stonefire-oss/stonefire-im/demo/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// echoMetadata returns the "x-req" value of the incoming metadata in the
+// header and the trailer of the call.
+func echoMetadata() []ServerOption {
+	unary := func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		grpc.SetHeader(ctx, metadata.Pairs("x-header", md.Get("x-req")[0]))
+		grpc.SetTrailer(ctx, metadata.Pairs("x-trailer", md.Get("x-req")[0]))
+		return handler(ctx, req)
+	}
+	stream := func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		md, _ := metadata.FromIncomingContext(ss.Context())
+		if err := ss.SendHeader(metadata.Pairs("x-header", md.Get("x-req")[0])); err != nil {
+			return err
+		}
+		ss.SetTrailer(metadata.Pairs("x-trailer", md.Get("x-req")[0]))
+		return handler(srv, ss)
+	}
+	return []ServerOption{UnaryInterceptor(unary), StreamInterceptor(stream)}
+}
+
+func TestMetadata(t *testing.T) {
+	_, addr := newTestServer(t, echoMetadata()...)
+	client := pb.NewStudentServiceClient(newTestClient(t, addr))
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-req", "v", "qrpc-timeout", "1n")
+
+	wantHeader := metadata.Pairs("x-header", "v")
+	wantTrailer := metadata.Pairs("x-trailer", "v")
+
+	t.Run("unary", func(t *testing.T) {
+		var header, trailer metadata.MD
+		if _, err := client.CreateStudent(ctx, &pb.Student{}, grpc.Header(&header), grpc.Trailer(&trailer)); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(header, wantHeader) {
+			t.Errorf("header = %v, want %v", header, wantHeader)
+		}
+		if !reflect.DeepEqual(trailer, wantTrailer) {
+			t.Errorf("trailer = %v, want %v", trailer, wantTrailer)
+		}
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		stream, err := client.Hello(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The header was sent ahead of any message.
+		header, err := stream.Header()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(header, wantHeader) {
+			t.Errorf("Header() = %v, want %v", header, wantHeader)
+		}
+		if err := stream.Send(&pb.Student{Name: "a"}); err != nil {
+			t.Fatal(err)
+		}
+		if echo, err := stream.Recv(); err != nil || echo.Name != "a" {
+			t.Fatalf("Recv() = %v, %v", echo, err)
+		}
+		stream.CloseSend()
+		stream.Recv()
+		if got := stream.Trailer(); !reflect.DeepEqual(got, wantTrailer) {
+			t.Errorf("Trailer() = %v, want %v", got, wantTrailer)
+		}
+	})
+}
@@ -0,0 +1,189 @@
+package qrpc
+
+import (
+	"context"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+	"github.com/stonefire-oss/stonefire-im/pkg/codec"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// PushOption configures a Push.
+type PushOption interface {
+	apply(*pushOptions)
+}
+
+type pushOptions struct {
+	qos        codec.QosLevel
+	compressed bool
+	retain     bool
+	sender     string
+}
+
+type funcPushOption struct {
+	f func(*pushOptions)
+}
+
+func (fpo *funcPushOption) apply(po *pushOptions) {
+	fpo.f(po)
+}
+
+func newFuncPushOption(f func(*pushOptions)) *funcPushOption {
+	return &funcPushOption{f: f}
+}
+
+// PushQos returns a PushOption which sets the delivery guarantee of a push.
+// With QosAtMostOnce the message is sent once and Push returns as soon as it
+// is on the stream, the client does not acknowledge it. The default is
+// QosAtLeastOnce.
+func PushQos(q codec.QosLevel) PushOption {
+	return newFuncPushOption(func(o *pushOptions) {
+		o.qos = q
+	})
+}
+
+// PushCompressed returns a PushOption which makes the message of a push be
+// sent gzip compressed.
+func PushCompressed(z bool) PushOption {
+	return newFuncPushOption(func(o *pushOptions) {
+		o.compressed = z
+	})
+}
+
+// PushRetain returns a PushOption which makes the broker retain a message
+// published on a topic: it is sent to the sessions subscribing to the topic
+// later on, until another retained message replaces it. A retained message
+// without payload clears the topic. It has no effect on Push.
+func PushRetain(r bool) PushOption {
+	return newFuncPushOption(func(o *pushOptions) {
+		o.retain = r
+	})
+}
+
+// PushSender returns a PushOption which sets the ClientId of the client a
+// message is pushed on behalf of. The messages of a conversation carry it,
+// see SenderFromContext, and their sender gets their receipts, see
+// EnableReceipts.
+func PushSender(clientId string) PushOption {
+	return newFuncPushOption(func(o *pushOptions) {
+		o.sender = clientId
+	})
+}
+
+var defaultPushOptions = pushOptions{
+	qos: codec.QosAtLeastOnce,
+}
+
+// Push sends msg to the client connected with clientId, in a Publish on path
+// carried by a stream the server opens. The outgoing metadata of ctx goes
+// along with it. A client connected from several devices gets it on each of
+// them.
+//
+// With QosAtLeastOnce, the default, Push waits for the PubAck of the client
+// and returns the status of its PushHandler. A push which is not
+// acknowledged in time is sent again, also over the next connection of the
+// client if the current one breaks; Push may return before that if ctx is
+// done, the push is delivered all the same. With several devices Push returns
+// the first error among them. Push fails with ResourceExhausted if the client
+// is too far behind, with more than a thousand pushes waiting for room in its
+// push window.
+//
+// Push fails with Unavailable if the client is not connected, unless the
+// server has an offline store: a QoS 1 push is then stored and Push returns
+// once it is, as it is while the stored messages of the client are being
+// delivered, see OfflineStore.
+func (s *Server) Push(ctx context.Context, clientId, path string, msg any, opts ...PushOption) error {
+	po := defaultPushOptions
+	for _, o := range opts {
+		o.apply(&po)
+	}
+	if !po.qos.IsValid() {
+		return status.Errorf(codes.InvalidArgument, "qrpc: invalid QoS %d", po.qos)
+	}
+
+	bf, err := EncodePayload(msg, po.compressed)
+	if err != nil {
+		return status.Errorf(codes.Internal, "qrpc: error while marshaling: %v", err)
+	}
+	defer freeBuffer(bf)
+
+	pub := &codec.Publish{
+		Header: codec.Header{Compressed: po.compressed},
+		Path:   path,
+		Props:  po.props(ctx),
+	}
+	if bf != nil {
+		pub.Payload = bf
+	}
+	return s.push(ctx, clientId, pub, po.qos)
+}
+
+// props returns the Props of a push: the outgoing metadata of ctx, and the
+// sender if set.
+func (po *pushOptions) props(ctx context.Context) codec.Props {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	props := mdToProps(md)
+	if po.sender != "" {
+		if props == nil {
+			props = make(codec.Props, 1)
+		}
+		props[SenderProp] = []string{po.sender}
+	}
+	return props
+}
+
+// push sends pub to the connections of clientId, or stores it if there are
+// none and it can be.
+func (s *Server) push(ctx context.Context, clientId string, pub *codec.Publish, qos codec.QosLevel) error {
+	if s.opts.offline != nil && qos == codec.QosAtLeastOnce {
+		if live, err := s.storeOffline(clientId, pub); !live {
+			return err
+		}
+	}
+	conns := s.clientConns(clientId)
+	if len(conns) == 0 {
+		return status.Errorf(codes.Unavailable, "qrpc: client %q is not connected", clientId)
+	}
+
+	errs := make([]error, len(conns))
+	var wg sync.WaitGroup
+	for i, c := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if qos == codec.QosAtMostOnce {
+				errs[i] = s.pushOnce(ctx, c, pub)
+			} else {
+				errs[i] = s.publish(ctx, c.session, pub)
+			}
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pushOnce sends msg, a Publish, over c without waiting for an acknowledgement.
+func (s *Server) pushOnce(ctx context.Context, c *qrpcConn, msg codec.Message) error {
+	stream, err := c.conn.OpenStreamSync(ctx)
+	if err != nil {
+		return toRPCErr(ctx, err)
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		stream.SetWriteDeadline(dl)
+	}
+	if err := newFrameWriter(stream, s.opts.bufferPool).WriteMessage(msg); err != nil {
+		stream.CancelWrite(quic.StreamErrorCode(Canceled))
+		stream.CancelRead(quic.StreamErrorCode(Canceled))
+		return toRPCErr(ctx, err)
+	}
+	finishStream(stream)
+	return nil
+}
@@ -0,0 +1,110 @@
+package qrpc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stonefire-oss/stonefire-im/demo/pb"
+	"github.com/stonefire-oss/stonefire-im/pkg/codec"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const testPushPath = "/qrpc.test/Push"
+
+// testPush pushes a Student named name to clientId, with the metadata k: v.
+func testPush(s *Server, clientId, name string, opts ...PushOption) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, "k", "v")
+	return s.Push(ctx, clientId, testPushPath, &pb.Student{Name: name}, opts...)
+}
+
+func TestServer_Push(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     []PushOption
+		err      error
+		wantCode codes.Code
+	}{
+		{name: "acknowledged", wantCode: codes.OK},
+		{name: "compressed", opts: []PushOption{PushCompressed(true)}, wantCode: codes.OK},
+		{name: "refused", err: status.Error(codes.NotFound, "no such conversation"), wantCode: codes.NotFound},
+		{
+			name: "at most once",
+			opts: []PushOption{PushQos(codec.QosAtMostOnce)},
+			// The client has no say.
+			err:      status.Error(codes.NotFound, "no such conversation"),
+			wantCode: codes.OK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, addr := newTestServer(t)
+			got := make(chan string, 1)
+			newTestClient(t, addr, WithClientId("alice"), WithPushHandler(func(ctx context.Context, path string, dec func(any) error) error {
+				var st pb.Student
+				if err := dec(&st); err != nil {
+					return err
+				}
+				md, _ := metadata.FromIncomingContext(ctx)
+				got <- path + " " + st.Name + " " + md.Get("k")[0]
+				return tt.err
+			}))
+
+			err := testPush(s, "alice", "bob", tt.opts...)
+			if c := status.Code(err); c != tt.wantCode {
+				t.Errorf("Push() code = %v, want %v (%v)", c, tt.wantCode, err)
+			}
+			select {
+			case g := <-got:
+				if want := testPushPath + " bob v"; g != want {
+					t.Errorf("pushed %q, want %q", g, want)
+				}
+			case <-time.After(time.Second * 5):
+				t.Fatal("the push was not received")
+			}
+		})
+	}
+}
+
+func TestServer_PushRegistry(t *testing.T) {
+	s, addr := newTestServer(t)
+	received := make(chan string, 2)
+	handler := func(name string) DialOption {
+		return WithPushHandler(func(ctx context.Context, path string, dec func(any) error) error {
+			received <- name
+			return nil
+		})
+	}
+
+	if c := status.Code(testPush(s, "alice", "bob")); c != codes.Unavailable {
+		t.Errorf("Push() before Connect code = %v, want %v", c, codes.Unavailable)
+	}
+
+	first := newTestClient(t, addr, WithClientId("alice"), handler("first"))
+	second := newTestClient(t, addr, WithClientId("alice"), handler("second"))
+	// The last connection of a ClientId gets its pushes.
+	if err := testPush(s, "alice", "bob"); err != nil {
+		t.Fatalf("Push() error = %v", err)
+	}
+	if got := <-received; got != "second" {
+		t.Errorf("push received by %s, want second", got)
+	}
+
+	// Closing a replaced connection leaves the registry alone.
+	first.Close()
+	time.Sleep(time.Millisecond * 100)
+	if err := testPush(s, "alice", "bob"); err != nil {
+		t.Fatalf("Push() after the first connection closed error = %v", err)
+	}
+	<-received
+
+	second.Close()
+	time.Sleep(time.Millisecond * 100)
+	if c := status.Code(testPush(s, "alice", "bob")); c != codes.Unavailable {
+		t.Errorf("Push() after Close code = %v, want %v", c, codes.Unavailable)
+	}
+}
@@ -0,0 +1,623 @@
+package qrpc
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/stonefire-oss/stonefire-im/pkg/codec"
+	"github.com/stonefire-oss/stonefire-im/pkg/utils"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/mem"
+	"google.golang.org/grpc/status"
+)
+
+// Messages pushed by the server are delivered at least once (QoS 1).
+//
+// A push is a Publish with AckRequired on a stream opened by the server, which
+// the client acknowledges with a PubAck on the same stream. Until then the
+// push stays in the push window of the client, a Publish which is not
+// acknowledged in time is sent again with DupFlag set, and so are all the
+// pending ones, in order, when the client resumes its session by connecting
+// again without CleanSession.
+//
+// The other way round, a client retrying a unary call sends it again with the
+// same MessageId and DupFlag set. A server with a DedupCacheSize keeps the
+// replies of the recent calls of every session, a retry gets the reply of
+// the call it repeats instead of being processed again.
+
+const (
+	defaultPushWindowSize    = 64
+	defaultPushRetryInterval = time.Second * 5
+	// pushQueueSize bounds the pushes of a session waiting for room in its
+	// push window.
+	pushQueueSize = 1024
+	// maxPubAckPayload bounds the payload of the PubAck of a push, the
+	// server does not use it.
+	maxPubAckPayload = 4 << 10
+)
+
+var (
+	// errSessionEnded fails the pushes still pending when their session ends.
+	errSessionEnded = status.Error(codes.Unavailable, "qrpc: the session of the client ended")
+	// errMemberLeft fails the pushes of a shared subscription still pending
+	// when the client goes away.
+	errMemberLeft = status.Error(codes.Unavailable, "qrpc: the client left")
+	// errPushQueueFull fails a push to a client too far behind.
+	errPushQueueFull = status.Error(codes.ResourceExhausted, "qrpc: too many pushes pending for the client")
+	// errServerStopping fails the pushes once the server is stopping.
+	errServerStopping = status.Error(codes.Unavailable, "qrpc: the server is stopping")
+)
+
+// pushWindow holds the pushes to a session which are not acknowledged yet.
+// The pushes are queued in the order they are made and written out by a
+// single goroutine, so that they reach the client in that order, their
+// PubAcks are awaited concurrently, up to the size of the window.
+type pushWindow struct {
+	retry time.Duration
+	pool  mem.BufferPool
+	quit  *utils.Event
+	// slots bounds the pushes in flight.
+	slots chan struct{}
+
+	mu      sync.Mutex
+	conn    *qrpcConn // nil while the client is away
+	nextId  uint16
+	pending map[uint16]*pendingPush
+	// queue holds the pushes waiting for a slot, resend the pending ones to
+	// send again over a new connection, both in order. writing is set while
+	// a goroutine writes them out.
+	queue   []*pendingPush
+	resend  []*pendingPush
+	writing bool
+	// seq orders the pushes.
+	seq uint64
+	// gone is set once the window was discarded, nothing is pushed anymore.
+	gone bool
+
+	// acked, if set, is called with the Props of every push acknowledged.
+	acked func(props codec.Props)
+}
+
+type pendingPush struct {
+	frame *codec.PublishFrame
+	props codec.Props
+	// id is set once the push got a slot in the window.
+	id uint16
+	// payload is the payload of frame if it is a mem.Buffer, the push holds
+	// a reference on it until it completes.
+	payload mem.Buffer
+	seq     uint64
+	sent    bool
+	// shared pushes are withdrawn when the window is detached.
+	shared bool
+	// once pushes are at most once: they are written if the client is
+	// connected by then, and not acknowledged.
+	once bool
+	done chan struct{}
+	err  error
+}
+
+func (p *pendingPush) ref() {
+	if p.payload != nil {
+		p.payload.Ref()
+	}
+}
+
+func (p *pendingPush) free() {
+	if p.payload != nil {
+		p.payload.Free()
+	}
+}
+
+func newPushWindow(opts *serverOptions, quit *utils.Event) *pushWindow {
+	return &pushWindow{
+		retry:   opts.pushRetryInterval,
+		pool:    opts.bufferPool,
+		quit:    quit,
+		slots:   make(chan struct{}, opts.pushWindowSize),
+		pending: make(map[uint16]*pendingPush),
+	}
+}
+
+// publish pushes pub to the client and waits for its PubAck, whose status it
+// returns. A payload which is a mem.Buffer is referenced until the push
+// completes, any other is copied. If ctx is done first the push stays in
+// flight and is still delivered.
+func (w *pushWindow) publish(ctx context.Context, pub *codec.Publish) error {
+	f, err := newPushFrame(pub, codec.QosAtLeastOnce)
+	if err != nil {
+		return err
+	}
+	return w.push(ctx, &pendingPush{frame: f, props: pub.Props})
+}
+
+// publishShared is publish for a message of a shared subscription, which
+// another member of the group can take over: rather than waiting for the
+// client to come back, it fails with errMemberLeft if the client is away or
+// goes away before acknowledging the push.
+func (w *pushWindow) publishShared(ctx context.Context, pub *codec.Publish) error {
+	f, err := newPushFrame(pub, codec.QosAtLeastOnce)
+	if err != nil {
+		return err
+	}
+	return w.push(ctx, &pendingPush{frame: f, props: pub.Props, shared: true})
+}
+
+// post queues pub to be pushed with qos after the pushes made before, without
+// waiting for it to be delivered. A message at most once is dropped if the
+// client is away.
+func (w *pushWindow) post(pub *codec.Publish, qos codec.QosLevel) error {
+	f, err := newPushFrame(pub, qos)
+	if err != nil {
+		return err
+	}
+	return w.postFrame(f, pub.Props, qos)
+}
+
+// postFrame is post for a frame encoded with qos and props, which can be
+// posted to several windows. Its payload must not be modified.
+func (w *pushWindow) postFrame(f *codec.PublishFrame, props codec.Props, qos codec.QosLevel) error {
+	return w.enqueue(&pendingPush{frame: f, props: props, once: qos == codec.QosAtMostOnce})
+}
+
+// newPushFrame encodes the push of pub with qos, copying its payload unless
+// it is a mem.Buffer.
+func newPushFrame(pub *codec.Publish, qos codec.QosLevel) (*codec.PublishFrame, error) {
+	msg := &codec.Publish{
+		Header:  codec.Header{AckRequired: qos == codec.QosAtLeastOnce, Compressed: pub.Compressed, Retain: pub.Retain},
+		Path:    pub.Path,
+		Props:   pub.Props,
+		Payload: pub.Payload,
+	}
+	if _, ok := pub.Payload.(mem.Buffer); !ok && pub.Payload != nil {
+		msg.Payload = codec.SlicePayload(append([]byte(nil), pub.Payload.ReadOnlyData()...))
+	}
+	f, err := codec.NewPublishFrame(msg)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "qrpc: error while encoding: %v", err)
+	}
+	return f, nil
+}
+
+// push queues p and waits for it to complete.
+func (w *pushWindow) push(ctx context.Context, p *pendingPush) error {
+	if err := w.enqueue(p); err != nil {
+		return err
+	}
+	select {
+	case <-p.done:
+		return p.err
+	case <-ctx.Done():
+		return status.FromContextError(ctx.Err()).Err()
+	case <-w.quit.Fired():
+		return errServerStopping
+	}
+}
+
+// enqueue queues p to be written out after the pushes queued before it.
+func (w *pushWindow) enqueue(p *pendingPush) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	switch {
+	case w.gone:
+		return errSessionEnded
+	case w.quit.HasFired():
+		return errServerStopping
+	case p.shared && w.conn == nil:
+		return errMemberLeft
+	case p.once && w.conn == nil:
+		return nil
+	case len(w.queue) >= pushQueueSize:
+		return errPushQueueFull
+	}
+	w.seq++
+	p.seq = w.seq
+	p.done = make(chan struct{})
+	if b, ok := p.frame.Payload.(mem.Buffer); ok {
+		p.payload = b
+		p.ref()
+	}
+	w.queue = append(w.queue, p)
+	w.startWriting()
+	return nil
+}
+
+// startWriting starts the goroutine writing out the pushes unless it is
+// running already. w.mu must be held.
+func (w *pushWindow) startWriting() {
+	if !w.writing {
+		w.writing = true
+		go w.write()
+	}
+}
+
+// write sends the pushes to send again, one after the other, then the queued
+// ones as they get a slot in the window, until there is none left. The
+// PubAcks of the latter are awaited in the background.
+func (w *pushWindow) write() {
+	for {
+		w.mu.Lock()
+		if len(w.resend) > 0 {
+			p := w.resend[0]
+			w.resend = w.resend[1:]
+			conn := w.conn
+			w.mu.Unlock()
+			// The pushes sent again go one after the other.
+			if conn != nil {
+				sent := time.Now()
+				if stream, ok := w.sendPush(conn, p); ok {
+					w.awaitAck(conn, p, stream, sent)
+				}
+			}
+			continue
+		}
+		if len(w.queue) == 0 {
+			w.writing = false
+			w.mu.Unlock()
+			return
+		}
+		p := w.queue[0]
+		w.mu.Unlock()
+
+		if !p.once {
+			select {
+			case w.slots <- struct{}{}:
+			case <-w.quit.Fired():
+				w.mu.Lock()
+				w.writing = false
+				w.mu.Unlock()
+				return
+			}
+		}
+		w.mu.Lock()
+		if len(w.queue) == 0 || w.queue[0] != p || len(w.resend) > 0 {
+			// Withdrawn meanwhile, or the client came back and the pushes
+			// pending go first.
+			w.mu.Unlock()
+			if !p.once {
+				<-w.slots
+			}
+			continue
+		}
+		w.queue = w.queue[1:]
+		conn := w.conn
+		if p.once {
+			w.mu.Unlock()
+			if conn != nil {
+				w.sendAtMostOnce(conn, p)
+			}
+			p.free()
+			continue
+		}
+		p.id = w.allocId()
+		w.pending[p.id] = p
+		w.mu.Unlock()
+		w.start(conn, p)
+	}
+}
+
+// allocId returns a MessageId which is not in flight. w.mu must be held, the
+// window being smaller than the id space, there is always one.
+func (w *pushWindow) allocId() uint16 {
+	for {
+		w.nextId++
+		if _, ok := w.pending[w.nextId]; w.nextId != 0 && !ok {
+			return w.nextId
+		}
+	}
+}
+
+// start sends p over conn and waits for its PubAck in the background. If conn
+// is nil p is sent once the client is back.
+func (w *pushWindow) start(conn *qrpcConn, p *pendingPush) {
+	if conn == nil {
+		return
+	}
+	sent := time.Now()
+	if stream, ok := w.sendPush(conn, p); ok {
+		go w.awaitAck(conn, p, stream, sent)
+	}
+}
+
+// awaitAck waits for the PubAck of p on stream, on which it was sent at
+// sent, sending p again every retry interval until it is acknowledged or
+// conn goes away. A push sent before goes out with DupFlag set.
+func (w *pushWindow) awaitAck(conn *qrpcConn, p *pendingPush, stream quic.Stream, sent time.Time) {
+	for {
+		if stream != nil {
+			if ack, ok := readPubAck(stream, p.id); ok {
+				w.ack(ack)
+				return
+			}
+		}
+		// A push which failed right away, on a stream the client reset for
+		// instance, is not sent again before the retry interval.
+		if !w.waitRetry(conn, w.retry-time.Since(sent)) {
+			return
+		}
+		sent = time.Now()
+		var ok bool
+		if stream, ok = w.sendPush(conn, p); !ok {
+			return
+		}
+	}
+}
+
+// waitRetry waits for d, it reports false if conn or the server went away
+// first.
+func (w *pushWindow) waitRetry(conn *qrpcConn, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-conn.ctx.Done():
+	case <-w.quit.Fired():
+	}
+	return false
+}
+
+// sendPush sends p on a new stream of conn, whose PubAck is due within a
+// retry interval. It returns the stream, nil if p could not be sent, and
+// reports false if p is not to be sent over conn anymore.
+func (w *pushWindow) sendPush(conn *qrpcConn, p *pendingPush) (quic.Stream, bool) {
+	w.mu.Lock()
+	_, pending := w.pending[p.id]
+	if !pending || w.conn != conn || conn.closed.HasFired() || w.quit.HasFired() {
+		w.mu.Unlock()
+		return nil, false
+	}
+	dup := p.sent
+	p.sent = true
+	// The push may complete while it is being sent, its payload stays
+	// referenced until then.
+	p.ref()
+	w.mu.Unlock()
+	defer p.free()
+
+	ctx, cancel := context.WithTimeout(conn.ctx, w.retry)
+	defer cancel()
+	stream, err := conn.conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, true
+	}
+	stream.SetDeadline(time.Now().Add(w.retry))
+	if err := newFrameWriter(stream, w.pool).WriteMessage(p.frame.Copy(p.id, dup)); err != nil {
+		stream.CancelWrite(quic.StreamErrorCode(Canceled))
+		stream.CancelRead(quic.StreamErrorCode(NoError))
+		return nil, true
+	}
+	stream.Close()
+	return stream, true
+}
+
+// readPubAck reads the PubAck of the push of id on stream.
+func readPubAck(stream quic.Stream, id uint16) (*codec.PubAck, bool) {
+	defer stream.CancelRead(quic.StreamErrorCode(NoError))
+	reply, err := codec.DecodeOneMessage(stream, pooledPLMaker{maxSize: maxPubAckPayload})
+	if err != nil {
+		return nil, false
+	}
+	ack, ok := reply.(*codec.PubAck)
+	if !ok || ack.MessageId != id {
+		return nil, false
+	}
+	return ack, true
+}
+
+// sendAtMostOnce sends p, a push at most once, on a new stream of conn.
+func (w *pushWindow) sendAtMostOnce(conn *qrpcConn, p *pendingPush) {
+	ctx, cancel := context.WithTimeout(conn.ctx, w.retry)
+	defer cancel()
+	stream, err := conn.conn.OpenStreamSync(ctx)
+	if err != nil {
+		return
+	}
+	stream.SetWriteDeadline(time.Now().Add(w.retry))
+	if err := newFrameWriter(stream, w.pool).WriteMessage(p.frame.Copy(0, false)); err != nil {
+		stream.CancelWrite(quic.StreamErrorCode(Canceled))
+		stream.CancelRead(quic.StreamErrorCode(Canceled))
+		return
+	}
+	finishStream(stream)
+}
+
+// ack completes the push acknowledged by ack. A PubAck for a push which is
+// not pending, acknowledged already through a duplicate, is ignored.
+func (w *pushWindow) ack(ack *codec.PubAck) {
+	w.mu.Lock()
+	p, ok := w.pending[ack.MessageId]
+	delete(w.pending, ack.MessageId)
+	w.mu.Unlock()
+	if !ok {
+		return
+	}
+	w.complete(p, statusError(ack.Status, ack.Trailer))
+	if w.acked != nil {
+		w.acked(p.props)
+	}
+}
+
+// complete ends p, removed from the window or its queue already, with err.
+func (w *pushWindow) complete(p *pendingPush, err error) {
+	p.err = err
+	close(p.done)
+	p.free()
+	if p.id != 0 {
+		<-w.slots
+	}
+}
+
+// attach delivers the pushes of the window over conn. The pending ones are
+// sent again first, in the order they were pushed.
+func (w *pushWindow) attach(conn *qrpcConn) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.conn = conn
+	w.resend = make([]*pendingPush, 0, len(w.pending))
+	for _, p := range w.pending {
+		w.resend = append(w.resend, p)
+	}
+	slices.SortFunc(w.resend, func(a, b *pendingPush) int {
+		return cmp.Compare(a.seq, b.seq)
+	})
+	if len(w.resend) > 0 || len(w.queue) > 0 {
+		w.startWriting()
+	}
+}
+
+// attached returns the connection the window delivers over, nil while the
+// client is away.
+func (w *pushWindow) attached() *qrpcConn {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.conn
+}
+
+// inflight returns the number of pushes not acknowledged yet.
+func (w *pushWindow) inflight() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.pending) + len(w.queue)
+}
+
+// detach stops delivering over conn and withdraws the shared pushes, and the
+// queued pushes at most once. It reports false if the window was attached to
+// another connection meanwhile.
+func (w *pushWindow) detach(conn *qrpcConn) bool {
+	w.mu.Lock()
+	if w.conn != conn {
+		w.mu.Unlock()
+		return false
+	}
+	w.conn = nil
+	w.resend = nil
+	var withdrawn []*pendingPush
+	for id, p := range w.pending {
+		if p.shared {
+			delete(w.pending, id)
+			withdrawn = append(withdrawn, p)
+		}
+	}
+	w.queue = slices.DeleteFunc(w.queue, func(p *pendingPush) bool {
+		if p.shared || p.once {
+			withdrawn = append(withdrawn, p)
+			return true
+		}
+		return false
+	})
+	w.mu.Unlock()
+
+	for _, p := range withdrawn {
+		w.complete(p, errMemberLeft)
+	}
+	return true
+}
+
+// discard fails the pending and queued pushes with err, and any later one.
+func (w *pushWindow) discard(err error) {
+	w.mu.Lock()
+	w.gone = true
+	pending := w.pending
+	queue := w.queue
+	w.pending = make(map[uint16]*pendingPush)
+	w.queue, w.resend = nil, nil
+	w.mu.Unlock()
+
+	for _, p := range pending {
+		w.complete(p, err)
+	}
+	for _, p := range queue {
+		w.complete(p, err)
+	}
+}
+
+// dedupKey identifies a call across the connections of a session. The
+// devices of a client under MultiDevice pick their MessageIds on their own,
+// a call is not mistaken for the one of another device.
+type dedupKey struct {
+	session   sessionKey
+	messageId uint16
+}
+
+// dedupEntry is a call of the dedup cache. ack is its reply once done is
+// closed, nil if the call ended without one.
+type dedupEntry struct {
+	key  dedupKey
+	done chan struct{}
+	ack  *codec.PubAck
+	// evicted is set when the entry leaves the ring while its call is still
+	// running, the call removes it once done. Guarded by the mutex of the
+	// cache.
+	evicted bool
+}
+
+// dedupCache remembers the replies of the most recent unary calls.
+type dedupCache struct {
+	mu      sync.Mutex
+	entries map[dedupKey]*dedupEntry
+	// ring holds the entries in insertion order, the oldest is evicted
+	// first.
+	ring []*dedupEntry
+	next int
+}
+
+func newDedupCache(size int) *dedupCache {
+	return &dedupCache{
+		entries: make(map[dedupKey]*dedupEntry, size),
+		ring:    make([]*dedupEntry, size),
+	}
+}
+
+// begin registers the call of key. When dup is set and the call is known, it
+// returns the entry of the original call instead, and true.
+func (d *dedupCache) begin(key dedupKey, dup bool) (*dedupEntry, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if e, ok := d.entries[key]; ok && dup {
+		return e, true
+	}
+
+	// A new call, or one reusing the MessageId of an old one, which it
+	// replaces.
+	if old := d.ring[d.next]; old != nil && d.entries[old.key] == old {
+		select {
+		case <-old.done:
+			delete(d.entries, old.key)
+		default:
+			// The oldest call is still running, a retry of it can still
+			// find it until it is done.
+			old.evicted = true
+		}
+	}
+	e := &dedupEntry{key: key, done: make(chan struct{})}
+	d.ring[d.next] = e
+	d.next = (d.next + 1) % len(d.ring)
+	d.entries[key] = e
+	return e, false
+}
+
+// finish records ack as the reply of e, copying its payload.
+func (d *dedupCache) finish(e *dedupEntry, ack *codec.PubAck) {
+	if ack != nil {
+		cp := *ack
+		if ack.Payload != nil {
+			cp.Payload = codec.SlicePayload(append([]byte(nil), ack.Payload.ReadOnlyData()...))
+		}
+		e.ack = &cp
+	}
+	d.mu.Lock()
+	if e.evicted && d.entries[e.key] == e {
+		delete(d.entries, e.key)
+	}
+	d.mu.Unlock()
+	close(e.done)
+}
@@ -0,0 +1,189 @@
+package qrpc
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/stonefire-oss/stonefire-im/demo/pb"
+	"github.com/stonefire-oss/stonefire-im/pkg/codec"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestServer_PushRedelivery(t *testing.T) {
+	t.Run("ack timeout", func(t *testing.T) {
+		s, addr := newTestServer(t, PushRetryInterval(time.Millisecond*100))
+		var calls atomic.Int32
+		newTestClient(t, addr, WithClientId("alice"), WithPushHandler(func(ctx context.Context, path string, dec func(any) error) error {
+			calls.Add(1)
+			// Late enough for the push to be sent again a few times.
+			time.Sleep(time.Millisecond * 350)
+			return nil
+		}))
+
+		if err := testPush(s, "alice", "bob"); err != nil {
+			t.Fatalf("Push() error = %v", err)
+		}
+		if n := calls.Load(); n != 1 {
+			t.Errorf("handler calls = %d, want 1", n)
+		}
+	})
+
+	t.Run("reconnect", func(t *testing.T) {
+		s, addr := newTestServer(t)
+		release := make(chan struct{})
+		defer close(release)
+		received := make(chan struct{})
+		first := newTestClient(t, addr, WithClientId("alice"), WithCleanSession(false), WithPushHandler(func(ctx context.Context, path string, dec func(any) error) error {
+			close(received)
+			<-release
+			return nil
+		}))
+
+		done := make(chan error, 1)
+		go func() { done <- testPush(s, "alice", "bob") }()
+		<-received
+		first.Close()
+
+		newTestClient(t, addr, WithClientId("alice"), WithCleanSession(false), WithPushHandler(func(ctx context.Context, path string, dec func(any) error) error {
+			return nil
+		}))
+		if err := <-done; err != nil {
+			t.Errorf("Push() error = %v", err)
+		}
+	})
+
+	tests := []struct {
+		name string
+		opts []ServerOption
+		dial []DialOption
+	}{
+		{name: "clean session"},
+		{name: "session expired", opts: []ServerOption{SessionExpiry(time.Millisecond * 100)}, dial: []DialOption{WithCleanSession(false)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, addr := newTestServer(t, tt.opts...)
+			release := make(chan struct{})
+			defer close(release)
+			received := make(chan struct{})
+			dial := append([]DialOption{WithClientId("alice"), WithPushHandler(func(ctx context.Context, path string, dec func(any) error) error {
+				close(received)
+				<-release
+				return nil
+			})}, tt.dial...)
+			cc := newTestClient(t, addr, dial...)
+
+			done := make(chan error, 1)
+			go func() { done <- testPush(s, "alice", "bob") }()
+			<-received
+			cc.Close()
+
+			if c := status.Code(<-done); c != codes.Unavailable {
+				t.Errorf("Push() code = %v, want %v", c, codes.Unavailable)
+			}
+		})
+	}
+}
+
+// rawCall sends req on a stream of its own and returns the reply.
+func rawCall(t *testing.T, cc *ClientConn, req *codec.Publish) *codec.PubAck {
+	t.Helper()
+	s, err := cc.conn.OpenStreamSync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.CancelRead(quic.StreamErrorCode(NoError))
+	s.SetDeadline(time.Now().Add(time.Second * 5))
+
+	if err := newFrameWriter(s, cc.opts.bufferPool).WriteMessage(req); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	msg, err := codec.DecodeOneMessage(s, codec.SlicePayloadBuiler{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ack, ok := msg.(*codec.PubAck)
+	if !ok {
+		t.Fatalf("reply = %v, want a PubAck", msg)
+	}
+	return ack
+}
+
+func TestServer_Dedup(t *testing.T) {
+	var calls atomic.Int32
+	count := func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		n := calls.Add(1)
+		res, err := handler(ctx, req)
+		if r, ok := res.(*pb.Result); ok {
+			r.Code = n
+		}
+		return res, err
+	}
+	_, addr := newTestServer(t, UnaryInterceptor(count), DedupCacheSize(16), DuplicateLogin(MultiDevice))
+	phone := newTestClient(t, addr, WithClientId("alice"), WithDeviceId("phone"))
+	laptop := newTestClient(t, addr, WithClientId("alice"), WithDeviceId("laptop"))
+
+	b, err := proto.Marshal(&pb.Student{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	call := func(cc *ClientConn, dup bool) int32 {
+		ack := rawCall(t, cc, &codec.Publish{
+			Header:    codec.Header{AckRequired: true, DupFlag: dup},
+			MessageId: 77,
+			Path:      pb.StudentService_CreateStudent_FullMethodName,
+			Payload:   codec.SlicePayload(b),
+		})
+		if err := statusError(ack.Status, ack.Trailer); err != nil {
+			t.Fatalf("call error = %v", err)
+		}
+		var res pb.Result
+		if err := proto.Unmarshal(ack.Payload.ReadOnlyData(), &res); err != nil {
+			t.Fatal(err)
+		}
+		return res.Code
+	}
+
+	tests := []struct {
+		name string
+		cc   *ClientConn
+		dup  bool
+		want int32
+	}{
+		{name: "first", cc: phone, want: 1},
+		{name: "retry", cc: phone, dup: true, want: 1},
+		{name: "retry again", cc: phone, dup: true, want: 1},
+		{name: "same id from another device", cc: laptop, dup: true, want: 2},
+		{name: "retry from another device", cc: laptop, dup: true, want: 2},
+		{name: "retry after another device", cc: phone, dup: true, want: 1},
+		{name: "id reused", cc: phone, want: 3},
+	}
+	for _, tt := range tests {
+		if got := call(tt.cc, tt.dup); got != tt.want {
+			t.Errorf("%s: reply of call %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDedupCache_EvictRunning(t *testing.T) {
+	d := newDedupCache(2)
+	running, _ := d.begin(dedupKey{messageId: 1}, false)
+	for id := range uint16(10) {
+		e, _ := d.begin(dedupKey{messageId: id + 2}, false)
+		d.finish(e, nil)
+	}
+	if e, dup := d.begin(dedupKey{messageId: 1}, true); !dup || e != running {
+		t.Errorf("begin() of a running call evicted = %v, %v, want it", e, dup)
+	}
+	d.finish(running, nil)
+	if got := len(d.entries); got != 2 {
+		t.Errorf("entries = %d, want 2", got)
+	}
+}
@@ -4,11 +4,15 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/quic-go/quic-go"
 	"github.com/stonefire-oss/stonefire-im/pkg/codec"
 	"github.com/stonefire-oss/stonefire-im/pkg/utils"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/mem"
+	"google.golang.org/grpc/status"
 )
 
 const (
@@ -16,11 +20,15 @@ const (
 	SessionTimeoutErr     = 0xFF00
 	UnSupportMessageErr   = 0xFF01
 	ServiceUnavailableErr = 0xFF02
+	UnauthenticatedErr    = 0xFF03
+	SessionTakenOverErr   = 0xFF04
 	ApplicationErr        = 0xFFFF
 
 	SessionTimeoutErrMsg     = "session timeout"
 	UnSupportMessageErrMsg   = "unsupport message type"
 	ServiceUnavailableErrMsg = "service unavailable"
+	UnauthenticatedErrMsg    = "connection not authenticated"
+	SessionTakenOverErrMsg   = "session taken over"
 )
 
 type CloseReason uint64
@@ -39,13 +47,42 @@ func (r CloseReason) String() string {
 		return UnSupportMessageErrMsg
 	case ServiceUnavailableErr:
 		return ServiceUnavailableErrMsg
+	case UnauthenticatedErr:
+		return UnauthenticatedErrMsg
+	case SessionTakenOverErr:
+		return SessionTakenOverErrMsg
 	default:
 		return fmt.Sprintf("unknown code %d", r)
 	}
 }
 
+// DisconnectReason is the ReasonCode carried by a codec.Disconnect.
+type DisconnectReason uint8
+
+const (
+	DisconnectNormal DisconnectReason = iota
+	DisconnectServerShutdown
+	// DisconnectSessionTakenOver is sent to a connection replaced by a newer
+	// one of the same client, see LoginPolicy.
+	DisconnectSessionTakenOver
+)
+
+func (r DisconnectReason) String() string {
+	switch r {
+	case DisconnectNormal:
+		return "normal disconnection"
+	case DisconnectServerShutdown:
+		return "server shutting down"
+	case DisconnectSessionTakenOver:
+		return "session taken over"
+	default:
+		return fmt.Sprintf("unknown reason %d", r)
+	}
+}
+
 type qrpcConn struct {
 	conn              quic.Connection
+	srv               *Server
 	quit              *utils.Event
 	closed            *utils.Event
 	mu                sync.Mutex
@@ -53,16 +90,49 @@ type qrpcConn struct {
 	maxConnectionIdle time.Duration
 	ctx               context.Context
 	plmk              codec.PayloadBuilder
+	bufferPool        mem.BufferPool
+
+	// acceptCtx is canceled when the server stops taking new streams.
+	acceptCtx context.Context
+	// streamQuota bounds the streams being read or served at once.
+	streamQuota       *utils.AtomicSemaphore
+	firstFrameTimeout time.Duration
+
+	// The connection is connected once its Connect was accepted, the
+	// fields below are set by then.
+	connected bool
+	auth      Authenticator
+	identity  any
+	ua        *UserAgent
+	session   sessionKey
+	// backlog is set if the connection delivers the offline messages of
+	// the client.
+	backlog bool
+	// will is published when the connection ends, unless the client
+	// disconnected or the connection was taken over.
+	will atomic.Pointer[lastWill]
+
+	maxSendMessageSize    int
+	maxReceiveMessageSize int
 }
 
 func newQRPConn(conn quic.Connection, s *Server) *qrpcConn {
 	qc := &qrpcConn{
 		conn:              conn,
+		srv:               s,
 		quit:              s.quit,
 		closed:            utils.NewEvent(),
 		maxConnectionIdle: s.opts.maxConnectionIdle,
-		ctx:               context.Background(),
-		plmk:              &pooledPLMaker{s.opts.bufferPool},
+		ctx:               conn.Context(),
+		plmk:              &pooledPLMaker{p: s.opts.bufferPool, maxSize: s.opts.maxReceiveMessageSize},
+		bufferPool:        s.opts.bufferPool,
+		acceptCtx:         s.ctx,
+		streamQuota:       utils.NewHandlerQuota(s.opts.maxConcurrentStreams),
+		firstFrameTimeout: s.opts.firstFrameTimeout,
+		auth:              s.opts.auth,
+
+		maxSendMessageSize:    s.opts.maxSendMessageSize,
+		maxReceiveMessageSize: s.opts.maxReceiveMessageSize,
 	}
 	return qc
 }
@@ -84,6 +154,20 @@ func (c *qrpcConn) close(code quic.ApplicationErrorCode, msg string) error {
 	return nil
 }
 
+// disconnect tells the peer why the connection is going away on a stream
+// opened by the server. The connection itself is left open.
+func (c *qrpcConn) disconnect(r DisconnectReason) error {
+	stream, err := c.conn.OpenStream()
+	if err != nil {
+		return err
+	}
+	defer finishStream(stream)
+
+	stream.SetWriteDeadline(time.Now().Add(time.Second))
+	dis := codec.Disconnect{ReasonCode: uint8(r)}
+	return dis.Encode(stream)
+}
+
 func (c *qrpcConn) keepalive() {
 	idleTimer := time.NewTimer(c.maxConnectionIdle)
 
@@ -118,11 +202,20 @@ func (c *qrpcConn) keepalive() {
 	}
 }
 
+// finishStream closes the send direction of s and discards whatever the
+// peer may still send, so that QUIC can retire the stream.
+func finishStream(s quic.Stream) {
+	s.Close()
+	s.CancelRead(quic.StreamErrorCode(NoError))
+}
+
 type UserAgent struct {
 	Protocal      string
 	ClientId      string
 	ClientVersion string
 	OSType        string
+	DeviceId      string
+	Props         codec.Props
 }
 
 type serverConnKey struct{}
@@ -138,26 +231,42 @@ func qrpcConnFromContext(ctx context.Context) *qrpcConn {
 	return nil
 }
 
+// Serve reads the Connect of the connection, then serves its streams. Every
+// stream is read and served by a goroutine of its own, so that a stalled
+// stream holds up no other; the number of such goroutines is bounded by the
+// stream quota.
 func (c *qrpcConn) Serve(handler streamHandler) error {
 	if c.quit.HasFired() {
 		c.closeWithReason(ServiceUnavailableErr)
 		return nil
 	}
 
+	// A client which does not send its Connect in time is reaped like an
+	// idle one.
+	c.touch()
 	go c.keepalive()
 
 	defer func() {
-		c.closeWithReason(SessionTimeoutErr)
+		// Once the server is stopping it closes the connection itself, after
+		// the in-flight handlers are done.
+		if !c.quit.HasFired() {
+			c.closeWithReason(SessionTimeoutErr)
+		}
 	}()
 
+	ctx := context.WithValue(c.ctx, serverConnKey{}, c)
+	// A connection out of quota waits for it until the server stops taking
+	// streams or the connection ends.
+	quotaCtx, cancel := context.WithCancel(c.acceptCtx)
+	defer cancel()
+	stop := context.AfterFunc(c.ctx, cancel)
+	defer stop()
 	for {
-		if c.quit.HasFired() {
-			return nil
-		}
-
-		ctx := context.WithValue(c.ctx, serverConnKey{}, c)
-		stream, err := c.conn.AcceptStream(ctx)
+		stream, err := c.conn.AcceptStream(c.acceptCtx)
 		if err != nil {
+			if c.quit.HasFired() {
+				return nil
+			}
 			if appErr, ok := err.(*quic.ApplicationError); ok {
 				if appErr.ErrorCode == quic.ApplicationErrorCode(quic.NoError) {
 					return nil
@@ -166,30 +275,171 @@ func (c *qrpcConn) Serve(handler streamHandler) error {
 			return err
 		}
 
-		msg, err := codec.DecodeOneMessage(stream, c.plmk)
-		if err != nil {
-			return err
-		}
-		switch vv := msg.(type) {
-		case *codec.Disconnect:
-			return c.closeWithReason(NoError)
-		case *codec.Connect:
-			c.idle = time.Now()
-			return nil
-		case *codec.Ping:
-			c.idle = time.Now()
-			pong := codec.PingAck{}
-			if err := pong.Encode(stream); err != nil {
+		if !c.connected {
+			// Nothing else is read before the Connect is accepted.
+			msg, err := c.readFirstFrame(stream)
+			if err != nil {
+				return err
+			}
+			if err := c.handshake(ctx, msg, stream); err != nil {
 				return err
 			}
-		case *codec.Publish:
-			c.idle = time.Now()
-			handler(ctx, vv, stream)
-		default:
-			if pc, ok := vv.(codec.PayloadContainer); ok {
-				FreePayload(pc)
+			continue
+		}
+
+		if err := c.streamQuota.Acquire(quotaCtx); err != nil {
+			// The next AcceptStream reports why.
+			stream.CancelWrite(quic.StreamErrorCode(Unavailable))
+			stream.CancelRead(quic.StreamErrorCode(Unavailable))
+			continue
+		}
+		go c.serveStream(ctx, stream, handler)
+	}
+}
+
+// readFirstFrame reads the frame opening stream, within firstFrameTimeout.
+func (c *qrpcConn) readFirstFrame(stream quic.Stream) (codec.Message, error) {
+	if c.firstFrameTimeout > 0 {
+		stream.SetReadDeadline(time.Now().Add(c.firstFrameTimeout))
+	}
+	msg, err := codec.DecodeOneMessage(stream, c.plmk)
+	stream.SetReadDeadline(time.Time{})
+	return msg, err
+}
+
+// serveStream reads the first frame of stream and serves it. It holds a slot
+// of the stream quota, which is handed over to handler with a Publish.
+func (c *qrpcConn) serveStream(ctx context.Context, stream quic.Stream, handler streamHandler) {
+	msg, err := c.readFirstFrame(stream)
+	if err != nil {
+		defer c.streamQuota.Release()
+		if pub, ok := msg.(*codec.Publish); ok && status.Code(err) == codes.ResourceExhausted {
+			// The payload was refused by the PayloadBuilder, only the call
+			// fails.
+			replyStatus(newFrameWriter(stream, c.bufferPool), pub, ResourceExhausted, status.Convert(err).Message())
+			finishStream(stream)
+			return
+		}
+		// The stream is stalled or broken, the connection goes on.
+		stream.CancelRead(quic.StreamErrorCode(Canceled))
+		stream.CancelWrite(quic.StreamErrorCode(Canceled))
+		return
+	}
+
+	switch vv := msg.(type) {
+	case *codec.Publish:
+		c.touch()
+		c.seen(true)
+		handler(ctx, vv, stream)
+		return
+	case *codec.Ping:
+		c.touch()
+		c.seen(false)
+		pong := codec.PingAck{}
+		pong.Encode(stream)
+		finishStream(stream)
+	case *codec.Subscribe:
+		c.touch()
+		c.seen(true)
+		c.srv.handleSubscribe(ctx, c, stream, vv)
+		finishStream(stream)
+	case *codec.Unsubscribe:
+		c.touch()
+		c.seen(true)
+		c.srv.handleUnsubscribe(c, stream, vv)
+		finishStream(stream)
+	case *codec.Disconnect:
+		c.will.Store(nil)
+		c.closeWithReason(NoError)
+	default:
+		if pc, ok := vv.(codec.PayloadContainer); ok {
+			FreePayload(pc)
+		}
+		c.closeWithReason(UnSupportMessageErr)
+	}
+	c.streamQuota.Release()
+}
+
+// touch records activity on the connection, which keeps it from being
+// reaped as idle.
+func (c *qrpcConn) touch() {
+	c.mu.Lock()
+	c.idle = time.Now()
+	c.mu.Unlock()
+}
+
+// seen records a frame of the client for its presence, active unless it is
+// a Ping.
+func (c *qrpcConn) seen(active bool) {
+	if c.srv.presence != nil {
+		c.srv.presence.seen(c.ua.ClientId, active)
+	}
+}
+
+// handshake processes the first message of the connection, which must be a
+// Connect. Anything else ends the connection.
+func (c *qrpcConn) handshake(ctx context.Context, msg codec.Message, stream quic.Stream) error {
+	req, ok := msg.(*codec.Connect)
+	if !ok {
+		if pub, ok := msg.(*codec.Publish); ok {
+			FreePayload(pub)
+			replyStatus(newFrameWriter(stream, c.bufferPool), pub, Unauthenticated, "qrpc: Connect expected")
+		}
+		finishStream(stream)
+		return c.lingerClose(UnauthenticatedErr)
+	}
+
+	c.touch()
+
+	ack := c.authenticate(ctx, req)
+	if ack.ReturnCode == codec.RetCodeAccepted && c.srv.topics != nil {
+		if w, err := parseWill(req.Props); err != nil {
+			ack.ReturnCode = codec.RetCodeBadWill
+		} else if w != nil && c.srv.checkTopic(ctx, w.pub.Path, TopicPublish) != nil {
+			ack.ReturnCode = codec.RetCodeNotAuthorized
+		} else {
+			c.will.Store(w)
+		}
+	}
+	if ack.ReturnCode == codec.RetCodeAccepted {
+		// The client can be pushed to as soon as it knows it is connected.
+		ok, present := c.srv.addClient(c, req.CleanSession)
+		if ok {
+			c.connected = true
+			ack.SessionPresent = present
+			if c.srv.presence != nil {
+				c.srv.presence.connected(c.ua.ClientId)
 			}
-			return c.closeWithReason(UnSupportMessageErr)
+		} else {
+			ack.ReturnCode = codec.RetCodeClientIdInUse
 		}
 	}
+	err := ack.Encode(stream)
+	finishStream(stream)
+	if err != nil {
+		return err
+	}
+	if !c.connected {
+		return c.lingerClose(UnauthenticatedErr)
+	}
+	if c.backlog {
+		go c.srv.deliverBacklog(c)
+	}
+	if c.srv.opts.onDatagram != nil && c.conn.ConnectionState().SupportsDatagrams {
+		go c.receiveDatagrams(ctx)
+	}
+	return nil
+}
+
+// lingerClose gives the peer the time to read the last reply it was sent and
+// hang up before closing the connection, since closing it discards the data
+// not sent yet.
+func (c *qrpcConn) lingerClose(r CloseReason) error {
+	t := time.NewTimer(c.maxConnectionIdle)
+	select {
+	case <-c.conn.Context().Done():
+	case <-t.C:
+	}
+	t.Stop()
+	return c.closeWithReason(r)
 }
@@ -0,0 +1,388 @@
+package qrpc
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/stonefire-oss/stonefire-im/pkg/codec"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// A server with receipts enabled, see EnableReceipts, tells the sender of a
+// message of a conversation, set with PushSender, when it reaches each of
+// its recipients and when they read it.
+//
+// A delivered receipt is made when the recipient acknowledges the QoS 1 push
+// of the message. A read receipt is made when a client advances its read
+// cursor in a conversation with MarkRead: every message up to the cursor is
+// read. It goes to the senders of the messages newly read, found in the
+// conversation store, and to the other devices of the reader, which keep
+// their cursor in step. The read cursors are kept in memory, one per reader
+// and conversation for as long as the server runs, they are lost when it
+// restarts: the senders then get the read receipts of the messages read
+// before again, the next time their reader advances.
+//
+// The receipts for a client are gathered for ReceiptInterval, then pushed in
+// a batch, the read receipts of a conversation boiled down to the last one.
+// They are handled by the ReceiptHandler of the client.
+
+const (
+	// SenderProp is the Props key carrying the ClientId of the sender of a
+	// message, see PushSender.
+	SenderProp = "qrpc-sender"
+
+	defaultReceiptInterval = time.Millisecond * 200
+	// maxReceiptBatch is the number of receipts pushed at once at most.
+	maxReceiptBatch = 256
+
+	// receiptPath is the path of the pushes carrying receipts. Each receipt
+	// is a value of every one of the receipt keys, in the same position.
+	receiptPath      = "/qrpc.Receipts/Push"
+	receiptKindKey   = "qrpc-receipt-kind"
+	receiptConvKey   = "qrpc-receipt-conv"
+	receiptSeqKey    = "qrpc-receipt-seq"
+	receiptClientKey = "qrpc-receipt-client"
+
+	// markReadMethod is the path of the MarkRead call, whose request and
+	// reply carry the cursor in readSeqKey.
+	markReadMethod = "/qrpc.Receipts/MarkRead"
+	readSeqKey     = "qrpc-read-seq"
+)
+
+// ReceiptKind tells what a receipt acknowledges.
+type ReceiptKind uint8
+
+const (
+	// ReceiptDelivered tells that a message reached a recipient.
+	ReceiptDelivered ReceiptKind = iota + 1
+	// ReceiptRead tells that a recipient read every message of a
+	// conversation up to a seq.
+	ReceiptRead
+)
+
+func (k ReceiptKind) String() string {
+	switch k {
+	case ReceiptDelivered:
+		return "delivered"
+	case ReceiptRead:
+		return "read"
+	default:
+		return fmt.Sprintf("unknown receipt %d", k)
+	}
+}
+
+// Receipt tells that the client ClientId got the message Seq of the
+// conversation Conv, or read it along with those before.
+type Receipt struct {
+	Kind     ReceiptKind
+	Conv     string
+	Seq      uint64
+	ClientId string
+}
+
+// ReceiptHandler handles a batch of receipts pushed by the server. A batch
+// may be delivered more than once.
+type ReceiptHandler func(ctx context.Context, receipts []Receipt)
+
+// queuedReceipt is a receipt waiting to be pushed, not to the connection
+// skip, which made it.
+type queuedReceipt struct {
+	Receipt
+	skip *qrpcConn
+}
+
+type readKey struct {
+	clientId, conv string
+}
+
+// receiptQueue holds the read cursors and batches the receipts.
+type receiptQueue struct {
+	interval time.Duration
+	// flush pushes the receipts of a client.
+	flush func(clientId string, rs []queuedReceipt)
+
+	mu      sync.Mutex
+	cursors map[readKey]uint64
+	pending map[string][]queuedReceipt
+	timer   *time.Timer
+}
+
+func newReceiptQueue(interval time.Duration, flush func(string, []queuedReceipt)) *receiptQueue {
+	return &receiptQueue{
+		interval: interval,
+		flush:    flush,
+		cursors:  make(map[readKey]uint64),
+		pending:  make(map[string][]queuedReceipt),
+	}
+}
+
+// add queues r for clientId, unless it is queued already, as happens with a
+// recipient connected from several devices. A read receipt replaces the one
+// queued for the same reader and conversation.
+func (q *receiptQueue) add(clientId string, r queuedReceipt) {
+	q.mu.Lock()
+	rs := q.pending[clientId]
+	i := slices.IndexFunc(rs, func(old queuedReceipt) bool {
+		if r.Kind == ReceiptRead {
+			return old.Kind == ReceiptRead && old.Conv == r.Conv && old.ClientId == r.ClientId
+		}
+		return old == r
+	})
+	if i >= 0 {
+		if rs[i].Seq <= r.Seq {
+			rs[i] = r
+		}
+	} else {
+		rs = append(rs, r)
+	}
+	if len(rs) >= maxReceiptBatch {
+		delete(q.pending, clientId)
+		q.mu.Unlock()
+		q.flush(clientId, rs)
+		return
+	}
+	q.pending[clientId] = rs
+	if q.timer == nil {
+		q.timer = time.AfterFunc(q.interval, q.flushAll)
+	}
+	q.mu.Unlock()
+}
+
+func (q *receiptQueue) flushAll() {
+	q.mu.Lock()
+	pending := q.pending
+	q.pending = make(map[string][]queuedReceipt)
+	q.timer = nil
+	q.mu.Unlock()
+	for clientId, rs := range pending {
+		q.flush(clientId, rs)
+	}
+}
+
+// advance moves the read cursor of clientId in conv to seq if it is behind.
+// It returns the cursor before and after.
+func (q *receiptQueue) advance(clientId, conv string, seq uint64) (old, cur uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	key := readKey{clientId: clientId, conv: conv}
+	old = q.cursors[key]
+	if seq > old {
+		q.cursors[key] = seq
+		return old, seq
+	}
+	return old, old
+}
+
+// ReadCursor returns the seq up to which clientId read the conversation
+// conv, zero if receipts are not enabled.
+func (s *Server) ReadCursor(clientId, conv string) uint64 {
+	if s.receipts == nil {
+		return 0
+	}
+	s.receipts.mu.Lock()
+	defer s.receipts.mu.Unlock()
+	return s.receipts.cursors[readKey{clientId: clientId, conv: conv}]
+}
+
+// delivered queues the delivered receipt of the push to recipient with
+// props, if it is a message of a conversation with a sender.
+func (s *Server) delivered(recipient string, props codec.Props) {
+	sender := propValue(props, SenderProp)
+	conv := propValue(props, ConversationIdProp)
+	seq, err := strconv.ParseUint(propValue(props, ConversationSeqProp), 10, 64)
+	if sender == "" || sender == recipient || conv == "" || err != nil {
+		return
+	}
+	s.receipts.add(sender, queuedReceipt{Receipt: Receipt{
+		Kind:     ReceiptDelivered,
+		Conv:     conv,
+		Seq:      seq,
+		ClientId: recipient,
+	}})
+}
+
+// sendReceipts pushes rs to the connections of clientId, or stores them if
+// there are none.
+func (s *Server) sendReceipts(clientId string, rs []queuedReceipt) {
+	if s.opts.offline != nil {
+		if live, _ := s.storeOffline(clientId, receiptPublish(rs, nil)); !live {
+			return
+		}
+	}
+	conns := s.clientConns(clientId)
+	for _, c := range conns {
+		if pub := receiptPublish(rs, c); pub != nil {
+			go s.publish(s.ctx, c.session, pub)
+		}
+	}
+}
+
+// receiptPublish returns the push of the receipts of rs not made by c, nil
+// if there are none.
+func receiptPublish(rs []queuedReceipt, c *qrpcConn) *codec.Publish {
+	props := make(codec.Props, 4)
+	for _, r := range rs {
+		if c != nil && r.skip == c {
+			continue
+		}
+		props[receiptKindKey] = append(props[receiptKindKey], strconv.Itoa(int(r.Kind)))
+		props[receiptConvKey] = append(props[receiptConvKey], r.Conv)
+		props[receiptSeqKey] = append(props[receiptSeqKey], strconv.FormatUint(r.Seq, 10))
+		props[receiptClientKey] = append(props[receiptClientKey], r.ClientId)
+	}
+	if len(props) == 0 {
+		return nil
+	}
+	return &codec.Publish{Path: receiptPath, Props: props}
+}
+
+// parseReceipts returns the receipts carried by props.
+func parseReceipts(props codec.Props) ([]Receipt, error) {
+	kinds, convs, seqs, clients := props[receiptKindKey], props[receiptConvKey], props[receiptSeqKey], props[receiptClientKey]
+	if len(convs) != len(kinds) || len(seqs) != len(kinds) || len(clients) != len(kinds) {
+		return nil, status.Error(codes.InvalidArgument, "qrpc: malformed receipts")
+	}
+	rs := make([]Receipt, len(kinds))
+	for i := range kinds {
+		kind, err1 := strconv.ParseUint(kinds[i], 10, 8)
+		seq, err2 := strconv.ParseUint(seqs[i], 10, 64)
+		if err1 != nil || err2 != nil {
+			return nil, status.Error(codes.InvalidArgument, "qrpc: malformed receipts")
+		}
+		rs[i] = Receipt{Kind: ReceiptKind(kind), Conv: convs[i], Seq: seq, ClientId: clients[i]}
+	}
+	return rs, nil
+}
+
+// handleMarkRead serves a MarkRead call, the reply carries the cursor.
+func (s *Server) handleMarkRead(ctx context.Context, req *codec.Publish, fw *frameWriter) (codec.Props, error) {
+	if s.receipts == nil {
+		return nil, status.Error(Unimplemented, "qrpc: receipts are not enabled")
+	}
+	conv := propValue(req.Props, ConversationIdProp)
+	seq, err := strconv.ParseUint(propValue(req.Props, readSeqKey), 10, 64)
+	if conv == "" || err != nil {
+		return nil, status.Error(InvalidArgument, "qrpc: malformed MarkRead request")
+	}
+	if s.opts.conversationAccess == nil {
+		return nil, status.Error(PermissionDenied, "qrpc: conversations cannot be read")
+	}
+	if err := s.opts.conversationAccess(ctx, conv); err != nil {
+		return nil, err
+	}
+	// A cursor past the last message would hold back the read receipts of
+	// the messages to come.
+	if s.opts.conversations == nil {
+		return nil, status.Error(FailedPrecondition, "qrpc: no conversation store")
+	}
+	if seq > 0 {
+		msgs, err := s.opts.conversations.Fetch(conv, seq-1, 1)
+		if err != nil {
+			return nil, status.Errorf(Internal, "qrpc: conversation %q: %v", conv, err)
+		}
+		if len(msgs) == 0 {
+			return nil, status.Errorf(OutOfRange, "qrpc: seq %d is past the last message of conversation %q", seq, conv)
+		}
+	}
+
+	c := qrpcConnFromContext(ctx)
+	reader := c.session.clientId
+	old, cur := s.receipts.advance(reader, conv, seq)
+	if cur > old {
+		r := Receipt{Kind: ReceiptRead, Conv: conv, Seq: cur, ClientId: reader}
+		s.receipts.add(reader, queuedReceipt{Receipt: r, skip: c})
+		for _, sender := range s.readSenders(conv, old, cur) {
+			if sender != reader {
+				s.receipts.add(sender, queuedReceipt{Receipt: r})
+			}
+		}
+	}
+	return codec.Props{readSeqKey: {strconv.FormatUint(cur, 10)}}, nil
+}
+
+// readSenders returns the senders of the messages of conv in (after, to],
+// found in the conversation store.
+func (s *Server) readSenders(conv string, after, to uint64) []string {
+	if s.opts.conversations == nil {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var senders []string
+	for after < to {
+		msgs, err := s.opts.conversations.Fetch(conv, after, maxSyncBatch)
+		if err != nil || len(msgs) == 0 {
+			break
+		}
+		for _, m := range msgs {
+			if m.Seq > to {
+				return senders
+			}
+			if sender := propValue(m.Props, SenderProp); sender != "" && !seen[sender] {
+				seen[sender] = true
+				senders = append(senders, sender)
+			}
+			after = m.Seq
+		}
+	}
+	return senders
+}
+
+// MarkRead advances the read cursor of the client in the conversation conv
+// to seq, unless it is further already, and returns the cursor. The senders
+// of the messages newly read and the other devices of the client get a read
+// receipt. The server decides which conversations the client can read, see
+// ConversationAccess. MarkRead fails with OutOfRange if there is no message
+// seq in the conversation yet.
+func (cc *ClientConn) MarkRead(ctx context.Context, conv string, seq uint64) (uint64, error) {
+	req := &codec.Publish{
+		Header:    codec.Header{AckRequired: true},
+		MessageId: cc.nextMessageId(),
+		Path:      markReadMethod,
+		Props:     outgoingProps(ctx),
+	}
+	if req.Props == nil {
+		req.Props = make(codec.Props)
+	}
+	req.Props[ConversationIdProp] = []string{conv}
+	req.Props[readSeqKey] = []string{strconv.FormatUint(seq, 10)}
+	reply, err := cc.roundTrip(ctx, req)
+	if err != nil {
+		return 0, err
+	}
+	ack, ok := reply.(*codec.PubAck)
+	if !ok || ack.MessageId != req.MessageId {
+		return 0, status.Errorf(codes.Internal, "qrpc: unexpected %v frame in reply to MarkRead", reply)
+	}
+	defer FreePayload(ack)
+	if err := statusError(ack.Status, ack.Trailer); err != nil {
+		return 0, err
+	}
+	cur, err := strconv.ParseUint(propValue(ack.Props, readSeqKey), 10, 64)
+	if err != nil {
+		return 0, status.Error(codes.Internal, "qrpc: MarkRead reply without seq")
+	}
+	return cur, nil
+}
+
+type senderKey struct{}
+
+// withSender returns ctx carrying the sender of the message with props, if
+// it has one.
+func withSender(ctx context.Context, props codec.Props) context.Context {
+	if sender := propValue(props, SenderProp); sender != "" {
+		return context.WithValue(ctx, senderKey{}, sender)
+	}
+	return ctx
+}
+
+// SenderFromContext returns the ClientId of the sender of the message a
+// PushHandler was called for, see PushSender, false if it has none.
+func SenderFromContext(ctx context.Context) (string, bool) {
+	sender, ok := ctx.Value(senderKey{}).(string)
+	return sender, ok
+}
@@ -0,0 +1,99 @@
+package qrpc
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stonefire-oss/stonefire-im/demo/pb"
+	"github.com/stonefire-oss/stonefire-im/pkg/store"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestServer_Receipts(t *testing.T) {
+	allow := func(ctx context.Context, conv string) error { return nil }
+	s, addr := newTestServer(t,
+		EnableReceipts(true),
+		ReceiptInterval(time.Millisecond*50),
+		DuplicateLogin(MultiDevice),
+		ConversationStore(store.NewMemory()),
+		ConversationAccess(allow),
+	)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	receiver := func(received chan<- Receipt) DialOption {
+		return WithReceiptHandler(func(ctx context.Context, rs []Receipt) {
+			for _, r := range rs {
+				received <- r
+			}
+		})
+	}
+	senders := make(chan string, 4)
+	pushHandler := WithPushHandler(func(ctx context.Context, path string, dec func(any) error) error {
+		if sender, ok := SenderFromContext(ctx); ok {
+			senders <- sender
+		}
+		return nil
+	})
+	alice, phone, laptop := make(chan Receipt, 16), make(chan Receipt, 16), make(chan Receipt, 16)
+	newTestClient(t, addr, WithClientId("alice"), receiver(alice))
+	bob := newTestClient(t, addr, WithClientId("bob"), WithDeviceId("phone"), receiver(phone), pushHandler)
+	newTestClient(t, addr, WithClientId("bob"), WithDeviceId("laptop"), receiver(laptop), pushHandler)
+
+	for range 2 {
+		if _, err := s.PushConversation(ctx, "room", []string{"bob"}, testPushPath, &pb.Student{}, PushSender("alice")); err != nil {
+			t.Fatalf("PushConversation() error = %v", err)
+		}
+	}
+	for range 4 {
+		if sender := <-senders; sender != "alice" {
+			t.Errorf("SenderFromContext() = %q, want alice", sender)
+		}
+	}
+	// Both devices of bob acknowledged each message, alice gets every
+	// receipt at least once.
+	expect := func(received <-chan Receipt, want ...Receipt) {
+		t.Helper()
+		missing := make(map[Receipt]bool)
+		for _, r := range want {
+			missing[r] = true
+		}
+		for len(missing) > 0 {
+			select {
+			case r := <-received:
+				delete(missing, r)
+			case <-ctx.Done():
+				t.Fatalf("receipts %v not received", missing)
+			}
+		}
+	}
+	expect(alice,
+		Receipt{Kind: ReceiptDelivered, Conv: "room", Seq: 1, ClientId: "bob"},
+		Receipt{Kind: ReceiptDelivered, Conv: "room", Seq: 2, ClientId: "bob"},
+	)
+
+	read := Receipt{Kind: ReceiptRead, Conv: "room", Seq: 2, ClientId: "bob"}
+	if cur, err := bob.MarkRead(ctx, "room", 2); err != nil || cur != 2 {
+		t.Fatalf("MarkRead() = %d, %v, want 2", cur, err)
+	}
+	expect(alice, read)
+	expect(laptop, read)
+	// The cursor does not go back.
+	if cur, err := bob.MarkRead(ctx, "room", 1); err != nil || cur != 2 {
+		t.Errorf("MarkRead() behind the cursor = %d, %v, want 2", cur, err)
+	}
+	if _, err := bob.MarkRead(ctx, "room", math.MaxUint64); status.Code(err) != codes.OutOfRange {
+		t.Errorf("MarkRead() past the last message error = %v, want %v", err, codes.OutOfRange)
+	}
+	if cur := s.ReadCursor("bob", "room"); cur != 2 {
+		t.Errorf("ReadCursor() = %d, want 2", cur)
+	}
+	select {
+	case r := <-phone:
+		t.Errorf("the device which marked the conversation read got %+v", r)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
@@ -0,0 +1,81 @@
+package qrpc
+
+import (
+	"sync"
+
+	"github.com/stonefire-oss/stonefire-im/pkg/broker"
+	"github.com/stonefire-oss/stonefire-im/pkg/codec"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultRetainedMessages = 10000
+	defaultMaxRetainedSize  = 64 * 1024
+)
+
+// retainedMessage is the last retained Publish on a topic, with the QoS it
+// was published with.
+type retainedMessage struct {
+	pub *codec.Publish
+	qos codec.QosLevel
+}
+
+// retainStore keeps the last retained Publish of each topic, which the
+// broker sends to the sessions subscribing to the topic later on. A retained
+// Publish without payload clears the topic.
+type retainStore struct {
+	max, maxSize int
+
+	mu   sync.Mutex
+	msgs map[string]retainedMessage
+}
+
+// newRetainStore returns a store of at most max messages, nil if max is not
+// positive.
+func newRetainStore(max, maxSize int) *retainStore {
+	if max <= 0 {
+		return nil
+	}
+	return &retainStore{
+		max:     max,
+		maxSize: maxSize,
+		msgs:    make(map[string]retainedMessage),
+	}
+}
+
+// set retains pub, which the store takes over and must not be modified.
+func (r *retainStore) set(pub *codec.Publish, qos codec.QosLevel) error {
+	size := 0
+	if pub.Payload != nil {
+		size = pub.Payload.Len()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if size == 0 {
+		delete(r.msgs, pub.Path)
+		return nil
+	}
+	if size > r.maxSize {
+		return status.Errorf(codes.ResourceExhausted, "qrpc: retained message larger than max (%d vs. %d)", size, r.maxSize)
+	}
+	if _, ok := r.msgs[pub.Path]; !ok && len(r.msgs) >= r.max {
+		return status.Errorf(codes.ResourceExhausted, "qrpc: too many retained messages (max %d)", r.max)
+	}
+	r.msgs[pub.Path] = retainedMessage{pub: pub, qos: qos}
+	return nil
+}
+
+// match returns the retained messages whose topic matches filter.
+func (r *retainStore) match(filter string) []retainedMessage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var res []retainedMessage
+	for topic, m := range r.msgs {
+		if broker.Match(filter, topic) {
+			res = append(res, m)
+		}
+	}
+	return res
+}
@@ -0,0 +1,76 @@
+package qrpc
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stonefire-oss/stonefire-im/demo/pb"
+	"github.com/stonefire-oss/stonefire-im/pkg/codec"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestServer_Retained(t *testing.T) {
+	_, addr := newTestServer(t, EnableBroker(true), RetainedMessages(2), MaxRetainedSize(32))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	pub := newTestClient(t, addr, WithClientId("bob"))
+
+	publishes := []struct {
+		topic    string
+		name     string // nil message if empty
+		retain   bool
+		wantCode codes.Code
+	}{
+		{topic: "status/alice", name: "away", retain: true},
+		{topic: "status/bob", name: "online", retain: true},
+		{topic: "status/carol", name: "online", retain: true, wantCode: codes.ResourceExhausted},
+		{topic: "status/dave", name: "online"},
+		{topic: "status/alice", name: "online", retain: true},
+		{topic: "status/alice", name: strings.Repeat("x", 32), retain: true, wantCode: codes.ResourceExhausted},
+	}
+	for _, p := range publishes {
+		var msg any
+		if p.name != "" {
+			msg = &pb.Student{Name: p.name}
+		}
+		err := pub.Publish(ctx, p.topic, msg, PushRetain(p.retain))
+		if c := status.Code(err); c != p.wantCode {
+			t.Errorf("Publish(%s, %q) code = %v, want %v (%v)", p.topic, p.name, c, p.wantCode, err)
+		}
+	}
+
+	subscribe := func(clientId string) []string {
+		received := make(chan string, 4)
+		sub := topicClient(t, addr, clientId, received)
+		if _, err := sub.Subscribe(ctx, codec.TopicQos{Topic: "status/+", Qos: codec.QosAtLeastOnce}); err != nil {
+			t.Fatalf("Subscribe() error = %v", err)
+		}
+		var got []string
+		for {
+			select {
+			case m := <-received:
+				got = append(got, m)
+			case <-time.After(time.Millisecond * 200):
+				slices.Sort(got)
+				return got
+			}
+		}
+	}
+	want := []string{"status/alice online", "status/bob online"}
+	if got := subscribe("carol"); !slices.Equal(got, want) {
+		t.Errorf("retained messages = %v, want %v", got, want)
+	}
+
+	// A retained message without payload clears the topic.
+	if err := pub.Publish(ctx, "status/bob", nil, PushRetain(true)); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	want = []string{"status/alice online"}
+	if got := subscribe("dave"); !slices.Equal(got, want) {
+		t.Errorf("retained messages after clearing = %v, want %v", got, want)
+	}
+}
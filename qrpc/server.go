@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"maps"
 	"math"
 	"reflect"
 	"strings"
@@ -11,10 +12,13 @@ import (
 	"time"
 
 	"github.com/quic-go/quic-go"
+	"github.com/stonefire-oss/stonefire-im/pkg/broker"
 	"github.com/stonefire-oss/stonefire-im/pkg/codec"
+	"github.com/stonefire-oss/stonefire-im/pkg/store"
 	"github.com/stonefire-oss/stonefire-im/pkg/utils"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/mem"
+	"google.golang.org/grpc/status"
 )
 
 const (
@@ -22,6 +26,11 @@ const (
 	defaultServerMaxSendMessageSize    = math.MaxInt32
 	defaultMaxConcurrentStreams        = 100
 	defaultMaxConnectionIdle           = time.Second * 3
+	defaultFirstFrameTimeout           = time.Second * 3
+
+	// gracefulStopLinger is how long GracefulStop lets a client hang up by
+	// itself once its calls are over.
+	gracefulStopLinger = time.Second
 )
 
 type ServerOption interface {
@@ -34,10 +43,383 @@ type serverOptions struct {
 	numServerWorkers      uint32
 	maxConnectionIdle     time.Duration
 	maxConcurrentStreams  uint32
+	firstFrameTimeout     time.Duration
+	pushWindowSize        int
+	pushRetryInterval     time.Duration
+	sessionExpiry         time.Duration
+	dedupCacheSize        int
+	loginPolicy           LoginPolicy
+	broker                bool
+	retainedMessages      int
+	maxRetainedSize       int
+	shareStrategy         ShareStrategy
+	topicAccess           func(ctx context.Context, topic string, action TopicAction) error
+	offline               store.MessageStore
+	conversations         store.MessageStore
+	conversationAccess    func(ctx context.Context, conv string) error
+	presence              bool
+	presenceAwayTimeout   time.Duration
+	presenceDebounce      time.Duration
+	presenceAccess        func(ctx context.Context, clientId string) error
+	receipts              bool
+	receiptInterval       time.Duration
+	onDatagram            DatagramHandler
+	datagramRate          float64
+	datagramBurst         int
+
+	unaryInt        grpc.UnaryServerInterceptor
+	streamInt       grpc.StreamServerInterceptor
+	chainUnaryInts  []grpc.UnaryServerInterceptor
+	chainStreamInts []grpc.StreamServerInterceptor
+	auth            Authenticator
 
 	bufferPool mem.BufferPool
 }
 
+type funcServerOption struct {
+	f func(*serverOptions)
+}
+
+func (fdo *funcServerOption) apply(do *serverOptions) {
+	fdo.f(do)
+}
+
+func newFuncServerOption(f func(*serverOptions)) *funcServerOption {
+	return &funcServerOption{f: f}
+}
+
+// UnaryInterceptor returns a ServerOption that sets the UnaryServerInterceptor
+// for the server. Only one unary interceptor can be installed. The
+// construction of multiple interceptors (e.g., chaining) can be implemented
+// at the caller.
+//
+// The calls served by the server itself, SyncConversation, MarkRead and the
+// history calls, go through the unary interceptors too, with a nil request.
+// The topic publishes do not, see TopicAccess.
+func UnaryInterceptor(i grpc.UnaryServerInterceptor) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		if o.unaryInt != nil {
+			panic("The unary server interceptor was already set and may not be reset.")
+		}
+		o.unaryInt = i
+	})
+}
+
+// ChainUnaryInterceptor returns a ServerOption that specifies the chained
+// interceptor for unary RPCs. The first interceptor will be the outer most,
+// while the last interceptor will be the inner most wrapper around the real
+// call. All unary interceptors added by this method will be chained.
+func ChainUnaryInterceptor(interceptors ...grpc.UnaryServerInterceptor) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.chainUnaryInts = append(o.chainUnaryInts, interceptors...)
+	})
+}
+
+// StreamInterceptor returns a ServerOption that sets the StreamServerInterceptor
+// for the server. Only one stream interceptor can be installed. WatchPresence,
+// served by the server itself, goes through the stream interceptors too, with
+// a nil srv.
+func StreamInterceptor(i grpc.StreamServerInterceptor) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		if o.streamInt != nil {
+			panic("The stream server interceptor was already set and may not be reset.")
+		}
+		o.streamInt = i
+	})
+}
+
+// ChainStreamInterceptor returns a ServerOption that specifies the chained
+// interceptor for streaming RPCs. The first interceptor will be the outer most,
+// while the last interceptor will be the inner most wrapper around the real
+// call. All stream interceptors added by this method will be chained.
+func ChainStreamInterceptor(interceptors ...grpc.StreamServerInterceptor) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.chainStreamInts = append(o.chainStreamInts, interceptors...)
+	})
+}
+
+// Auth returns a ServerOption that sets the Authenticator validating the
+// Connect of every connection. Without one every client is accepted.
+func Auth(a Authenticator) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.auth = a
+	})
+}
+
+// MaxRecvMsgSize returns a ServerOption to set the max message size in bytes
+// the server can receive. If this is not set, qrpc uses the default 4MB. A
+// compressed message is checked both on the wire and once decompressed.
+func MaxRecvMsgSize(m int) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.maxReceiveMessageSize = m
+	})
+}
+
+// MaxSendMsgSize returns a ServerOption to set the max message size in bytes
+// the server can send. If this is not set, qrpc uses the default
+// `math.MaxInt32`.
+func MaxSendMsgSize(m int) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.maxSendMessageSize = m
+	})
+}
+
+// NumStreamWorkers returns a ServerOption that sets the number of worker
+// goroutines that should be used to process incoming streams. Setting this
+// to zero (default) will disable workers and spawn a new goroutine for each
+// stream. When all workers are busy new streams are refused with
+// ResourceExhausted.
+func NumStreamWorkers(numServerWorkers uint32) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.numServerWorkers = numServerWorkers
+	})
+}
+
+// MaxConcurrentStreams returns a ServerOption that will apply a limit on the
+// number of concurrent streams handled for each qrpc connection.
+func MaxConcurrentStreams(n uint32) ServerOption {
+	if n == 0 {
+		n = math.MaxUint32
+	}
+	return newFuncServerOption(func(o *serverOptions) {
+		o.maxConcurrentStreams = n
+	})
+}
+
+// ConnectionIdle returns a ServerOption that sets the duration after which a
+// connection without any Ping or Publish is closed with SessionTimeoutErr.
+func ConnectionIdle(d time.Duration) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.maxConnectionIdle = d
+	})
+}
+
+// FirstFrameTimeout returns a ServerOption that sets how long the server waits
+// for the first frame of a stream. A stream whose first frame is not read in
+// time is reset, the connection and its other streams are not affected.
+func FirstFrameTimeout(d time.Duration) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.firstFrameTimeout = d
+	})
+}
+
+// PushWindowSize returns a ServerOption that sets how many pushes to a client
+// may wait for their PubAck at once. Further pushes wait for a slot.
+func PushWindowSize(n int) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.pushWindowSize = n
+	})
+}
+
+// PushRetryInterval returns a ServerOption that sets how long the server
+// waits for the PubAck of a push before sending it again with DupFlag set.
+func PushRetryInterval(d time.Duration) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.pushRetryInterval = d
+	})
+}
+
+// SessionExpiry returns a ServerOption that sets how long the session of a
+// client which connected without CleanSession outlives its connection. The
+// QoS 1 pushes it did not acknowledge are sent again if it connects back in
+// time, and fail with Unavailable otherwise. Zero ends sessions with their
+// connection.
+func SessionExpiry(d time.Duration) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.sessionExpiry = d
+	})
+}
+
+// DedupCacheSize returns a ServerOption that sets how many unary calls the
+// server remembers the reply of, so that a retry of one of them with DupFlag
+// set is answered with that reply instead of being processed again. The
+// replies are kept along with their payloads. Deduplication is off by
+// default, and when n is zero. Streaming calls are never deduplicated.
+func DedupCacheSize(n int) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.dedupCacheSize = n
+	})
+}
+
+// DuplicateLogin returns a ServerOption that sets what happens when a client
+// connects with the ClientId of a connected one. The default is KickOld.
+func DuplicateLogin(p LoginPolicy) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.loginPolicy = p
+	})
+}
+
+// EnableBroker returns a ServerOption that turns on the topic broker: clients
+// may subscribe to topic filters, and the Publish frames whose Path is a topic
+// rather than a method path, which starts with '/', are routed to the
+// sessions subscribed to them. See the broker package for the topic syntax.
+func EnableBroker(on bool) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.broker = on
+	})
+}
+
+// RetainedMessages returns a ServerOption that sets how many topics the
+// broker keeps a retained message for. A retained Publish on another topic is
+// refused with ResourceExhausted once the limit is reached. Zero disables
+// retained messages.
+func RetainedMessages(n int) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.retainedMessages = n
+	})
+}
+
+// MaxRetainedSize returns a ServerOption that sets the largest payload, in
+// bytes, of a message the broker retains. A larger retained Publish is
+// refused with ResourceExhausted.
+func MaxRetainedSize(n int) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.maxRetainedSize = n
+	})
+}
+
+// TopicAccess returns a ServerOption that sets the function deciding whether
+// the client of a call may publish on a topic or subscribe to a topic filter,
+// see TopicAction. It is given the context of the connection and the topic
+// or the filter as sent, $share prefix included. A refused Publish fails
+// with the error of the function, a refused filter is granted QosFailure,
+// and a will on a refused topic fails the Connect. Without one every topic
+// is open to every client.
+func TopicAccess(f func(ctx context.Context, topic string, action TopicAction) error) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.topicAccess = f
+	})
+}
+
+// SharedSubscriptionStrategy returns a ServerOption that sets how the broker
+// picks the member of a shared subscription group which gets a message. The
+// default is ShareRoundRobin.
+func SharedSubscriptionStrategy(st ShareStrategy) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.shareStrategy = st
+	})
+}
+
+// OfflineStore returns a ServerOption that sets the store keeping the pushes
+// to the clients which are not connected, delivered to them once they
+// connect. Without one such pushes fail with Unavailable. The store is not
+// closed by the server.
+func OfflineStore(st store.MessageStore) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.offline = st
+	})
+}
+
+// ConversationStore returns a ServerOption that sets the store keeping the
+// messages of the conversations, which numbers them, see PushConversation.
+// The messages are never acknowledged: a conversation reaching the quota of
+// the store has its oldest messages dropped to make room for the new ones,
+// and the messages are dropped once the TTL of the store passed. A store
+// created with store.MaxMessages(0), store.MaxBytes(0) and store.TTL(0)
+// keeps them all. A store.HistoryStore also serves the history of the
+// conversations, see ClientConn.History. The store is not closed by the
+// server.
+func ConversationStore(st store.MessageStore) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.conversations = st
+	})
+}
+
+// ConversationAccess returns a ServerOption that sets the function deciding
+// whether the client of a call may sync a conversation, see
+// SyncConversation, or read its history, see ClientConn.History. It is given
+// the context of the call, and its error is returned to the client. Without
+// one no conversation can be synced.
+func ConversationAccess(f func(ctx context.Context, conv string) error) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.conversationAccess = f
+	})
+}
+
+// EnablePresence returns a ServerOption that turns on the tracking of the
+// presence of the clients, see Server.Presence and WatchPresence.
+func EnablePresence(on bool) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.presence = on
+	})
+}
+
+// PresenceAwayTimeout returns a ServerOption that sets how long a connected
+// client may go without making a call, publishing or subscribing before it is
+// away. Zero keeps the connected clients online. The default is 5 minutes.
+func PresenceAwayTimeout(d time.Duration) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.presenceAwayTimeout = d
+	})
+}
+
+// PresenceDebounce returns a ServerOption that sets how long a client stays
+// online once its last connection closed, in case it connects again. Zero
+// makes it offline right away. The default is 10 seconds.
+func PresenceDebounce(d time.Duration) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.presenceDebounce = d
+	})
+}
+
+// PresenceAccess returns a ServerOption that sets the function deciding
+// whether the client of a call may watch the presence of clientId, see
+// WatchPresence. It is given the context of the call, and its error is
+// returned to the client. Without one no presence can be watched.
+func PresenceAccess(f func(ctx context.Context, clientId string) error) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.presenceAccess = f
+	})
+}
+
+// EnableReceipts returns a ServerOption that turns on the delivered and read
+// receipts of the messages of conversations, see PushSender and MarkRead.
+func EnableReceipts(on bool) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.receipts = on
+	})
+}
+
+// ReceiptInterval returns a ServerOption that sets how long the receipts for
+// a client are gathered before they are pushed together. The default is
+// 200ms.
+func ReceiptInterval(d time.Duration) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.receiptInterval = d
+	})
+}
+
+// HandleDatagrams returns a ServerOption that sets the handler of the
+// messages the clients send in datagrams, see ClientConn.SendDatagram.
+// Without one the server does not read them.
+func HandleDatagrams(h DatagramHandler) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.onDatagram = h
+	})
+}
+
+// DatagramRateLimit returns a ServerOption that sets how many datagrams per
+// second a connection may send on average, with bursts of up to burst
+// datagrams. The datagrams over the limit are dropped. The default is 20 per
+// second with bursts of 40.
+func DatagramRateLimit(rate float64, burst int) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.datagramRate = rate
+		o.datagramBurst = burst
+	})
+}
+
+// BufferPool returns a ServerOption that configures the server to use the
+// provided buffer pool for the payloads of received frames.
+func BufferPool(bufferPool mem.BufferPool) ServerOption {
+	return newFuncServerOption(func(o *serverOptions) {
+		o.bufferPool = bufferPool
+	})
+}
+
+// streamHandler serves the call opened by req on stream. It takes over the
+// slot of the stream in the stream quota of its connection and releases it
+// once done.
 type streamHandler func(ctx context.Context, req *codec.Publish, stream quic.Stream)
 
 // serviceInfo wraps information about a service. It is very similar to
@@ -65,7 +447,38 @@ type Server struct {
 	ctx       context.Context
 	cancelFun context.CancelFunc
 
+	// offlineMu orders the messages stored for the clients with the end of
+	// the delivery of their backlogs, it is taken before mu.
+	offlineMu sync.Mutex
+	// convLocks serializes the appends to each conversation.
+	convLocks convLocks
+
 	services map[string]*serviceInfo
+	lis      map[*quic.Listener]bool
+	conns    map[*qrpcConn]bool
+	// clients maps every ClientId to its connections, by device id.
+	clients map[string]map[string]*qrpcConn
+	// sessions holds the sessions of the connected clients, and of the
+	// disconnected ones until they expire.
+	sessions map[sessionKey]*session
+	dedup    *dedupCache
+	// topics holds the subscriptions of the sessions, nil without the
+	// broker.
+	topics   *broker.Trie[sessionKey]
+	retained *retainStore
+	// shares holds the shared subscription groups, found by the topics of
+	// the messages through sharedTopics.
+	shares       map[shareKey]*shareGroup
+	sharedTopics *broker.Trie[shareKey]
+	// backlogs holds the ClientIds whose offline messages are being
+	// delivered, the messages to them are stored meanwhile.
+	backlogs map[string]bool
+	// groups maps every group to the ClientIds of its members.
+	groups map[string]map[string]bool
+	// presence is nil unless presence is enabled.
+	presence *presenceTracker
+	// receipts is nil unless receipts are enabled.
+	receipts *receiptQueue
 
 	serverWorkerChannel      chan func()
 	serverWorkerChannelClose func()
@@ -99,6 +512,17 @@ var defaultServerOptions = serverOptions{
 	maxSendMessageSize:    defaultServerMaxSendMessageSize,
 	maxConcurrentStreams:  defaultMaxConcurrentStreams,
 	maxConnectionIdle:     defaultMaxConnectionIdle,
+	firstFrameTimeout:     defaultFirstFrameTimeout,
+	pushWindowSize:        defaultPushWindowSize,
+	pushRetryInterval:     defaultPushRetryInterval,
+	sessionExpiry:         defaultSessionExpiry,
+	retainedMessages:      defaultRetainedMessages,
+	maxRetainedSize:       defaultMaxRetainedSize,
+	presenceAwayTimeout:   defaultPresenceAwayTimeout,
+	presenceDebounce:      defaultPresenceDebounce,
+	receiptInterval:       defaultReceiptInterval,
+	datagramRate:          defaultDatagramRate,
+	datagramBurst:         defaultDatagramBurst,
 	bufferPool:            mem.DefaultBufferPool(),
 }
 
@@ -113,7 +537,30 @@ func NewServer(opt ...ServerOption) *Server {
 		done: utils.NewEvent(),
 
 		services: make(map[string]*serviceInfo),
+		lis:      make(map[*quic.Listener]bool),
+		conns:    make(map[*qrpcConn]bool),
+		clients:  make(map[string]map[string]*qrpcConn),
+		sessions: make(map[sessionKey]*session),
+		backlogs: make(map[string]bool),
+		groups:   make(map[string]map[string]bool),
+	}
+	if opts.broker {
+		s.topics = broker.NewTrie[sessionKey]()
+		s.retained = newRetainStore(opts.retainedMessages, opts.maxRetainedSize)
+		s.shares = make(map[shareKey]*shareGroup)
+		s.sharedTopics = broker.NewTrie[shareKey]()
+	}
+	if opts.presence {
+		s.presence = newPresenceTracker(opts.presenceAwayTimeout, opts.presenceDebounce)
 	}
+	if opts.receipts {
+		s.receipts = newReceiptQueue(opts.receiptInterval, s.sendReceipts)
+	}
+	if opts.dedupCacheSize > 0 {
+		s.dedup = newDedupCache(opts.dedupCacheSize)
+	}
+	chainUnaryServerInterceptors(s)
+	chainStreamServerInterceptors(s)
 	s.cv = sync.NewCond(&s.mu)
 	if s.opts.numServerWorkers > 0 {
 		s.initServerWorkers()
@@ -122,6 +569,78 @@ func NewServer(opt ...ServerOption) *Server {
 	return s
 }
 
+// chainUnaryServerInterceptors chains all unary server interceptors into one.
+func chainUnaryServerInterceptors(s *Server) {
+	// Prepend opts.unaryInt to the chaining interceptors if it exists, since
+	// unaryInt will be executed before any other chained interceptors.
+	interceptors := s.opts.chainUnaryInts
+	if s.opts.unaryInt != nil {
+		interceptors = append([]grpc.UnaryServerInterceptor{s.opts.unaryInt}, s.opts.chainUnaryInts...)
+	}
+
+	var chainedInt grpc.UnaryServerInterceptor
+	if len(interceptors) == 0 {
+		chainedInt = nil
+	} else if len(interceptors) == 1 {
+		chainedInt = interceptors[0]
+	} else {
+		chainedInt = chainUnaryInterceptors(interceptors)
+	}
+
+	s.opts.unaryInt = chainedInt
+}
+
+func chainUnaryInterceptors(interceptors []grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		return interceptors[0](ctx, req, info, getChainUnaryHandler(interceptors, 0, info, handler))
+	}
+}
+
+func getChainUnaryHandler(interceptors []grpc.UnaryServerInterceptor, curr int, info *grpc.UnaryServerInfo, finalHandler grpc.UnaryHandler) grpc.UnaryHandler {
+	if curr == len(interceptors)-1 {
+		return finalHandler
+	}
+	return func(ctx context.Context, req any) (any, error) {
+		return interceptors[curr+1](ctx, req, info, getChainUnaryHandler(interceptors, curr+1, info, finalHandler))
+	}
+}
+
+// chainStreamServerInterceptors chains all stream server interceptors into one.
+func chainStreamServerInterceptors(s *Server) {
+	// Prepend opts.streamInt to the chaining interceptors if it exists, since
+	// streamInt will be executed before any other chained interceptors.
+	interceptors := s.opts.chainStreamInts
+	if s.opts.streamInt != nil {
+		interceptors = append([]grpc.StreamServerInterceptor{s.opts.streamInt}, s.opts.chainStreamInts...)
+	}
+
+	var chainedInt grpc.StreamServerInterceptor
+	if len(interceptors) == 0 {
+		chainedInt = nil
+	} else if len(interceptors) == 1 {
+		chainedInt = interceptors[0]
+	} else {
+		chainedInt = chainStreamInterceptors(interceptors)
+	}
+
+	s.opts.streamInt = chainedInt
+}
+
+func chainStreamInterceptors(interceptors []grpc.StreamServerInterceptor) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return interceptors[0](srv, ss, info, getChainStreamHandler(interceptors, 0, info, handler))
+	}
+}
+
+func getChainStreamHandler(interceptors []grpc.StreamServerInterceptor, curr int, info *grpc.StreamServerInfo, finalHandler grpc.StreamHandler) grpc.StreamHandler {
+	if curr == len(interceptors)-1 {
+		return finalHandler
+	}
+	return func(srv any, stream grpc.ServerStream) error {
+		return interceptors[curr+1](srv, stream, info, getChainStreamHandler(interceptors, curr+1, info, finalHandler))
+	}
+}
+
 func (s *Server) RegisterService(sd *grpc.ServiceDesc, ss any) {
 	if ss != nil {
 		ht := reflect.TypeOf(sd.HandlerType).Elem()
@@ -155,9 +674,28 @@ func (s *Server) register(sd *grpc.ServiceDesc, ss any) {
 	s.services[sd.ServiceName] = info
 }
 
+// Serve accepts connections on ls until the server is stopped. The listener
+// is closed by Stop or GracefulStop, after the connections it carries, since
+// closing a listener created by quic.ListenAddr tears down its connections.
 func (s *Server) Serve(ls *quic.Listener) error {
-	defer func() {
+	s.mu.Lock()
+	if s.lis == nil {
+		s.mu.Unlock()
 		ls.Close()
+		return nil
+	}
+	s.lis[ls] = true
+	s.mu.Unlock()
+
+	s.serveWG.Add(1)
+	defer func() {
+		if !s.quit.HasFired() {
+			s.mu.Lock()
+			delete(s.lis, ls)
+			s.mu.Unlock()
+			ls.Close()
+		}
+		s.serveWG.Done()
 	}()
 	for {
 		conn, err := ls.Accept(s.ctx)
@@ -194,84 +732,435 @@ func (s *Server) Serve(ls *quic.Listener) error {
 	}
 }
 
-func (s *Server) stop() {
-	s.quit.Fire()
+// Stop stops the server. It stops accepting connections, sends a Disconnect
+// to every connection and closes them with ServiceUnavailableErr without
+// waiting for the pending RPCs.
+func (s *Server) Stop() {
+	s.fireQuit()
+	s.cancelFun()
+
+	conns := s.drainConns()
+	for c := range conns {
+		c.closeWithReason(ServiceUnavailableErr)
+	}
+	s.serveWG.Wait()
+	s.closeListeners()
+	s.closeWorkers()
+}
+
+// GracefulStop stops the server gracefully. It stops accepting connections
+// and new streams and sends a Disconnect to every connection, so clients can
+// move to another server, then waits for the pending RPCs to finish, or for
+// ctx to be done, before closing the remaining connections with
+// ServiceUnavailableErr. The clients are given up to a second to hang up
+// once the RPCs are over. It returns ctx.Err() if the connections had to be
+// cut short.
+func (s *Server) GracefulStop(ctx context.Context) error {
+	s.fireQuit()
 	s.cancelFun()
+
+	conns := s.drainConns()
+	finished := make(chan struct{})
+	go func() {
+		s.handlersWG.Wait()
+		// The replies may still be in flight when the handlers return, the
+		// clients hang up once they got them, or are cut off after the
+		// linger.
+		var wg sync.WaitGroup
+		for c := range conns {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				t := time.NewTimer(gracefulStopLinger)
+				defer t.Stop()
+				select {
+				case <-c.conn.Context().Done():
+				case <-t.C:
+				}
+			}()
+		}
+		wg.Wait()
+		close(finished)
+	}()
+
+	var err error
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	for c := range conns {
+		c.closeWithReason(ServiceUnavailableErr)
+	}
+	s.serveWG.Wait()
+	s.closeListeners()
+	s.closeWorkers()
+	return err
+}
+
+func (s *Server) closeListeners() {
+	s.mu.Lock()
+	lis := s.lis
+	s.lis = nil
+	s.mu.Unlock()
+
+	for ls := range lis {
+		ls.Close()
+	}
+}
+
+// drainConns sends a Disconnect to every live connection and hands them over
+// to the caller. Connections established afterwards are refused.
+func (s *Server) drainConns() map[*qrpcConn]bool {
+	s.mu.Lock()
+	conns := s.conns
+	s.conns = nil
+	s.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for c := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.disconnect(DisconnectServerShutdown)
+		}()
+	}
+	wg.Wait()
+	return conns
+}
+
+// fireQuit fires the quit event under the lock of the server, no handler is
+// started once it returns, see startHandler.
+func (s *Server) fireQuit() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.quit.Fire()
+}
+
+// startHandler counts a handler about to run, unless the server is
+// stopping. The check and the count are made under the lock of the server
+// so that GracefulStop waits for every handler it let start.
+func (s *Server) startHandler() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.quit.HasFired() {
+		return false
+	}
+	s.handlersWG.Add(1)
+	return true
+}
+
+func (s *Server) closeWorkers() {
+	if s.serverWorkerChannelClose != nil {
+		s.serverWorkerChannelClose()
+	}
+	s.done.Fire()
+}
+
+func (s *Server) addConn(c *qrpcConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns == nil {
+		return false
+	}
+	s.conns[c] = true
+	return true
+}
+
+func (s *Server) removeConn(c *qrpcConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, c)
 }
 
 func (s *Server) handleStream(ctx context.Context, req *codec.Publish, stream quic.Stream) {
+	ctx, cancel := newStreamContext(ctx, req, stream)
+	defer cancel()
+	fw := newFrameWriter(stream, s.opts.bufferPool)
+
+	if s.topics != nil && !strings.HasPrefix(req.Path, "/") {
+		s.handleTopicPublish(ctx, req, fw)
+		finishStream(stream)
+		return
+	}
+	if h, ok := s.builtinHandler(req.Path); ok {
+		if req.Path == presenceMethod {
+			s.serveBuiltinStream(ctx, req, stream, fw, h)
+		} else {
+			s.serveBuiltin(ctx, req, fw, h)
+		}
+		finishStream(stream)
+		return
+	}
+
 	sm := req.Path
 	if sm != "" && sm[0] == '/' {
 		sm = sm[1:]
 	}
 	pos := strings.LastIndex(sm, "/")
+	if pos == -1 {
+		replyStatus(fw, req, Unimplemented, fmt.Sprintf("malformed method name: %q", req.Path))
+		finishStream(stream)
+		return
+	}
 	service := sm[:pos]
 	method := sm[pos+1:]
 	srv, knownService := s.services[service]
 	if knownService {
 		if md, ok := srv.methods[method]; ok {
-			s.processUnaryRPC(ctx, md, srv, req, stream)
-			stream.Close()
+			s.processUnaryRPC(ctx, md, srv, req, fw)
+			finishStream(stream)
 			return
 		}
 		if sd, ok := srv.streams[method]; ok {
-			s.processStreamingRPC(ctx, sd, srv, req, stream)
+			s.processStreamingRPC(ctx, sd, srv, req, stream, fw)
+			finishStream(stream)
 			return
 		}
 	}
 
+	replyStatus(fw, req, Unimplemented, "")
+	finishStream(stream)
+}
+
+// builtinHandler serves a call answered by the server itself rather than by
+// a registered service. It writes the messages coming before the reply, if
+// any, and returns the Props of the reply.
+type builtinHandler func(ctx context.Context, req *codec.Publish, fw *frameWriter) (codec.Props, error)
+
+// builtinHandler returns the handler of method if the server serves it
+// itself.
+func (s *Server) builtinHandler(method string) (builtinHandler, bool) {
+	switch method {
+	case syncMethod:
+		return s.handleSync, true
+	case presenceMethod:
+		return s.handlePresence, true
+	case markReadMethod:
+		return s.handleMarkRead, true
+	case historyMethod:
+		return s.handleHistory, true
+	case historyDeleteMethod:
+		return s.handleHistoryDelete, true
+	}
+	return nil, false
+}
+
+// serveBuiltin serves req with h through the unary interceptors, like the
+// calls of the services. The interceptors are given a nil request, the
+// arguments of the call are in its Props.
+func (s *Server) serveBuiltin(ctx context.Context, req *codec.Publish, fw *frameWriter, h builtinHandler) error {
+	FreePayload(req)
+	meta := &callMetadata{method: req.Path}
+	ctx = grpc.NewContextWithServerTransportStream(ctx, meta)
+	handler := func(ctx context.Context, _ any) (any, error) {
+		return h(ctx, req, fw)
+	}
+
+	var (
+		reply  any
+		appErr error
+	)
+	if s.opts.unaryInt == nil {
+		reply, appErr = handler(ctx, nil)
+	} else {
+		reply, appErr = s.opts.unaryInt(ctx, nil, &grpc.UnaryServerInfo{FullMethod: req.Path}, handler)
+	}
+
+	ack := meta.finalAck(req, status.Convert(appErr))
+	if props, _ := reply.(codec.Props); appErr == nil && len(props) > 0 {
+		if ack.Props == nil {
+			ack.Props = make(codec.Props, len(props))
+		}
+		maps.Copy(ack.Props, props)
+	}
+	return fw.WriteMessage(ack)
+}
+
+// serveBuiltinStream serves req, a call streaming its replies until it is
+// over, with h through the stream interceptors. The interceptors are given a
+// nil srv.
+func (s *Server) serveBuiltinStream(ctx context.Context, req *codec.Publish, stream quic.Stream, fw *frameWriter, h builtinHandler) error {
+	meta := &callMetadata{method: req.Path}
+	ctx = grpc.NewContextWithServerTransportStream(ctx, meta)
+	sd := &grpc.StreamDesc{ServerStreams: true}
+	ss := newServerStream(ctx, req, stream, fw, qrpcConnFromContext(ctx), sd, meta)
+	defer ss.release()
+	handler := func(_ any, ss grpc.ServerStream) error {
+		_, err := h(ss.Context(), req, fw)
+		return err
+	}
+
+	var appErr error
+	if s.opts.streamInt == nil {
+		appErr = handler(nil, ss)
+	} else {
+		si := &grpc.StreamServerInfo{FullMethod: req.Path, IsServerStream: true}
+		appErr = s.opts.streamInt(nil, ss, si, handler)
+	}
+
+	st := status.Convert(appErr)
+	if err := ctx.Err(); err != nil {
+		st = status.FromContextError(err)
+	}
+	return fw.WriteMessageFunc(func() (codec.Message, error) {
+		return meta.finalAck(req, st), nil
+	})
+}
+
+// replyStatus answers req with a PubAck carrying only a status.
+func replyStatus(fw *frameWriter, req *codec.Publish, c Code, msg string) error {
 	ack := codec.PubAck{
 		Header:    codec.Header{AckRequired: req.AckRequired},
 		MessageId: req.MessageId,
-		Status:    codec.Status{Code: uint8(Unimplemented)},
+		Status:    codec.Status{Code: uint8(c), Message: msg},
+	}
+	return fw.WriteMessage(&ack)
+}
+
+func (s *Server) processStreamingRPC(ctx context.Context, sd *grpc.StreamDesc, info *serviceInfo, req *codec.Publish, stream quic.Stream, fw *frameWriter) error {
+	method := req.Path
+	meta := &callMetadata{method: method}
+	ctx = grpc.NewContextWithServerTransportStream(ctx, meta)
+	ss := newServerStream(ctx, req, stream, fw, qrpcConnFromContext(ctx), sd, meta)
+	defer ss.release()
+	// A handler blocked in RecvMsg returns once the call is over.
+	stop := context.AfterFunc(ctx, func() {
+		stream.CancelRead(quic.StreamErrorCode(Canceled))
+	})
+	defer stop()
+
+	var appErr error
+	if s.opts.streamInt == nil {
+		appErr = sd.Handler(info.serviceImpl, ss)
+	} else {
+		si := &grpc.StreamServerInfo{
+			FullMethod:     method,
+			IsClientStream: sd.ClientStreams,
+			IsServerStream: sd.ServerStreams,
+		}
+		appErr = s.opts.streamInt(info.serviceImpl, ss, si, sd.Handler)
+	}
+
+	st := status.Convert(appErr)
+	if err := ctx.Err(); err != nil {
+		st = status.FromContextError(err)
 	}
+	return fw.WriteMessageFunc(func() (codec.Message, error) {
+		return meta.finalAck(req, st), nil
+	})
+}
 
-	ack.Encode(stream)
-	stream.Close()
+func (s *Server) processUnaryRPC(ctx context.Context, md *grpc.MethodDesc, info *serviceInfo, req *codec.Publish, fw *frameWriter) error {
+	entry, replay := s.dedupUnaryRPC(ctx, req)
+	if replay != nil {
+		FreePayload(req)
+		return fw.WriteMessage(replay)
+	}
+
+	ack, bf := s.runUnaryRPC(ctx, md, info, req)
+	defer freeBuffer(bf)
+	if entry != nil {
+		// A call cut short by its context is run again when retried.
+		if ctx.Err() != nil {
+			s.dedup.finish(entry, nil)
+		} else {
+			s.dedup.finish(entry, ack)
+		}
+	}
+	return fw.WriteMessage(ack)
 }
 
-func (s *Server) processStreamingRPC(ctx context.Context, sd *grpc.StreamDesc, info *serviceInfo, req *codec.Publish, stream quic.Stream) error {
-	ss := newServerStream(ctx, req, stream, qrpcConnFromContext(ctx), sd)
-	return sd.Handler(info.serviceImpl, ss)
+// dedupUnaryRPC looks req up in the dedup cache. It returns the reply to
+// replay for a retry of a known call, or else the entry recording the reply
+// of req, nil if the call is not deduplicated.
+func (s *Server) dedupUnaryRPC(ctx context.Context, req *codec.Publish) (*dedupEntry, *codec.PubAck) {
+	c := qrpcConnFromContext(ctx)
+	if s.dedup == nil || c == nil || req.MessageId == 0 {
+		return nil, nil
+	}
+	key := dedupKey{session: c.session, messageId: req.MessageId}
+	e, dup := s.dedup.begin(key, req.DupFlag)
+	if !dup {
+		return e, nil
+	}
+
+	// The call may still be running on the stream the client gave up on.
+	select {
+	case <-e.done:
+	case <-ctx.Done():
+		ws, _ := wireStatus(status.FromContextError(ctx.Err()))
+		return nil, &codec.PubAck{
+			Header:    codec.Header{AckRequired: req.AckRequired},
+			MessageId: req.MessageId,
+			Status:    ws,
+		}
+	}
+	if e.ack == nil {
+		e, _ = s.dedup.begin(key, false)
+		return e, nil
+	}
+	return nil, e.ack
 }
 
-func (s *Server) processUnaryRPC(ctx context.Context, md *grpc.MethodDesc, info *serviceInfo, req *codec.Publish, stream quic.Stream) error {
+// runUnaryRPC runs the handler of req and returns the PubAck carrying its
+// outcome, along with the buffer of the reply, which the caller frees once
+// the PubAck was sent.
+func (s *Server) runUnaryRPC(ctx context.Context, md *grpc.MethodDesc, info *serviceInfo, req *codec.Publish) (*codec.PubAck, mem.Buffer) {
+	meta := &callMetadata{method: req.Path}
+	ctx = grpc.NewContextWithServerTransportStream(ctx, meta)
+	// The request is freed once decoded, or once the handler returns if it
+	// never decoded it, rejected by an interceptor for instance.
+	var freeReq sync.Once
 	df := func(v any) error {
-		defer FreePayload(req)
-		return DecodePayload(v, req.Payload, req.Compressed)
+		defer freeReq.Do(func() { FreePayload(req) })
+		return decodePayload(v, req.Payload, req.Compressed, s.opts.maxReceiveMessageSize)
+	}
+	reply, appErr := md.Handler(info.serviceImpl, ctx, df, s.opts.unaryInt)
+	freeReq.Do(func() { FreePayload(req) })
+	if err := ctx.Err(); err != nil {
+		// The reply is late or unwanted, whatever the handler returned.
+		return meta.finalAck(req, status.FromContextError(err)), nil
 	}
-	reply, appErr := md.Handler(info.serviceImpl, ctx, df, nil)
 	if appErr != nil {
-		return appErr
+		// Errors which are not gRPC status errors become Unknown.
+		return meta.finalAck(req, status.Convert(appErr)), nil
 	}
 
 	bf, err := EncodePayload(reply, req.Compressed)
-
 	if err != nil {
-		return err
+		return meta.finalAck(req, status.Newf(Internal, "qrpc: error while marshaling: %v", err)), nil
 	}
-
-	defer func() {
+	if bf != nil && bf.Len() > s.opts.maxSendMessageSize {
+		st := status.Newf(ResourceExhausted, "qrpc: trying to send message larger than max (%d vs. %d)", bf.Len(), s.opts.maxSendMessageSize)
 		bf.Free()
-	}()
-
-	ack := codec.PubAck{
-		Header:    codec.Header{AckRequired: req.AckRequired, Compressed: req.Compressed},
-		MessageId: req.MessageId,
-		Payload:   bf,
+		return meta.finalAck(req, st), nil
 	}
 
-	return ack.Encode(stream)
+	ack := meta.finalAck(req, status.New(OK, ""))
+	ack.Compressed = req.Compressed
+	ack.Payload = bf
+	return ack, bf
 }
 
 func (s *Server) handleRawConn(conn quic.Connection) {
-	s.serveWG.Add(1)
-	streamQuota := utils.NewHandlerQuota(s.opts.maxConcurrentStreams)
+	qcon := newQRPConn(conn, s)
+	streamQuota := qcon.streamQuota
 	handler := func(ctx context.Context, req *codec.Publish, stream quic.Stream) {
-		streamQuota.Acquire()
+		if !s.startHandler() {
+			streamQuota.Release()
+			FreePayload(req)
+			replyStatus(newFrameWriter(stream, s.opts.bufferPool), req, Unavailable, "qrpc: the server is stopping")
+			finishStream(stream)
+			return
+		}
 
 		f := func() {
-			defer streamQuota.Release()
+			defer func() {
+				streamQuota.Release()
+				s.handlersWG.Done()
+			}()
 			s.handleStream(ctx, req, stream)
 		}
 		if s.opts.numServerWorkers > 0 {
@@ -279,24 +1168,32 @@ func (s *Server) handleRawConn(conn quic.Connection) {
 			case s.serverWorkerChannel <- f:
 				return
 			default:
-				ack := codec.PubAck{
-					Header:    codec.Header{AckRequired: req.AckRequired},
-					MessageId: req.MessageId,
-					Status:    codec.Status{Code: uint8(ResourceExhausted)},
-				}
-
-				ack.Encode(stream)
-				stream.Close()
+				streamQuota.Release()
+				s.handlersWG.Done()
+				FreePayload(req)
+				replyStatus(newFrameWriter(stream, s.opts.bufferPool), req, ResourceExhausted, "")
+				finishStream(stream)
 				return
 			}
 		}
-		go f()
+		f()
 	}
 
-	qcon := newQRPConn(conn, s)
-	s.serveWG.Done()
+	if !s.addConn(qcon) {
+		qcon.closeWithReason(ServiceUnavailableErr)
+		return
+	}
+
+	s.serveWG.Add(1)
 	f := func() {
 		qcon.Serve(handler)
+		s.serveWG.Done()
+		<-conn.Context().Done()
+		s.removeConn(qcon)
+		if qcon.connected {
+			s.removeClient(qcon)
+			s.publishWill(qcon)
+		}
 	}
 	go f()
 }
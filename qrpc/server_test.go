@@ -0,0 +1,494 @@
+package qrpc
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/stonefire-oss/stonefire-im/demo/pb"
+	"github.com/stonefire-oss/stonefire-im/pkg/codec"
+	"github.com/stonefire-oss/stonefire-im/pkg/store"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/mem"
+	"google.golang.org/grpc/status"
+)
+
+type callRecorder struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (r *callRecorder) record(s string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, s)
+}
+
+func (r *callRecorder) get() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.calls...)
+}
+
+func (r *callRecorder) unary(name string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		r.record(name + " " + info.FullMethod)
+		return handler(ctx, req)
+	}
+}
+
+func (r *callRecorder) stream(name string) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		r.record(name + " " + info.FullMethod)
+		return handler(srv, ss)
+	}
+}
+
+func TestServer_Interceptors(t *testing.T) {
+	rec := &callRecorder{}
+	_, addr := newTestServer(t,
+		UnaryInterceptor(rec.unary("u0")),
+		ChainUnaryInterceptor(rec.unary("u1"), rec.unary("u2")),
+		StreamInterceptor(rec.stream("s0")),
+		ChainStreamInterceptor(rec.stream("s1")),
+	)
+	client := pb.NewStudentServiceClient(newTestClient(t, addr))
+
+	if _, err := client.CreateStudent(context.Background(), &pb.Student{Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := client.Hello(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Send(&pb.Student{Name: "a"})
+	if _, err := stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	stream.CloseSend()
+	stream.Recv()
+
+	want := []string{
+		"u0 " + pb.StudentService_CreateStudent_FullMethodName,
+		"u1 " + pb.StudentService_CreateStudent_FullMethodName,
+		"u2 " + pb.StudentService_CreateStudent_FullMethodName,
+		"s0 " + pb.StudentService_Hello_FullMethodName,
+		"s1 " + pb.StudentService_Hello_FullMethodName,
+	}
+	if got := rec.get(); !reflect.DeepEqual(got, want) {
+		t.Errorf("interceptor calls = %v, want %v", got, want)
+	}
+}
+
+func TestServer_BuiltinInterceptors(t *testing.T) {
+	rec := &callRecorder{}
+	allow := func(ctx context.Context, _ string) error { return nil }
+	denyMarkRead := func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if info.FullMethod == markReadMethod {
+			return nil, status.Error(codes.PermissionDenied, "denied")
+		}
+		return handler(ctx, req)
+	}
+	s, addr := newTestServer(t,
+		ConversationStore(store.NewMemory()),
+		ConversationAccess(allow),
+		EnableReceipts(true),
+		EnablePresence(true),
+		PresenceAccess(allow),
+		UnaryInterceptor(rec.unary("u")),
+		ChainUnaryInterceptor(denyMarkRead),
+		StreamInterceptor(rec.stream("s")),
+	)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	cc := newTestClient(t, addr, WithClientId("alice"))
+	if _, err := s.PushConversation(ctx, "room", nil, testPushPath, &pb.Student{Name: "a"}); err != nil {
+		t.Fatalf("PushConversation() error = %v", err)
+	}
+
+	if msgs, err := cc.SyncConversation(ctx, "room", 0, 0, 10); err != nil || len(msgs) != 1 {
+		t.Errorf("SyncConversation() = %d messages, %v, want 1", len(msgs), err)
+	}
+	if page, err := cc.History(ctx, "room", HistoryQuery{}); err != nil || len(page.Messages) != 1 {
+		t.Errorf("History() = %v, %v, want 1 message", page, err)
+	}
+	if _, err := cc.MarkRead(ctx, "room", 1); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("MarkRead() error = %v, want %v", err, codes.PermissionDenied)
+	}
+	w, err := cc.WatchPresence(ctx, "bob")
+	if err != nil {
+		t.Fatalf("WatchPresence() error = %v", err)
+	}
+	defer w.Close()
+	if _, err := w.Recv(); err != nil {
+		t.Fatalf("Recv() error = %v", err)
+	}
+
+	want := []string{
+		"u " + syncMethod,
+		"u " + historyMethod,
+		"u " + markReadMethod,
+		"s " + presenceMethod,
+	}
+	if got := rec.get(); !reflect.DeepEqual(got, want) {
+		t.Errorf("interceptor calls = %v, want %v", got, want)
+	}
+}
+
+// countingPool counts the buffers taken from and given back to the default
+// pool.
+type countingPool struct {
+	gets, puts atomic.Int64
+}
+
+func (p *countingPool) Get(n int) *[]byte {
+	p.gets.Add(1)
+	return mem.DefaultBufferPool().Get(n)
+}
+
+func (p *countingPool) Put(b *[]byte) {
+	p.puts.Add(1)
+	mem.DefaultBufferPool().Put(b)
+}
+
+func TestServer_UnaryInterceptorRejects(t *testing.T) {
+	deny := func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		return nil, status.Error(codes.PermissionDenied, "denied")
+	}
+	_, addr := newTestServer(t, UnaryInterceptor(deny))
+	client := pb.NewStudentServiceClient(newTestClient(t, addr))
+
+	_, err := client.CreateStudent(context.Background(), &pb.Student{Name: "a"})
+	if got := status.Code(err); got != codes.PermissionDenied {
+		t.Errorf("CreateStudent() code = %v, want %v", got, codes.PermissionDenied)
+	}
+}
+
+func TestServer_UndecodedRequestFreed(t *testing.T) {
+	pool := &countingPool{}
+	s, addr := newTestServer(t, BufferPool(pool))
+	// A handler which fails without decoding its request.
+	s.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "qrpc.test.Lazy",
+		HandlerType: (*any)(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Fail",
+			Handler: func(srv any, ctx context.Context, dec func(any) error, _ grpc.UnaryServerInterceptor) (any, error) {
+				return nil, status.Error(codes.FailedPrecondition, "not now")
+			},
+		}},
+	}, nil)
+	cc := newTestClient(t, addr)
+
+	// The request is large enough to come from the pool.
+	err := cc.Invoke(context.Background(), "/qrpc.test.Lazy/Fail", &pb.Student{Name: strings.Repeat("a", 4096)}, new(pb.Result))
+	if got := status.Code(err); got != codes.FailedPrecondition {
+		t.Errorf("Invoke() code = %v, want %v", got, codes.FailedPrecondition)
+	}
+	if gets, puts := pool.gets.Load(), pool.puts.Load(); gets == 0 || gets != puts {
+		t.Errorf("pool buffers taken = %d, given back = %d", gets, puts)
+	}
+}
+
+func TestServer_MessageSizeLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []ServerOption
+		req  *pb.Student
+		// copts are the options of the call.
+		copts []grpc.CallOption
+		want  codes.Code
+	}{
+		{
+			name: "within limits",
+			opts: []ServerOption{MaxRecvMsgSize(64), MaxSendMsgSize(64)},
+			req:  &pb.Student{Name: "short"},
+			want: codes.OK,
+		},
+		{
+			name: "request too large",
+			opts: []ServerOption{MaxRecvMsgSize(64)},
+			req:  &pb.Student{Name: strings.Repeat("x", 128)},
+			want: codes.ResourceExhausted,
+		},
+		{
+			name: "reply too large",
+			opts: []ServerOption{MaxSendMsgSize(16)},
+			req:  &pb.Student{Name: strings.Repeat("x", 32)},
+			want: codes.ResourceExhausted,
+		},
+		{
+			// The request fits the limit on the wire but not once inflated.
+			name:  "inflated request too large",
+			opts:  []ServerOption{MaxRecvMsgSize(1024)},
+			req:   &pb.Student{Name: strings.Repeat("x", 1<<20)},
+			copts: []grpc.CallOption{grpc.UseCompressor("gzip")},
+			want:  codes.ResourceExhausted,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, addr := newTestServer(t, tt.opts...)
+			client := pb.NewStudentServiceClient(newTestClient(t, addr))
+
+			_, err := client.CreateStudent(context.Background(), tt.req, tt.copts...)
+			if got := status.Code(err); got != tt.want {
+				t.Errorf("CreateStudent() code = %v, want %v (%v)", got, tt.want, err)
+			}
+			// The connection survives a refused message.
+			if _, err := client.CreateStudent(context.Background(), &pb.Student{}); err != nil {
+				t.Errorf("CreateStudent() after refusal error = %v", err)
+			}
+		})
+	}
+}
+
+func TestServer_GracefulStop(t *testing.T) {
+	tests := []struct {
+		name    string
+		call    time.Duration
+		timeout time.Duration
+		wantErr error
+	}{
+		{name: "handlers finish", call: time.Millisecond * 200, timeout: time.Second * 5},
+		{name: "deadline", call: time.Second * 2, timeout: time.Millisecond * 200, wantErr: context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, addr := newTestServer(t)
+			reasons := make(chan DisconnectReason, 1)
+			cc := newTestClient(t, addr, WithDisconnectHandler(func(r DisconnectReason) {
+				reasons <- r
+			}))
+			client := pb.NewStudentServiceClient(cc)
+
+			callErr := make(chan error, 1)
+			go func() {
+				_, err := client.CreateStudent(context.Background(), &pb.Student{Name: tt.call.String()})
+				callErr <- err
+			}()
+			time.Sleep(time.Millisecond * 50)
+
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+			if err := s.GracefulStop(ctx); err != tt.wantErr {
+				t.Errorf("GracefulStop() error = %v, want %v", err, tt.wantErr)
+			}
+			if r := <-reasons; r != DisconnectServerShutdown {
+				t.Errorf("Disconnect reason = %v, want %v", r, DisconnectServerShutdown)
+			}
+			if err := <-callErr; (err != nil) != (tt.wantErr != nil) {
+				t.Errorf("in-flight call error = %v", err)
+			}
+			_, err := client.CreateStudent(context.Background(), &pb.Student{})
+			if got := status.Code(err); got != codes.Unavailable {
+				t.Errorf("call after GracefulStop code = %v, want %v", got, codes.Unavailable)
+			}
+		})
+	}
+}
+
+func TestServer_GracefulStopDeafClient(t *testing.T) {
+	s, addr := newTestServer(t)
+	// A client which never reads the Disconnect nor hangs up.
+	tlsConf := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{testALPN}}
+	conn, err := quic.DialAddr(context.Background(), addr, tlsConf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseWithError(0, "")
+	newTestClient(t, addr)
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- s.GracefulStop(context.Background())
+	}()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("GracefulStop() error = %v", err)
+		}
+	case <-time.After(gracefulStopLinger * 3):
+		t.Fatal("GracefulStop() waits for a client which does not hang up")
+	}
+	select {
+	case <-conn.Context().Done():
+	case <-time.After(time.Second):
+		t.Error("the connection of the client was not closed")
+	}
+}
+
+func TestServer_DeadlineAndCancellation(t *testing.T) {
+	type result struct {
+		hasDeadline bool
+		err         error
+	}
+	results := make(chan result, 1)
+	block := func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		_, ok := ctx.Deadline()
+		<-ctx.Done()
+		results <- result{hasDeadline: ok, err: ctx.Err()}
+		return nil, ctx.Err()
+	}
+	_, addr := newTestServer(t, UnaryInterceptor(block))
+
+	tests := []struct {
+		name     string
+		call     func(cc *ClientConn) error
+		wantCode codes.Code
+		// want lists the acceptable handler contexts.
+		want []result
+	}{
+		{
+			name: "deadline",
+			call: func(cc *ClientConn) error {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+				defer cancel()
+				_, err := pb.NewStudentServiceClient(cc).CreateStudent(ctx, &pb.Student{})
+				return err
+			},
+			wantCode: codes.DeadlineExceeded,
+			// The client resets the stream once its deadline passed, which
+			// may cancel the handler before the server's timer fires.
+			want: []result{
+				{hasDeadline: true, err: context.DeadlineExceeded},
+				{hasDeadline: true, err: context.Canceled},
+			},
+		},
+		{
+			name: "canceled",
+			call: func(cc *ClientConn) error {
+				ctx, cancel := context.WithCancel(context.Background())
+				time.AfterFunc(time.Millisecond*100, cancel)
+				_, err := pb.NewStudentServiceClient(cc).CreateStudent(ctx, &pb.Student{})
+				return err
+			},
+			wantCode: codes.Canceled,
+			want:     []result{{err: context.Canceled}},
+		},
+		{
+			name: "connection closed",
+			call: func(cc *ClientConn) error {
+				time.AfterFunc(time.Millisecond*100, func() { cc.Close() })
+				_, err := pb.NewStudentServiceClient(cc).CreateStudent(context.Background(), &pb.Student{})
+				return err
+			},
+			wantCode: codes.Unavailable,
+			want:     []result{{err: context.Canceled}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc := newTestClient(t, addr)
+			err := tt.call(cc)
+			if got := status.Code(err); got != tt.wantCode {
+				t.Errorf("call code = %v, want %v (%v)", got, tt.wantCode, err)
+			}
+			select {
+			case got := <-results:
+				if !slices.Contains(tt.want, got) {
+					t.Errorf("handler context = %+v, want %+v", got, tt.want)
+				}
+			case <-time.After(time.Second * 5):
+				t.Fatal("the handler context was not done")
+			}
+		})
+	}
+}
+
+// openStalledStreams opens n streams on cc which send the first byte of a
+// frame and then nothing.
+func openStalledStreams(t testing.TB, cc *ClientConn, n int) []quic.Stream {
+	streams := make([]quic.Stream, 0, n)
+	for i := 0; i < n; i++ {
+		s, err := cc.conn.OpenStreamSync(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Write([]byte{byte(codec.MsgPublish) << 4}); err != nil {
+			t.Fatal(err)
+		}
+		streams = append(streams, s)
+	}
+	return streams
+}
+
+func TestServer_StalledStreams(t *testing.T) {
+	_, addr := newTestServer(t, FirstFrameTimeout(time.Millisecond*300), MaxConcurrentStreams(16))
+	cc := newTestClient(t, addr)
+	client := pb.NewStudentServiceClient(cc)
+
+	stalled := openStalledStreams(t, cc, 8)
+
+	// The stalled streams hold up no other call.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	for i := 0; i < 20; i++ {
+		if _, err := client.CreateStudent(ctx, &pb.Student{Name: "a"}); err != nil {
+			t.Fatalf("CreateStudent() error = %v", err)
+		}
+	}
+
+	// They are reset once their first frame is late.
+	for _, s := range stalled {
+		s.SetReadDeadline(time.Now().Add(time.Second * 2))
+		_, err := s.Read(make([]byte, 1))
+		var se *quic.StreamError
+		if !errors.As(err, &se) || se.ErrorCode != quic.StreamErrorCode(Canceled) {
+			t.Errorf("Read() on stalled stream error = %v, want a reset", err)
+		}
+	}
+}
+
+func TestServer_QuotaWaitEndsWithConn(t *testing.T) {
+	s, addr := newTestServer(t, MaxConcurrentStreams(1))
+	cc := newTestClient(t, addr, WithClientId("alice"))
+	client := pb.NewStudentServiceClient(cc)
+
+	// The first call holds the only stream of the connection, the second
+	// one leaves the server waiting for it.
+	for range 2 {
+		go client.CreateStudent(context.Background(), &pb.Student{Name: "2s"})
+		time.Sleep(time.Millisecond * 50)
+	}
+	cc.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for len(s.clientConns("alice")) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the connection is served until a stream is done")
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+}
+
+func BenchmarkServer_SlowStreams(b *testing.B) {
+	for _, n := range []int{0, 10, 50} {
+		b.Run(fmt.Sprintf("stalled=%d", n), func(b *testing.B) {
+			_, addr := newTestServer(b, FirstFrameTimeout(time.Hour))
+			cc := newTestClient(b, addr)
+			client := pb.NewStudentServiceClient(cc)
+			openStalledStreams(b, cc, n)
+
+			b.ResetTimer()
+			b.RunParallel(func(p *testing.PB) {
+				for p.Next() {
+					if _, err := client.CreateStudent(context.Background(), &pb.Student{Name: "a"}); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
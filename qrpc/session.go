@@ -0,0 +1,127 @@
+package qrpc
+
+import (
+	"context"
+	"time"
+
+	"github.com/stonefire-oss/stonefire-im/pkg/codec"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const defaultSessionExpiry = time.Hour
+
+// session is the state the server keeps for a client across its connections:
+// its subscriptions and the QoS 1 pushes it did not acknowledge yet.
+//
+// A client connecting with CleanSession starts a new session, which ends
+// with its connection. Otherwise the session outlives the connection for the
+// session expiry interval, and a client connecting again within it resumes
+// it: the ConnAck has SessionPresent set and the pending pushes are sent
+// again, in order.
+type session struct {
+	key    sessionKey
+	window *pushWindow
+	// subscriptions maps the topic filters of the session to their QoS,
+	// guarded by the mutex of the server.
+	subscriptions map[string]codec.QosLevel
+	// clean is the CleanSession flag of the last connection.
+	clean bool
+	// expiry ends the session while no connection uses it. gen tells the
+	// successive expiry timers apart.
+	expiry *time.Timer
+	gen    uint64
+}
+
+// openSession attaches c to its session, creating it if needed. It reports
+// whether an existing session was resumed.
+func (s *Server) openSession(c *qrpcConn, clean bool) bool {
+	s.mu.Lock()
+	ss, present := s.sessions[c.session]
+	var ended *session
+	if present {
+		if ss.expiry != nil {
+			ss.expiry.Stop()
+			ss.expiry = nil
+			ss.gen++
+		}
+		if clean {
+			ended, present = ss, false
+			s.dropSubscriptions(ended)
+		}
+	}
+	if !present {
+		ss = &session{
+			key:           c.session,
+			window:        newPushWindow(&s.opts, s.quit),
+			subscriptions: make(map[string]codec.QosLevel),
+		}
+		if s.receipts != nil {
+			clientId := c.session.clientId
+			ss.window.acked = func(props codec.Props) {
+				s.delivered(clientId, props)
+			}
+		}
+		s.sessions[c.session] = ss
+	}
+	ss.clean = clean
+	s.mu.Unlock()
+
+	if ended != nil {
+		ended.window.discard(errSessionEnded)
+	}
+	ss.window.attach(c)
+	if present {
+		s.flushShared(c.session)
+	}
+	return present
+}
+
+// closeSession detaches c from its session once it is closed. A clean
+// session ends right away, others once the expiry interval passed without
+// the client coming back.
+func (s *Server) closeSession(c *qrpcConn) {
+	s.mu.Lock()
+	ss, ok := s.sessions[c.session]
+	if !ok || !ss.window.detach(c) {
+		// The session was taken over by another connection.
+		s.mu.Unlock()
+		return
+	}
+	if ss.clean || s.opts.sessionExpiry <= 0 {
+		delete(s.sessions, c.session)
+		s.dropSubscriptions(ss)
+		s.mu.Unlock()
+		ss.window.discard(errSessionEnded)
+		return
+	}
+	gen := ss.gen
+	ss.expiry = time.AfterFunc(s.opts.sessionExpiry, func() {
+		s.expireSession(ss, gen)
+	})
+	s.mu.Unlock()
+}
+
+func (s *Server) expireSession(ss *session, gen uint64) {
+	s.mu.Lock()
+	if s.sessions[ss.key] != ss || ss.gen != gen {
+		// Resumed meanwhile.
+		s.mu.Unlock()
+		return
+	}
+	delete(s.sessions, ss.key)
+	s.dropSubscriptions(ss)
+	s.mu.Unlock()
+	ss.window.discard(errSessionEnded)
+}
+
+// publish pushes pub to the session of key, see pushWindow.
+func (s *Server) publish(ctx context.Context, key sessionKey, pub *codec.Publish) error {
+	s.mu.Lock()
+	ss, ok := s.sessions[key]
+	s.mu.Unlock()
+	if !ok {
+		return status.Errorf(codes.Unavailable, "qrpc: client %q is not connected", key.clientId)
+	}
+	return ss.window.publish(ctx, pub)
+}
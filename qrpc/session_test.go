@@ -0,0 +1,91 @@
+package qrpc
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stonefire-oss/stonefire-im/demo/pb"
+)
+
+func TestServer_SessionPresent(t *testing.T) {
+	_, addr := newTestServer(t)
+
+	steps := []struct {
+		name  string
+		clean bool
+		want  bool
+	}{
+		{name: "new session", clean: false, want: false},
+		{name: "resumed", clean: false, want: true},
+		{name: "clean start", clean: true, want: false},
+		// A clean session ends with its connection.
+		{name: "after clean session", clean: false, want: false},
+	}
+	for _, st := range steps {
+		cc := newTestClient(t, addr, WithClientId("alice"), WithCleanSession(st.clean))
+		if got := cc.SessionPresent(); got != st.want {
+			t.Errorf("%s: SessionPresent() = %v, want %v", st.name, got, st.want)
+		}
+		cc.Close()
+		// Let the server notice.
+		time.Sleep(time.Millisecond * 100)
+	}
+}
+
+func TestServer_SessionReplay(t *testing.T) {
+	s, addr := newTestServer(t)
+	release := make(chan struct{})
+	defer close(release)
+	received := make(chan struct{}, 3)
+	first := newTestClient(t, addr, WithClientId("alice"), WithCleanSession(false), WithPushHandler(func(ctx context.Context, path string, dec func(any) error) error {
+		received <- struct{}{}
+		<-release
+		return nil
+	}))
+
+	names := []string{"1", "2", "3", "4", "5"}
+	var wg sync.WaitGroup
+	for _, n := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := testPush(s, "alice", n); err != nil {
+				t.Errorf("Push(%s) error = %v", n, err)
+			}
+		}()
+		// The pushes are made in order.
+		time.Sleep(time.Millisecond * 20)
+	}
+	for range names {
+		<-received
+	}
+	first.Close()
+
+	var (
+		mu  sync.Mutex
+		got []string
+	)
+	cc := newTestClient(t, addr, WithClientId("alice"), WithCleanSession(false), WithPushHandler(func(ctx context.Context, path string, dec func(any) error) error {
+		var st pb.Student
+		if err := dec(&st); err != nil {
+			return err
+		}
+		mu.Lock()
+		got = append(got, st.Name)
+		mu.Unlock()
+		return nil
+	}))
+	if !cc.SessionPresent() {
+		t.Error("SessionPresent() = false, want true")
+	}
+
+	wg.Wait()
+	mu.Lock()
+	defer mu.Unlock()
+	if !slices.Equal(got, names) {
+		t.Errorf("replayed %v, want %v", got, names)
+	}
+}
@@ -0,0 +1,188 @@
+package qrpc
+
+import (
+	"slices"
+
+	"github.com/stonefire-oss/stonefire-im/pkg/broker"
+	"github.com/stonefire-oss/stonefire-im/pkg/codec"
+)
+
+// Shared subscriptions spread the messages of a topic filter over the members
+// of a group: a client subscribing to $share/{group}/{filter} joins the group,
+// and each message matching filter is pushed to a single connected member,
+// picked by the ShareStrategy of the server. A QoS 1 message which the member
+// does not acknowledge before leaving is pushed to another one. While no
+// member is connected the group keeps up to shareQueueSize QoS 1 messages,
+// pushed once a member connects, the later ones are dropped. Retained
+// messages are not sent to shared subscriptions.
+
+// shareQueueSize bounds the messages a group keeps while no member is
+// connected.
+const shareQueueSize = 1024
+
+// ShareStrategy decides which member of a shared subscription group gets a
+// message.
+type ShareStrategy uint8
+
+const (
+	// ShareRoundRobin hands the messages to the members in turn.
+	ShareRoundRobin ShareStrategy = iota
+	// ShareLeastInflight hands a message to the member with the fewest
+	// pushes not acknowledged yet.
+	ShareLeastInflight
+)
+
+func (st ShareStrategy) String() string {
+	switch st {
+	case ShareRoundRobin:
+		return "round robin"
+	case ShareLeastInflight:
+		return "least inflight"
+	default:
+		return "unknown strategy"
+	}
+}
+
+// shareKey identifies a shared subscription group. Groups of the same name
+// with different filters are distinct.
+type shareKey struct {
+	group, filter string
+}
+
+// shareGroup is a shared subscription group, guarded by the mutex of the
+// server.
+type shareGroup struct {
+	members []sessionKey
+	qos     map[sessionKey]codec.QosLevel
+	// next is where the search for a member starts.
+	next int
+	// parked holds the QoS 1 messages which found no connected member, in
+	// the order they were published.
+	parked []*codec.Publish
+}
+
+// joinShare adds the session of key to the group of filter. s.mu must be
+// held.
+func (s *Server) joinShare(key sessionKey, group, filter string, qos codec.QosLevel) error {
+	sk := shareKey{group: group, filter: filter}
+	g, ok := s.shares[sk]
+	if !ok {
+		if err := s.sharedTopics.Subscribe(filter, sk, codec.QosAtLeastOnce); err != nil {
+			return err
+		}
+		g = &shareGroup{qos: make(map[sessionKey]codec.QosLevel)}
+		s.shares[sk] = g
+	}
+	if _, ok := g.qos[key]; !ok {
+		g.members = append(g.members, key)
+	}
+	g.qos[key] = qos
+	return nil
+}
+
+// leaveShare removes the session of key from the group of filter, and the
+// group once empty. s.mu must be held.
+func (s *Server) leaveShare(key sessionKey, group, filter string) {
+	sk := shareKey{group: group, filter: filter}
+	g, ok := s.shares[sk]
+	if !ok {
+		return
+	}
+	if _, ok := g.qos[key]; !ok {
+		return
+	}
+	delete(g.qos, key)
+	g.members = slices.DeleteFunc(g.members, func(k sessionKey) bool { return k == key })
+	if len(g.members) == 0 {
+		delete(s.shares, sk)
+		s.sharedTopics.Unsubscribe(filter, sk)
+	}
+}
+
+// pickMember returns a connected member of the group of sk and the QoS of
+// its subscription. It reports false if there is none, msg is then kept in
+// the group if it is at least once and the group has room for it.
+func (s *Server) pickMember(sk shareKey, msg *codec.Publish, qos codec.QosLevel) (ss *session, subQos codec.QosLevel, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, found := s.shares[sk]
+	if !found {
+		return nil, 0, false
+	}
+
+	n := len(g.members)
+	best := -1
+	var bestInflight int
+	for i := 0; i < n; i++ {
+		idx := (g.next + i) % n
+		m, found := s.sessions[g.members[idx]]
+		if !found || m.window.attached() == nil {
+			continue
+		}
+		if s.opts.shareStrategy == ShareRoundRobin {
+			best = idx
+			break
+		}
+		if inflight := m.window.inflight(); best < 0 || inflight < bestInflight {
+			best, bestInflight = idx, inflight
+		}
+	}
+	if best < 0 {
+		if qos == codec.QosAtLeastOnce && len(g.parked) < shareQueueSize {
+			g.parked = append(g.parked, msg)
+		}
+		return nil, 0, false
+	}
+	g.next = best + 1
+	key := g.members[best]
+	return s.sessions[key], g.qos[key], true
+}
+
+// deliverShared pushes msg to one member of the group of sk. A QoS 1 message
+// is kept in the group while no member is connected, and goes to another
+// member if the one it was pushed to leaves before acknowledging it.
+func (s *Server) deliverShared(sk shareKey, msg *codec.Publish, qos codec.QosLevel) {
+	ss, subQos, ok := s.pickMember(sk, msg, qos)
+	if !ok {
+		return
+	}
+	if min(qos, subQos) == codec.QosAtMostOnce {
+		ss.window.post(msg, codec.QosAtMostOnce)
+		return
+	}
+	go func() {
+		err := ss.window.publishShared(s.ctx, msg)
+		if err == errMemberLeft || err == errSessionEnded {
+			s.deliverShared(sk, msg, qos)
+		}
+	}()
+}
+
+// flushShared delivers the messages kept by the groups the session of key is
+// a member of, once it is connected or joined a group.
+func (s *Server) flushShared(key sessionKey) {
+	type parked struct {
+		sk  shareKey
+		msg *codec.Publish
+	}
+	var msgs []parked
+	s.mu.Lock()
+	if ss, ok := s.sessions[key]; ok && s.shares != nil {
+		for filter := range ss.subscriptions {
+			group, f := broker.SplitShared(filter)
+			g, ok := s.shares[shareKey{group: group, filter: f}]
+			if group == "" || !ok {
+				continue
+			}
+			for _, msg := range g.parked {
+				msgs = append(msgs, parked{sk: shareKey{group: group, filter: f}, msg: msg})
+			}
+			g.parked = nil
+		}
+	}
+	s.mu.Unlock()
+
+	for _, p := range msgs {
+		s.deliverShared(p.sk, p.msg, codec.QosAtLeastOnce)
+	}
+}
@@ -0,0 +1,161 @@
+package qrpc
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stonefire-oss/stonefire-im/demo/pb"
+	"github.com/stonefire-oss/stonefire-im/pkg/codec"
+)
+
+// countReceived counts the messages received by each client until none
+// arrives for a while.
+func countReceived(received <-chan string) map[string]int {
+	got := make(map[string]int)
+	for {
+		select {
+		case name := <-received:
+			got[name]++
+		case <-time.After(time.Millisecond * 200):
+			return got
+		}
+	}
+}
+
+func TestServer_SharedSubscription(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy ShareStrategy
+		want     map[string]int
+	}{
+		{name: "round robin", strategy: ShareRoundRobin, want: map[string]int{"w0": 2, "w1": 1, "w2": 1}},
+		// The busy worker is skipped.
+		{name: "least inflight", strategy: ShareLeastInflight, want: map[string]int{"w0": 1, "w1": 2, "w2": 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, addr := newTestServer(t, EnableBroker(true), SharedSubscriptionStrategy(tt.strategy))
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+			defer cancel()
+			release := make(chan struct{})
+			defer close(release)
+
+			received := make(chan string, 8)
+			for i := range 3 {
+				name := fmt.Sprintf("w%d", i)
+				var busy atomic.Bool
+				cc := newTestClient(t, addr, WithClientId(name), WithPushHandler(func(ctx context.Context, path string, dec func(any) error) error {
+					received <- name
+					// The first worker sits on its first message.
+					if name == "w0" && busy.CompareAndSwap(false, true) {
+						<-release
+					}
+					return nil
+				}))
+				if _, err := cc.Subscribe(ctx, codec.TopicQos{Topic: "$share/workers/events/#", Qos: codec.QosAtLeastOnce}); err != nil {
+					t.Fatalf("Subscribe() error = %v", err)
+				}
+			}
+			all := make(chan string, 8)
+			sub := topicClient(t, addr, "audit", all)
+			if _, err := sub.Subscribe(ctx, codec.TopicQos{Topic: "events/#", Qos: codec.QosAtLeastOnce}); err != nil {
+				t.Fatalf("Subscribe() error = %v", err)
+			}
+
+			for i := range 4 {
+				if err := s.Publish(ctx, "events/chat", &pb.Student{Name: fmt.Sprint(i)}); err != nil {
+					t.Fatalf("Publish() error = %v", err)
+				}
+				// Let the worker get it before the next one is routed.
+				time.Sleep(time.Millisecond * 50)
+			}
+
+			got := countReceived(received)
+			for name, n := range tt.want {
+				if got[name] != n {
+					t.Errorf("%s received %d messages, want %d (%v)", name, got[name], n, got)
+				}
+			}
+			if n := len(countReceived(all)); n == 0 {
+				t.Error("the plain subscription received nothing")
+			}
+		})
+	}
+}
+
+func TestServer_SharedRedelivery(t *testing.T) {
+	s, addr := newTestServer(t, EnableBroker(true))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	release := make(chan struct{})
+	defer close(release)
+
+	received := make(chan string, 2)
+	var workers []*ClientConn
+	for _, name := range []string{"w0", "w1"} {
+		cc := newTestClient(t, addr, WithClientId(name), WithPushHandler(func(ctx context.Context, path string, dec func(any) error) error {
+			received <- name
+			if name == "w0" {
+				<-release
+			}
+			return nil
+		}))
+		if _, err := cc.Subscribe(ctx, codec.TopicQos{Topic: "$share/workers/jobs", Qos: codec.QosAtLeastOnce}); err != nil {
+			t.Fatalf("Subscribe() error = %v", err)
+		}
+		workers = append(workers, cc)
+	}
+
+	if err := s.Publish(ctx, "jobs", &pb.Student{Name: "job"}); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	if got := <-received; got != "w0" {
+		t.Fatalf("first delivery to %s, want w0", got)
+	}
+	// w0 leaves without acknowledging the message.
+	workers[0].conn.CloseWithError(0x1, "crash")
+
+	select {
+	case got := <-received:
+		if got != "w1" {
+			t.Errorf("redelivery to %s, want w1", got)
+		}
+	case <-time.After(time.Second):
+		t.Error("the message was not delivered to another member")
+	}
+}
+
+func TestServer_SharedNoMember(t *testing.T) {
+	s, addr := newTestServer(t, EnableBroker(true))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	received := make(chan string, 4)
+	worker := topicClient(t, addr, "w0", received, WithCleanSession(false))
+	if _, err := worker.Subscribe(ctx, codec.TopicQos{Topic: "$share/workers/jobs", Qos: codec.QosAtLeastOnce}); err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	worker.Close()
+	// Let the server notice.
+	time.Sleep(time.Millisecond * 100)
+
+	for _, name := range []string{"a", "b"} {
+		if err := s.Publish(ctx, "jobs", &pb.Student{Name: name}); err != nil {
+			t.Fatalf("Publish() error = %v", err)
+		}
+	}
+	if err := s.Publish(ctx, "jobs", &pb.Student{Name: "c"}, PushQos(codec.QosAtMostOnce)); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+
+	topicClient(t, addr, "w0", received, WithCleanSession(false))
+	got := countReceived(received)
+	want := map[string]int{"jobs a": 1, "jobs b": 1}
+	if !maps.Equal(got, want) {
+		t.Errorf("received %v once back, want %v", got, want)
+	}
+}
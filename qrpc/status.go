@@ -1,47 +1,125 @@
 package qrpc
 
+import (
+	"github.com/stonefire-oss/stonefire-im/pkg/codec"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// Code is the status code of a call, the same as the gRPC one so that the
+// two can be used interchangeably. On the wire it takes 7 bits.
+//
 // Grpc status code [gRPC documentation]: https://github.com/grpc/grpc/blob/master/doc/statuscodes.md
-type Code uint8
+type Code = codes.Code
 
 const (
-	OK Code = 0
+	OK Code = codes.OK
 
-	Canceled Code = 1
+	Canceled Code = codes.Canceled
 
-	Unknown Code = 2
+	Unknown Code = codes.Unknown
 
-	InvalidArgument Code = 3
+	InvalidArgument Code = codes.InvalidArgument
 
-	DeadlineExceeded Code = 4
+	DeadlineExceeded Code = codes.DeadlineExceeded
 
-	NotFound Code = 5
+	NotFound Code = codes.NotFound
 
-	AlreadyExists Code = 6
+	AlreadyExists Code = codes.AlreadyExists
 
-	PermissionDenied Code = 7
+	PermissionDenied Code = codes.PermissionDenied
 
-	ResourceExhausted Code = 8
+	ResourceExhausted Code = codes.ResourceExhausted
 
-	FailedPrecondition Code = 9
+	FailedPrecondition Code = codes.FailedPrecondition
 
-	Aborted Code = 10
+	Aborted Code = codes.Aborted
 
-	OutOfRange Code = 11
+	OutOfRange Code = codes.OutOfRange
 
-	Unimplemented Code = 12
+	Unimplemented Code = codes.Unimplemented
 
-	Internal Code = 13
+	Internal Code = codes.Internal
 
-	Unavailable Code = 14
+	Unavailable Code = codes.Unavailable
 
-	DataLoss Code = 15
+	DataLoss Code = codes.DataLoss
 
-	Unauthenticated Code = 16
+	Unauthenticated Code = codes.Unauthenticated
 
 	_maxCode = 17
 )
 
+// statusDetailsKey is the trailer key carrying the details of a status, a
+// serialized google.rpc.Status like grpc-status-details-bin.
+const statusDetailsKey = "qrpc-status-details-bin"
+
+// Status is the outcome of a call.
 type Status struct {
 	Code    Code
 	Message string
+	Details []*anypb.Any
+}
+
+// FromError returns the Status of err, as status.Convert does.
+func FromError(err error) *Status {
+	p := status.Convert(err).Proto()
+	return &Status{
+		Code:    Code(p.GetCode()),
+		Message: p.GetMessage(),
+		Details: p.GetDetails(),
+	}
+}
+
+// GRPCStatus returns s as a gRPC status, which makes a Status usable by the
+// functions of the status package.
+func (s *Status) GRPCStatus() *status.Status {
+	return status.FromProto(&spb.Status{
+		Code:    int32(s.Code),
+		Message: s.Message,
+		Details: s.Details,
+	})
+}
+
+// Err returns the error of s, nil when its Code is OK.
+func (s *Status) Err() error {
+	return s.GRPCStatus().Err()
+}
+
+// wireStatus returns the status of a PubAck for st, and the value of the
+// statusDetailsKey trailer when st has details.
+func wireStatus(st *status.Status) (codec.Status, string) {
+	c := st.Code()
+	if c >= _maxCode {
+		c = Unknown
+	}
+	ws := codec.Status{Code: uint8(c), Message: st.Message()}
+
+	p := st.Proto()
+	if len(p.GetDetails()) == 0 {
+		return ws, ""
+	}
+	b, err := proto.Marshal(p)
+	if err != nil {
+		return ws, ""
+	}
+	return ws, string(b)
+}
+
+// statusError converts the status of a PubAck back into a gRPC status error,
+// nil if the call succeeded.
+func statusError(ws codec.Status, trailer codec.Props) error {
+	if Code(ws.Code) == OK {
+		return nil
+	}
+	if v := trailer[statusDetailsKey]; len(v) > 0 {
+		p := &spb.Status{}
+		if err := proto.Unmarshal([]byte(v[0]), p); err == nil && p.GetCode() == int32(ws.Code) {
+			return status.ErrorProto(p)
+		}
+	}
+	return status.Error(Code(ws.Code), ws.Message)
 }
@@ -0,0 +1,86 @@
+package qrpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stonefire-oss/stonefire-im/demo/pb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestServer_ErrorStatus(t *testing.T) {
+	detailed, err := status.New(codes.InvalidArgument, "bad name").WithDetails(&errdetails.BadRequest{
+		FieldViolations: []*errdetails.BadRequest_FieldViolation{{Field: "name", Description: "empty"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want *status.Status
+	}{
+		{
+			name: "status",
+			err:  status.Error(codes.NotFound, "no such student"),
+			want: status.New(codes.NotFound, "no such student"),
+		},
+		{
+			name: "details",
+			err:  detailed.Err(),
+			want: detailed,
+		},
+		{
+			name: "plain error",
+			err:  errors.New("boom"),
+			want: status.New(codes.Unknown, "boom"),
+		},
+		{
+			name: "qrpc status",
+			err:  (&Status{Code: Aborted, Message: "try again"}).Err(),
+			want: status.New(codes.Aborted, "try again"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fail := func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+				return nil, tt.err
+			}
+			failStream := func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+				return tt.err
+			}
+			_, addr := newTestServer(t, UnaryInterceptor(fail), StreamInterceptor(failStream))
+			client := pb.NewStudentServiceClient(newTestClient(t, addr))
+
+			_, err := client.CreateStudent(context.Background(), &pb.Student{})
+			if got := status.Convert(err); !proto.Equal(got.Proto(), tt.want.Proto()) {
+				t.Errorf("CreateStudent() status = %v, want %v", got.Proto(), tt.want.Proto())
+			}
+
+			stream, err := client.Hello(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = stream.Recv()
+			if got := status.Convert(err); !proto.Equal(got.Proto(), tt.want.Proto()) {
+				t.Errorf("Recv() status = %v, want %v", got.Proto(), tt.want.Proto())
+			}
+		})
+	}
+}
+
+func TestServer_MalformedMethod(t *testing.T) {
+	_, addr := newTestServer(t)
+	cc := newTestClient(t, addr)
+
+	err := cc.Invoke(context.Background(), "nomethod", &pb.Student{}, &pb.Result{})
+	if got := status.Code(err); got != codes.Unimplemented {
+		t.Errorf("Invoke() code = %v, want %v", got, codes.Unimplemented)
+	}
+}
@@ -2,58 +2,99 @@ package qrpc
 
 import (
 	"context"
-	"sync"
+	"errors"
+	"io"
 	"sync/atomic"
 
 	"github.com/quic-go/quic-go"
 	"github.com/stonefire-oss/stonefire-im/pkg/codec"
 	"github.com/stonefire-oss/stonefire-im/pkg/utils"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 type serverStream struct {
-	mu     sync.Mutex
 	s      quic.Stream
+	fw     *frameWriter
 	ctx    context.Context
-	fr     atomic.Pointer[codec.Publish]
-	md     metadata.MD
+	meta   *callMetadata
 	plmk   codec.PayloadBuilder
 	quit   *utils.Event
 	sd     *grpc.StreamDesc
 	z      bool
 	method string
+	// first is the frame which opened the call if it carries a message, it
+	// is the first one RecvMsg returns.
+	first atomic.Pointer[codec.Publish]
+
+	maxSendMessageSize    int
+	maxReceiveMessageSize int
 }
 
-func newServerStream(ctx context.Context, req *codec.Publish, stream quic.Stream, con *qrpcConn, sd *grpc.StreamDesc) grpc.ServerStream {
+// newServerStream creates the stream of a streaming call. req is the frame
+// which opened the call, it carries the method path and usually no message;
+// the messages of the call follow in Publish frames of their own. A message
+// sent along with the method is received first.
+func newServerStream(ctx context.Context, req *codec.Publish, stream quic.Stream, fw *frameWriter, con *qrpcConn, sd *grpc.StreamDesc, meta *callMetadata) *serverStream {
 	ss := &serverStream{
 		s:      stream,
+		fw:     fw,
 		ctx:    ctx,
 		method: req.Path,
 		quit:   con.quit,
-		md:     make(metadata.MD),
+		meta:   meta,
 		z:      req.Compressed,
 		plmk:   con.plmk,
 		sd:     sd,
-	}
 
-	ss.fr.Store(req)
+		maxSendMessageSize:    con.maxSendMessageSize,
+		maxReceiveMessageSize: con.maxReceiveMessageSize,
+	}
+	meta.sendHeader = ss.sendHeader
+	if req.Payload != nil && req.Payload.Len() > 0 {
+		ss.first.Store(req)
+	} else {
+		FreePayload(req)
+	}
 	return ss
 }
 
+// release frees the message which opened the call if it was not received.
+func (ss *serverStream) release() {
+	if first := ss.first.Swap(nil); first != nil {
+		FreePayload(first)
+	}
+}
+
 func (ss *serverStream) SetHeader(md metadata.MD) error {
-	ss.mu.Lock()
-	defer ss.mu.Unlock()
-	ss.md = metadata.Join(md)
-	return nil
+	return ss.meta.SetHeader(md)
 }
 
-func (ss *serverStream) SendHeader(metadata.MD) error {
-	return ss.SendMsg(nil)
+func (ss *serverStream) SendHeader(md metadata.MD) error {
+	return ss.meta.SendHeader(md)
 }
 
-func (ss *serverStream) SetTrailer(metadata.MD) {
+func (ss *serverStream) SetTrailer(md metadata.MD) {
+	ss.meta.SetTrailer(md)
+}
 
+// sendHeader sends the header ahead of the first message, in a Publish marked
+// as carrying no message.
+func (ss *serverStream) sendHeader() error {
+	return ss.fw.WriteMessageFunc(func() (codec.Message, error) {
+		header, ok := ss.meta.takeHeader()
+		if !ok {
+			return nil, errHeaderSent
+		}
+		props := mdToProps(header)
+		if props == nil {
+			props = make(codec.Props)
+		}
+		props[headerOnlyKey] = []string{"1"}
+		return &codec.Publish{Props: props}, nil
+	})
 }
 
 func (ss *serverStream) Context() context.Context {
@@ -71,47 +112,72 @@ func (ss *serverStream) SendMsg(m any) error {
 		}
 	}()
 
-	ss.mu.Lock()
-	pub := &codec.Publish{
-		Header:  codec.Header{AckRequired: false, Compressed: ss.z},
-		Payload: bf,
-		Props:   codec.Props(ss.md),
-	}
-	if ss.md.Len() > 0 {
-		ss.md = make(metadata.MD)
+	if bf != nil && bf.Len() > ss.maxSendMessageSize {
+		return status.Errorf(codes.ResourceExhausted, "qrpc: trying to send message larger than max (%d vs. %d)", bf.Len(), ss.maxSendMessageSize)
 	}
-	ss.mu.Unlock()
 
-	return pub.Encode(ss.s)
+	// The header goes with the first frame written, whichever of concurrent
+	// senders it belongs to.
+	return ss.fw.WriteMessageFunc(func() (codec.Message, error) {
+		pub := &codec.Publish{
+			Header:  codec.Header{AckRequired: false, Compressed: ss.z},
+			Payload: bf,
+		}
+		if header, ok := ss.meta.takeHeader(); ok {
+			pub.Props = mdToProps(header)
+		}
+		return pub, nil
+	})
 }
 
+// RecvMsg reads the next message of the client. It returns io.EOF once the
+// client half-closed the call.
 func (ss *serverStream) RecvMsg(m any) error {
-	fr := ss.fr.Swap(nil)
-	if fr != nil {
-		defer func() {
-			if r, ok := fr.Payload.(interface {
-				Release()
-			}); ok {
-				r.Release()
-			}
-			fr.Payload = nil
-		}()
-		return DecodePayload(m, fr.Payload, ss.z)
+	if first := ss.first.Swap(nil); first != nil {
+		return ss.decode(m, first)
 	}
 
 	msg, err := codec.DecodeOneMessage(ss.s, ss.plmk)
 	if err != nil {
-		return err
+		return ss.recvError(err)
 	}
 
-	switch vv := msg.(type) {
-	case *codec.Publish:
-		defer FreePayload(vv)
-		return DecodePayload(m, vv.Payload, vv.Compressed)
-	case codec.PayloadContainer:
-		FreePayload(vv)
-	default:
+	pub, ok := msg.(*codec.Publish)
+	if !ok {
+		if pc, ok := msg.(codec.PayloadContainer); ok {
+			FreePayload(pc)
+		}
+		return status.Errorf(codes.Internal, "qrpc: unexpected %v frame in stream", msg)
+	}
+	return ss.decode(m, pub)
+}
 
+// decode unmarshals the message of pub into m and frees it.
+func (ss *serverStream) decode(m any, pub *codec.Publish) error {
+	defer FreePayload(pub)
+	if err := decodePayload(m, pub.Payload, pub.Compressed, ss.maxReceiveMessageSize); err != nil {
+		if status.Code(err) == codes.ResourceExhausted {
+			return err
+		}
+		return status.Errorf(codes.Internal, "qrpc: failed to unmarshal the received message: %v", err)
 	}
 	return nil
 }
+
+// recvError converts an error reading the stream into the error of RecvMsg.
+func (ss *serverStream) recvError(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.EOF
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	if ctxErr := ss.ctx.Err(); ctxErr != nil {
+		return status.FromContextError(ctxErr).Err()
+	}
+	var se *quic.StreamError
+	if errors.As(err, &se) {
+		return status.Error(codes.Canceled, "qrpc: the client canceled the stream")
+	}
+	return status.Errorf(codes.Internal, "qrpc: failed to read message: %v", err)
+}
@@ -0,0 +1,279 @@
+package qrpc
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stonefire-oss/stonefire-im/demo/pb"
+	"github.com/stonefire-oss/stonefire-im/pkg/codec"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// streamKindsDesc describes client-streaming and server-streaming methods
+// next to the bidi Hello of the student service. Its handlers need no
+// implementation.
+var streamKindsDesc = grpc.ServiceDesc{
+	ServiceName: "qrpc.test.StreamKinds",
+	HandlerType: (*any)(nil),
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Count",
+			ClientStreams: true,
+			Handler: func(srv any, stream grpc.ServerStream) error {
+				ss := &grpc.GenericServerStream[pb.Student, pb.Result]{ServerStream: stream}
+				n := 0
+				for {
+					st, err := ss.Recv()
+					if err == io.EOF {
+						return ss.SendAndClose(&pb.Result{Code: int32(n)})
+					}
+					if err != nil {
+						return err
+					}
+					if st.Name == "fail" {
+						return status.Error(codes.InvalidArgument, "fail")
+					}
+					n++
+				}
+			},
+		},
+		{
+			StreamName:    "Repeat",
+			ServerStreams: true,
+			Handler: func(srv any, stream grpc.ServerStream) error {
+				ss := &grpc.GenericServerStream[pb.Student, pb.Echo]{ServerStream: stream}
+				st := new(pb.Student)
+				if err := ss.RecvMsg(st); err != nil {
+					return err
+				}
+				for _, s := range st.Scores {
+					if s < 0 {
+						return status.Error(codes.OutOfRange, "negative score")
+					}
+					if err := ss.Send(&pb.Echo{Name: st.Name}); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+		{
+			StreamName:    "Fan",
+			ServerStreams: true,
+			Handler: func(srv any, stream grpc.ServerStream) error {
+				st := new(pb.Student)
+				if err := stream.RecvMsg(st); err != nil {
+					return err
+				}
+				stream.SetHeader(metadata.Pairs("x-fan", st.Name))
+				// Every score is sent by a goroutine of its own.
+				var wg sync.WaitGroup
+				for _, s := range st.Scores {
+					wg.Add(1)
+					go func(s int32) {
+						defer wg.Done()
+						stream.SendMsg(&pb.Echo{Name: st.Name, Msg: strings.Repeat("x", int(s))})
+					}(s)
+				}
+				wg.Wait()
+				return nil
+			},
+		},
+	},
+}
+
+func TestStream_ClientStreaming(t *testing.T) {
+	s, addr := newTestServer(t)
+	s.RegisterService(&streamKindsDesc, nil)
+	cc := newTestClient(t, addr)
+
+	tests := []struct {
+		name     string
+		names    []string
+		want     int32
+		wantCode codes.Code
+	}{
+		{name: "empty", want: 0},
+		{name: "three", names: []string{"a", "b", "c"}, want: 3},
+		{name: "error", names: []string{"a", "fail"}, wantCode: codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs, err := cc.NewStream(context.Background(), &streamKindsDesc.Streams[0], "/qrpc.test.StreamKinds/Count")
+			if err != nil {
+				t.Fatal(err)
+			}
+			stream := &grpc.GenericClientStream[pb.Student, pb.Result]{ClientStream: cs}
+			for _, n := range tt.names {
+				stream.Send(&pb.Student{Name: n})
+			}
+			res, err := stream.CloseAndRecv()
+			if got := status.Code(err); got != tt.wantCode {
+				t.Fatalf("CloseAndRecv() code = %v, want %v (%v)", got, tt.wantCode, err)
+			}
+			if err == nil && res.Code != tt.want {
+				t.Errorf("CloseAndRecv() = %v, want %v", res.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestStream_ServerStreaming(t *testing.T) {
+	s, addr := newTestServer(t)
+	s.RegisterService(&streamKindsDesc, nil)
+	cc := newTestClient(t, addr)
+
+	tests := []struct {
+		name     string
+		scores   []int32
+		want     int
+		wantCode codes.Code
+	}{
+		{name: "empty", want: 0, wantCode: codes.OK},
+		{name: "two", scores: []int32{1, 2}, want: 2, wantCode: codes.OK},
+		{name: "error", scores: []int32{1, -1}, want: 1, wantCode: codes.OutOfRange},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs, err := cc.NewStream(context.Background(), &streamKindsDesc.Streams[1], "/qrpc.test.StreamKinds/Repeat")
+			if err != nil {
+				t.Fatal(err)
+			}
+			stream := &grpc.GenericClientStream[pb.Student, pb.Echo]{ClientStream: cs}
+			if err := stream.Send(&pb.Student{Name: tt.name, Scores: tt.scores}); err != nil {
+				t.Fatal(err)
+			}
+			stream.CloseSend()
+
+			n := 0
+			for {
+				_, err = stream.Recv()
+				if err != nil {
+					break
+				}
+				n++
+			}
+			if n != tt.want {
+				t.Errorf("received %d messages, want %d", n, tt.want)
+			}
+			if tt.wantCode == codes.OK {
+				if err != io.EOF {
+					t.Errorf("Recv() error = %v, want EOF", err)
+				}
+			} else if got := status.Code(err); got != tt.wantCode {
+				t.Errorf("Recv() code = %v, want %v", got, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestStream_BidiEnd(t *testing.T) {
+	_, addr := newTestServer(t)
+	client := pb.NewStudentServiceClient(newTestClient(t, addr))
+
+	stream, err := client.Hello(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The handler reads io.EOF at once and ends the call with OK.
+	stream.CloseSend()
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Errorf("Recv() error = %v, want EOF", err)
+	}
+	// The end of the call is sticky.
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Errorf("second Recv() error = %v, want EOF", err)
+	}
+}
+
+func TestStream_ConcurrentSend(t *testing.T) {
+	s, addr := newTestServer(t)
+	s.RegisterService(&streamKindsDesc, nil)
+	cc := newTestClient(t, addr)
+
+	st := &pb.Student{Name: "fan"}
+	for i := 0; i < 64; i++ {
+		st.Scores = append(st.Scores, int32(1000+i))
+	}
+	cs, err := cc.NewStream(context.Background(), &streamKindsDesc.Streams[2], "/qrpc.test.StreamKinds/Fan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := &grpc.GenericClientStream[pb.Student, pb.Echo]{ClientStream: cs}
+	if err := stream.Send(st); err != nil {
+		t.Fatal(err)
+	}
+	stream.CloseSend()
+
+	seen := make(map[int]bool)
+	for {
+		echo, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Recv() error = %v", err)
+		}
+		if echo.Name != st.Name {
+			t.Fatalf("Recv() = %q, want %q", echo.Name, st.Name)
+		}
+		seen[len(echo.Msg)] = true
+	}
+	if len(seen) != len(st.Scores) {
+		t.Errorf("received %d distinct messages, want %d", len(seen), len(st.Scores))
+	}
+	header, _ := stream.Header()
+	if got := header.Get("x-fan"); len(got) != 1 || got[0] != st.Name {
+		t.Errorf("Header() = %v, want x-fan: %v", header, st.Name)
+	}
+}
+
+func TestStream_MessageInFirstFrame(t *testing.T) {
+	s, addr := newTestServer(t)
+	s.RegisterService(&streamKindsDesc, nil)
+	cc := newTestClient(t, addr)
+
+	// A client may send the first message along with the method.
+	bf, err := EncodePayload(&pb.Student{Name: "first", Scores: []int32{1}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer freeBuffer(bf)
+	stream, err := cc.conn.OpenStreamSync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	open := &codec.Publish{
+		Header:    codec.Header{AckRequired: true},
+		MessageId: cc.nextMessageId(),
+		Path:      "/qrpc.test.StreamKinds/Repeat",
+		Payload:   bf,
+	}
+	if err := open.Encode(stream); err != nil {
+		t.Fatal(err)
+	}
+	stream.Close()
+
+	msg, err := codec.DecodeOneMessage(stream, codec.SlicePayloadBuiler{})
+	if err != nil {
+		t.Fatalf("DecodeOneMessage() error = %v", err)
+	}
+	pub, ok := msg.(*codec.Publish)
+	if !ok {
+		t.Fatalf("reply = %v, want a Publish", msg)
+	}
+	var echo pb.Echo
+	if err := DecodePayload(&echo, pub.Payload, pub.Compressed); err != nil || echo.Name != "first" {
+		t.Errorf("reply = %v, %v, want the echo of the first message", &echo, err)
+	}
+	msg, err = codec.DecodeOneMessage(stream, codec.SlicePayloadBuiler{})
+	if ack, ok := msg.(*codec.PubAck); err != nil || !ok || ack.Status.Code != uint8(OK) {
+		t.Errorf("final reply = %v, %v, want an OK PubAck", msg, err)
+	}
+}
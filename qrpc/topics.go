@@ -0,0 +1,366 @@
+package qrpc
+
+import (
+	"context"
+	"io"
+
+	"github.com/quic-go/quic-go"
+	"github.com/stonefire-oss/stonefire-im/pkg/broker"
+	"github.com/stonefire-oss/stonefire-im/pkg/codec"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Topics are served by the broker of the server, see EnableBroker.
+//
+// A client subscribes with a Subscribe frame, answered by a SubAck, and
+// publishes with a Publish whose Path is the topic, answered by a PubAck if
+// it requires one. The messages published on a topic are pushed to every
+// session subscribed to it like the messages of Server.Push, with the lowest
+// of the QoS of the publication and of the subscription. The subscriptions
+// belong to the session of the client and last as long as it. A server with
+// a TopicAccess decides which topics each client may use.
+
+// TopicAction is what a client asks to do with a topic, see TopicAccess.
+type TopicAction int
+
+const (
+	// TopicPublish is a Publish on the topic, or a will registered on it.
+	TopicPublish TopicAction = iota
+	// TopicSubscribe is a subscription to the topic filter.
+	TopicSubscribe
+)
+
+// Subscribe subscribes the client to the topics matching filters. It returns
+// the QoS granted for each filter, QosFailure for the refused ones. The
+// messages are handed to the PushHandler, with their topic as path.
+func (cc *ClientConn) Subscribe(ctx context.Context, filters ...codec.TopicQos) ([]codec.QosLevel, error) {
+	req := &codec.Subscribe{
+		Header:    codec.Header{AckRequired: true},
+		MessageId: cc.nextMessageId(),
+		Topics:    filters,
+	}
+	msg, err := cc.roundTrip(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	ack, ok := msg.(*codec.SubAck)
+	if !ok || ack.MessageId != req.MessageId || len(ack.TopicsQos) != len(filters) {
+		return nil, status.Errorf(codes.Internal, "qrpc: unexpected %v frame in reply to Subscribe", msg)
+	}
+	return ack.TopicsQos, nil
+}
+
+// Unsubscribe removes topic filters of the client.
+func (cc *ClientConn) Unsubscribe(ctx context.Context, filters ...string) error {
+	req := &codec.Unsubscribe{
+		Header:    codec.Header{AckRequired: true},
+		MessageId: cc.nextMessageId(),
+		Topics:    filters,
+	}
+	msg, err := cc.roundTrip(ctx, req)
+	if err != nil {
+		return err
+	}
+	if ack, ok := msg.(*codec.UnsubAck); !ok || ack.MessageId != req.MessageId {
+		return status.Errorf(codes.Internal, "qrpc: unexpected %v frame in reply to Unsubscribe", msg)
+	}
+	return nil
+}
+
+// Publish publishes msg on topic, along with the outgoing metadata of ctx. It
+// takes the same options as Server.Publish. With QosAtLeastOnce, the default,
+// it returns once the server took the message over.
+func (cc *ClientConn) Publish(ctx context.Context, topic string, msg any, opts ...PushOption) error {
+	po := defaultPushOptions
+	for _, o := range opts {
+		o.apply(&po)
+	}
+	if !po.qos.IsValid() {
+		return status.Errorf(codes.InvalidArgument, "qrpc: invalid QoS %d", po.qos)
+	}
+
+	bf, err := EncodePayload(msg, po.compressed)
+	if err != nil {
+		return status.Errorf(codes.Internal, "qrpc: error while marshaling: %v", err)
+	}
+	defer freeBuffer(bf)
+
+	md, _ := metadata.FromOutgoingContext(ctx)
+	pub := &codec.Publish{
+		Header: codec.Header{Compressed: po.compressed, Retain: po.retain},
+		Path:   topic,
+		Props:  mdToProps(md),
+	}
+	if bf != nil {
+		pub.Payload = bf
+	}
+	if po.qos == codec.QosAtMostOnce {
+		s, stop, err := cc.newStream(ctx)
+		if err != nil {
+			return err
+		}
+		defer stop()
+		if err := newFrameWriter(s, cc.opts.bufferPool).WriteMessage(pub); err != nil {
+			s.CancelRead(quic.StreamErrorCode(codes.Canceled))
+			return toRPCErr(ctx, err)
+		}
+		finishStream(s)
+		return nil
+	}
+
+	pub.AckRequired = true
+	pub.MessageId = cc.nextMessageId()
+	reply, err := cc.roundTrip(ctx, pub)
+	if err != nil {
+		return err
+	}
+	ack, ok := reply.(*codec.PubAck)
+	if !ok || ack.MessageId != pub.MessageId {
+		return status.Errorf(codes.Internal, "qrpc: unexpected %v frame in reply to Publish", reply)
+	}
+	defer FreePayload(ack)
+	return statusError(ack.Status, ack.Trailer)
+}
+
+// roundTrip sends req on a stream of its own and returns the reply.
+func (cc *ClientConn) roundTrip(ctx context.Context, req codec.Message) (codec.Message, error) {
+	s, stop, err := cc.newStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer stop()
+
+	if err := newFrameWriter(s, cc.opts.bufferPool).WriteMessage(req); err != nil {
+		s.CancelRead(quic.StreamErrorCode(codes.Canceled))
+		return nil, toRPCErr(ctx, err)
+	}
+	s.Close()
+	defer s.CancelRead(quic.StreamErrorCode(NoError))
+
+	msg, err := codec.DecodeOneMessage(s, cc.plmk)
+	if err == io.EOF {
+		return nil, status.Error(codes.Internal, "qrpc: stream terminated without a reply")
+	}
+	return msg, toRPCErr(ctx, err)
+}
+
+// Publish publishes msg on topic, along with the outgoing metadata of ctx, to
+// the sessions subscribed to it. It does not wait for the message to be
+// delivered. The QoS of the publication is set by PushQos, PushRetain makes
+// the broker retain it.
+func (s *Server) Publish(ctx context.Context, topic string, msg any, opts ...PushOption) error {
+	if s.topics == nil {
+		return status.Error(codes.FailedPrecondition, "qrpc: the broker is not enabled")
+	}
+	if !broker.ValidTopic(topic) {
+		return status.Errorf(codes.InvalidArgument, "qrpc: invalid topic %q", topic)
+	}
+	po := defaultPushOptions
+	for _, o := range opts {
+		o.apply(&po)
+	}
+	if !po.qos.IsValid() {
+		return status.Errorf(codes.InvalidArgument, "qrpc: invalid QoS %d", po.qos)
+	}
+
+	bf, err := EncodePayload(msg, po.compressed)
+	if err != nil {
+		return status.Errorf(codes.Internal, "qrpc: error while marshaling: %v", err)
+	}
+	defer freeBuffer(bf)
+
+	md, _ := metadata.FromOutgoingContext(ctx)
+	pub := &codec.Publish{
+		Header: codec.Header{Compressed: po.compressed, Retain: po.retain},
+		Path:   topic,
+		Props:  mdToProps(md),
+	}
+	if bf != nil {
+		pub.Payload = bf
+	}
+	return s.publishTopic(pub, po.qos)
+}
+
+// handleTopicPublish routes a Publish whose Path is a topic.
+func (s *Server) handleTopicPublish(ctx context.Context, req *codec.Publish, fw *frameWriter) {
+	defer FreePayload(req)
+	if !broker.ValidTopic(req.Path) {
+		if req.AckRequired {
+			replyStatus(fw, req, InvalidArgument, "qrpc: invalid topic")
+		}
+		return
+	}
+	if err := s.checkTopic(ctx, req.Path, TopicPublish); err != nil {
+		if req.AckRequired {
+			st := FromError(err)
+			replyStatus(fw, req, st.Code, st.Message)
+		}
+		return
+	}
+
+	qos := codec.QosAtMostOnce
+	if req.AckRequired {
+		qos = codec.QosAtLeastOnce
+	}
+	err := s.publishTopic(req, qos)
+	if req.AckRequired {
+		st := FromError(err)
+		replyStatus(fw, req, st.Code, st.Message)
+	}
+}
+
+// checkTopic asks the TopicAccess of the server whether the client of ctx
+// may do action with topic.
+func (s *Server) checkTopic(ctx context.Context, topic string, action TopicAction) error {
+	if s.opts.topicAccess == nil {
+		return nil
+	}
+	return s.opts.topicAccess(ctx, topic, action)
+}
+
+// publishTopic retains pub if it asks for it, then routes it to the sessions
+// subscribed to its topic. pub is copied.
+func (s *Server) publishTopic(pub *codec.Publish, qos codec.QosLevel) error {
+	msg := &codec.Publish{
+		Header: codec.Header{Compressed: pub.Compressed},
+		Path:   pub.Path,
+		Props:  pub.Props,
+	}
+	if pub.Payload != nil {
+		msg.Payload = codec.SlicePayload(append([]byte(nil), pub.Payload.ReadOnlyData()...))
+	}
+	if pub.Retain && s.retained != nil {
+		retained := *msg
+		retained.Retain = true
+		if err := s.retained.set(&retained, qos); err != nil {
+			return err
+		}
+	}
+	s.route(msg, qos)
+	return nil
+}
+
+// route pushes msg to the sessions subscribed to its topic. msg must not be
+// modified afterwards.
+func (s *Server) route(msg *codec.Publish, qos codec.QosLevel) {
+	for key, subQos := range s.topics.Match(msg.Path) {
+		s.mu.Lock()
+		ss, ok := s.sessions[key]
+		s.mu.Unlock()
+		if ok {
+			s.deliver(ss, msg, min(qos, subQos))
+		}
+	}
+	for sk := range s.sharedTopics.Match(msg.Path) {
+		s.deliverShared(sk, msg, qos)
+	}
+}
+
+// deliver queues msg in the push window of ss, the messages reach the client
+// in the order they were delivered. A message at most once is only sent if
+// the client is connected.
+func (s *Server) deliver(ss *session, msg *codec.Publish, qos codec.QosLevel) {
+	ss.window.post(msg, qos)
+}
+
+// handleSubscribe answers a Subscribe of c, then sends it the retained
+// messages matching the filters it was granted. The messages kept by the
+// shared subscription groups it joined are delivered first. A filter refused
+// by the TopicAccess of the server is granted QosFailure.
+func (s *Server) handleSubscribe(ctx context.Context, c *qrpcConn, stream quic.Stream, req *codec.Subscribe) {
+	ack := &codec.SubAck{
+		MessageId: req.MessageId,
+		TopicsQos: make([]codec.QosLevel, len(req.Topics)),
+	}
+	for i, t := range req.Topics {
+		if s.topics != nil && s.checkTopic(ctx, t.Topic, TopicSubscribe) != nil {
+			ack.TopicsQos[i] = codec.QosFailure
+			continue
+		}
+		ack.TopicsQos[i] = s.subscribe(c.session, t.Topic, t.Qos)
+	}
+	s.flushShared(c.session)
+	if err := newFrameWriter(stream, s.opts.bufferPool).WriteMessage(ack); err != nil || s.retained == nil {
+		return
+	}
+
+	s.mu.Lock()
+	ss, ok := s.sessions[c.session]
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	for i, t := range req.Topics {
+		if group, _ := broker.SplitShared(t.Topic); group != "" || ack.TopicsQos[i] == codec.QosFailure {
+			continue
+		}
+		for _, m := range s.retained.match(t.Topic) {
+			s.deliver(ss, m.pub, min(m.qos, ack.TopicsQos[i]))
+		}
+	}
+}
+
+// subscribe adds a subscription to the session of key and returns the QoS
+// granted.
+func (s *Server) subscribe(key sessionKey, filter string, qos codec.QosLevel) codec.QosLevel {
+	if s.topics == nil || !qos.IsValid() || !broker.ValidFilter(filter) {
+		return codec.QosFailure
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ss, ok := s.sessions[key]
+	if !ok {
+		return codec.QosFailure
+	}
+	var err error
+	if group, f := broker.SplitShared(filter); group != "" {
+		err = s.joinShare(key, group, f, qos)
+	} else {
+		err = s.topics.Subscribe(filter, key, qos)
+	}
+	if err != nil {
+		return codec.QosFailure
+	}
+	ss.subscriptions[filter] = qos
+	return qos
+}
+
+// unsubscribe removes a subscription of the session of key. s.mu must be
+// held.
+func (s *Server) unsubscribe(key sessionKey, filter string) {
+	if group, f := broker.SplitShared(filter); group != "" {
+		s.leaveShare(key, group, f)
+	} else {
+		s.topics.Unsubscribe(filter, key)
+	}
+}
+
+// handleUnsubscribe answers an Unsubscribe of c.
+func (s *Server) handleUnsubscribe(c *qrpcConn, stream quic.Stream, req *codec.Unsubscribe) {
+	if s.topics != nil {
+		s.mu.Lock()
+		if ss, ok := s.sessions[c.session]; ok {
+			for _, filter := range req.Topics {
+				s.unsubscribe(c.session, filter)
+				delete(ss.subscriptions, filter)
+			}
+		}
+		s.mu.Unlock()
+	}
+	ack := &codec.UnsubAck{MessageId: req.MessageId}
+	newFrameWriter(stream, s.opts.bufferPool).WriteMessage(ack)
+}
+
+// dropSubscriptions removes the subscriptions of a session which ended.
+// s.mu must be held.
+func (s *Server) dropSubscriptions(ss *session) {
+	if s.topics == nil {
+		return
+	}
+	for filter := range ss.subscriptions {
+		s.unsubscribe(ss.key, filter)
+	}
+}
@@ -0,0 +1,213 @@
+package qrpc
+
+import (
+	"context"
+	"crypto/tls"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stonefire-oss/stonefire-im/demo/pb"
+	"github.com/stonefire-oss/stonefire-im/pkg/codec"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// topicClient dials a client which sends the topic and name of the messages
+// it gets to received.
+func topicClient(t *testing.T, addr, clientId string, received chan<- string, opts ...DialOption) *ClientConn {
+	t.Helper()
+	opts = append([]DialOption{WithClientId(clientId), WithPushHandler(func(ctx context.Context, path string, dec func(any) error) error {
+		var st pb.Student
+		if err := dec(&st); err != nil {
+			return err
+		}
+		received <- path + " " + st.Name
+		return nil
+	})}, opts...)
+	return newTestClient(t, addr, opts...)
+}
+
+func TestServer_Topics(t *testing.T) {
+	_, addr := newTestServer(t, EnableBroker(true))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	received := make(chan string, 4)
+	sub := topicClient(t, addr, "alice", received)
+	granted, err := sub.Subscribe(ctx,
+		codec.TopicQos{Topic: "rooms/+/messages", Qos: codec.QosAtLeastOnce},
+		codec.TopicQos{Topic: "feeds/#", Qos: codec.QosAtMostOnce},
+		codec.TopicQos{Topic: "rooms/#/messages", Qos: codec.QosAtLeastOnce},
+	)
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	want := []codec.QosLevel{codec.QosAtLeastOnce, codec.QosAtMostOnce, codec.QosFailure}
+	if !slices.Equal(granted, want) {
+		t.Errorf("Subscribe() = %v, want %v", granted, want)
+	}
+
+	pub := newTestClient(t, addr, WithClientId("bob"))
+	tests := []struct {
+		topic string
+		qos   codec.QosLevel
+		want  bool
+	}{
+		{topic: "rooms/1/messages", qos: codec.QosAtLeastOnce, want: true},
+		{topic: "feeds/news/today", qos: codec.QosAtLeastOnce, want: true},
+		{topic: "rooms/1/members", qos: codec.QosAtLeastOnce},
+		{topic: "rooms/2/messages", qos: codec.QosAtMostOnce, want: true},
+	}
+	for _, tt := range tests {
+		if err := pub.Publish(ctx, tt.topic, &pb.Student{Name: "bob"}, PushQos(tt.qos)); err != nil {
+			t.Fatalf("Publish(%s) error = %v", tt.topic, err)
+		}
+		select {
+		case got := <-received:
+			if !tt.want {
+				t.Errorf("Publish(%s) delivered %q", tt.topic, got)
+			} else if got != tt.topic+" bob" {
+				t.Errorf("Publish(%s) delivered %q", tt.topic, got)
+			}
+		case <-time.After(time.Millisecond * 200):
+			if tt.want {
+				t.Errorf("Publish(%s) was not delivered", tt.topic)
+			}
+		}
+	}
+
+	if err := pub.Publish(ctx, "rooms/+/messages", &pb.Student{}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Publish(wildcard) error = %v, want %v", err, codes.InvalidArgument)
+	}
+
+	if err := sub.Unsubscribe(ctx, "rooms/+/messages"); err != nil {
+		t.Fatalf("Unsubscribe() error = %v", err)
+	}
+	if err := pub.Publish(ctx, "rooms/1/messages", &pb.Student{Name: "bob"}); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	select {
+	case got := <-received:
+		t.Errorf("delivered %q after Unsubscribe", got)
+	case <-time.After(time.Millisecond * 200):
+	}
+}
+
+func TestServer_TopicSession(t *testing.T) {
+	s, addr := newTestServer(t, EnableBroker(true))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	tests := []struct {
+		name  string
+		clean bool
+		want  bool
+	}{
+		{name: "resumed", want: true},
+		{name: "clean start", clean: true, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// A session of its own, the push of another subtest may still be
+			// pending in the previous one.
+			clientId := "alice/" + tt.name
+			received := make(chan string, 1)
+			first := topicClient(t, addr, clientId, received, WithCleanSession(false))
+			if _, err := first.Subscribe(ctx, codec.TopicQos{Topic: "alerts", Qos: codec.QosAtLeastOnce}); err != nil {
+				t.Fatalf("Subscribe() error = %v", err)
+			}
+			first.Close()
+			// Let the server notice.
+			time.Sleep(time.Millisecond * 100)
+
+			topicClient(t, addr, clientId, received, WithCleanSession(tt.clean))
+			if err := s.Publish(ctx, "alerts", &pb.Student{Name: "fire"}); err != nil {
+				t.Fatalf("Publish() error = %v", err)
+			}
+			select {
+			case got := <-received:
+				if !tt.want {
+					t.Errorf("delivered %q to a clean session", got)
+				}
+			case <-time.After(time.Millisecond * 200):
+				if tt.want {
+					t.Error("the subscription did not survive the session resumption")
+				}
+			}
+		})
+	}
+}
+
+func TestServer_TopicsDisabled(t *testing.T) {
+	s, addr := newTestServer(t)
+	cc := newTestClient(t, addr)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	granted, err := cc.Subscribe(ctx, codec.TopicQos{Topic: "alerts", Qos: codec.QosAtMostOnce})
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	if !slices.Equal(granted, []codec.QosLevel{codec.QosFailure}) {
+		t.Errorf("Subscribe() = %v, want [%v]", granted, codec.QosFailure)
+	}
+	if err := s.Publish(ctx, "alerts", &pb.Student{}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Publish() error = %v, want %v", err, codes.FailedPrecondition)
+	}
+}
+
+func TestServer_TopicAccess(t *testing.T) {
+	access := func(ctx context.Context, topic string, action TopicAction) error {
+		if ua, ok := UserAgentFromContext(ctx); ok && ua.ClientId == "admin" {
+			return nil
+		}
+		if strings.HasPrefix(topic, "private/") || topic == "#" {
+			return status.Error(codes.PermissionDenied, "private topic")
+		}
+		return nil
+	}
+	_, addr := newTestServer(t, EnableBroker(true), TopicAccess(access))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	received := make(chan string, 4)
+	sub := topicClient(t, addr, "alice", received)
+	granted, err := sub.Subscribe(ctx,
+		codec.TopicQos{Topic: "#", Qos: codec.QosAtLeastOnce},
+		codec.TopicQos{Topic: "private/+", Qos: codec.QosAtLeastOnce},
+		codec.TopicQos{Topic: "rooms/+", Qos: codec.QosAtLeastOnce},
+	)
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	want := []codec.QosLevel{codec.QosFailure, codec.QosFailure, codec.QosAtLeastOnce}
+	if !slices.Equal(granted, want) {
+		t.Errorf("Subscribe() = %v, want %v", granted, want)
+	}
+
+	if err := sub.Publish(ctx, "private/alice", &pb.Student{Name: "alice"}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Publish(private) error = %v, want %v", err, codes.PermissionDenied)
+	}
+	admin := newTestClient(t, addr, WithClientId("admin"))
+	for _, topic := range []string{"private/alice", "rooms/1"} {
+		if err := admin.Publish(ctx, topic, &pb.Student{Name: "admin"}); err != nil {
+			t.Fatalf("Publish(%s) error = %v", topic, err)
+		}
+	}
+	select {
+	case got := <-received:
+		if got != "rooms/1 admin" {
+			t.Errorf("delivered %q, want %q", got, "rooms/1 admin")
+		}
+	case <-time.After(time.Second):
+		t.Error("rooms/1 was not delivered")
+	}
+
+	tlsConf := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{testALPN}}
+	_, err = Dial(ctx, addr, tlsConf, WithClientId("bob"), WithLastWill("private/bob", &pb.Student{Name: "offline"}))
+	if c := status.Code(err); c != codes.PermissionDenied {
+		t.Errorf("Dial(private will) code = %v, want %v (%v)", c, codes.PermissionDenied, err)
+	}
+}
@@ -0,0 +1,106 @@
+package qrpc
+
+import (
+	"context"
+	"errors"
+
+	"github.com/quic-go/quic-go"
+	"github.com/stonefire-oss/stonefire-im/pkg/broker"
+	"github.com/stonefire-oss/stonefire-im/pkg/codec"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The last will of a client is a message the broker publishes on its behalf
+// when its connection ends without a Disconnect: it timed out, broke, or
+// was closed for an error. It is registered with these Connect.Props keys.
+// The will of a connection taken over by another one of the same client, or
+// closed by the server stopping, is dropped.
+const (
+	// WillTopicProp is the topic of the will. The other keys are ignored
+	// without it.
+	WillTopicProp = "qrpc-will-topic"
+	// WillPayloadProp is the payload of the will, as is.
+	WillPayloadProp = "qrpc-will-payload-bin"
+	// WillQosProp is the QoS of the will, "0" or "1". The default is "0".
+	WillQosProp = "qrpc-will-qos"
+	// WillRetainProp makes the will retained, whatever its value.
+	WillRetainProp = "qrpc-will-retain"
+)
+
+// lastWill is the will of a connection.
+type lastWill struct {
+	pub *codec.Publish
+	qos codec.QosLevel
+}
+
+var errBadWill = errors.New("qrpc: malformed will")
+
+// parseWill returns the will registered in p, nil if there is none.
+func parseWill(p codec.Props) (*lastWill, error) {
+	v := p[WillTopicProp]
+	if len(v) == 0 {
+		return nil, nil
+	}
+	if !broker.ValidTopic(v[0]) {
+		return nil, errBadWill
+	}
+	w := &lastWill{pub: &codec.Publish{Path: v[0]}}
+	if v := p[WillPayloadProp]; len(v) > 0 && v[0] != "" {
+		w.pub.Payload = codec.SlicePayload(v[0])
+	}
+	if v := p[WillQosProp]; len(v) > 0 {
+		switch v[0] {
+		case "0":
+		case "1":
+			w.qos = codec.QosAtLeastOnce
+		default:
+			return nil, errBadWill
+		}
+	}
+	_, w.pub.Retain = p[WillRetainProp]
+	return w, nil
+}
+
+// willOptions is the will a client registers, see WithLastWill.
+type willOptions struct {
+	topic string
+	msg   any
+	po    pushOptions
+}
+
+// addProps adds the Connect.Props registering the will to p.
+func (w *willOptions) addProps(p codec.Props) error {
+	bf, err := EncodePayload(w.msg, false)
+	if err != nil {
+		return status.Errorf(codes.Internal, "qrpc: error while marshaling the will: %v", err)
+	}
+	defer freeBuffer(bf)
+
+	p[WillTopicProp] = []string{w.topic}
+	if bf != nil {
+		p[WillPayloadProp] = []string{string(bf.ReadOnlyData())}
+	}
+	if w.po.qos == codec.QosAtLeastOnce {
+		p[WillQosProp] = []string{"1"}
+	}
+	if w.po.retain {
+		p[WillRetainProp] = []string{"1"}
+	}
+	return nil
+}
+
+// publishWill publishes the will of c, if it left one. A client closing its
+// connection with NoError disconnected too, even if the server did not get
+// its Disconnect first.
+func (s *Server) publishWill(c *qrpcConn) {
+	w := c.will.Swap(nil)
+	if w == nil || s.topics == nil || s.quit.HasFired() {
+		return
+	}
+	var appErr *quic.ApplicationError
+	if errors.As(context.Cause(c.conn.Context()), &appErr) && appErr.Remote && appErr.ErrorCode == CloseReason(NoError).code() {
+		return
+	}
+	s.publishTopic(w.pub, w.qos)
+}
@@ -0,0 +1,79 @@
+package qrpc
+
+import (
+	"context"
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/stonefire-oss/stonefire-im/demo/pb"
+	"github.com/stonefire-oss/stonefire-im/pkg/codec"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestServer_LastWill(t *testing.T) {
+	tests := []struct {
+		name string
+		// end ends the connection of the client, dial dials another one.
+		end  func(cc *ClientConn, dial func() *ClientConn)
+		want bool
+	}{
+		{
+			name: "connection lost",
+			end:  func(cc *ClientConn, dial func() *ClientConn) { cc.conn.CloseWithError(0x1, "crash") },
+			want: true,
+		},
+		{
+			name: "disconnected",
+			end:  func(cc *ClientConn, dial func() *ClientConn) { cc.Close() },
+		},
+		{
+			name: "taken over",
+			end:  func(cc *ClientConn, dial func() *ClientConn) { dial() },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, addr := newTestServer(t, EnableBroker(true))
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+			defer cancel()
+
+			received := make(chan string, 1)
+			sub := topicClient(t, addr, "bob", received)
+			if _, err := sub.Subscribe(ctx, codec.TopicQos{Topic: "presence/#", Qos: codec.QosAtLeastOnce}); err != nil {
+				t.Fatalf("Subscribe() error = %v", err)
+			}
+
+			dial := func() *ClientConn {
+				return newTestClient(t, addr, WithClientId("alice"), WithLastWill("presence/alice", &pb.Student{Name: "offline"}))
+			}
+			tt.end(dial(), dial)
+
+			select {
+			case got := <-received:
+				if !tt.want {
+					t.Errorf("will published: %q", got)
+				} else if got != "presence/alice offline" {
+					t.Errorf("will = %q, want %q", got, "presence/alice offline")
+				}
+			case <-time.After(time.Millisecond * 300):
+				if tt.want {
+					t.Error("the will was not published")
+				}
+			}
+		})
+	}
+}
+
+func TestServer_BadWill(t *testing.T) {
+	_, addr := newTestServer(t, EnableBroker(true))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	tlsConf := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{testALPN}}
+	_, err := Dial(ctx, addr, tlsConf, WithConnectProps(codec.Props{WillTopicProp: {"presence/+"}}))
+	if c := status.Code(err); c != codes.InvalidArgument {
+		t.Errorf("Dial() code = %v, want %v (%v)", c, codes.InvalidArgument, err)
+	}
+}
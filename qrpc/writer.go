@@ -0,0 +1,163 @@
+package qrpc
+
+import (
+	"io"
+	"sync"
+
+	"github.com/stonefire-oss/stonefire-im/pkg/codec"
+	"google.golang.org/grpc/mem"
+)
+
+// writeCopyThreshold is the size from which a payload is written from its
+// own buffer instead of being copied.
+const writeCopyThreshold = 16 << 10
+
+// frameWriter writes whole frames to a stream on behalf of concurrent
+// senders.
+//
+// A sender which finds the writer idle becomes the one writing: it writes its
+// frame along with the frames queued meanwhile by the others, coalesced into
+// as few Writes as possible, until the queue is empty. The others only queue
+// their frame and wait for it to be written. The lock is never held during a
+// Write, and frames never interleave on the wire.
+//
+// The heads and the small payloads are copied into a single buffer, a payload
+// of writeCopyThreshold bytes or more is written from its own buffer.
+type frameWriter struct {
+	w    io.Writer
+	pool mem.BufferPool
+
+	mu      sync.Mutex
+	queue   []*queuedFrame
+	writing bool
+	// err is the first write error, every later frame fails with it.
+	err error
+}
+
+type queuedFrame struct {
+	data mem.BufferSlice
+	err  error
+	// done is closed once the frame is written, nil for the frames of the
+	// sender writing them.
+	done chan struct{}
+}
+
+func newFrameWriter(w io.Writer, pool mem.BufferPool) *frameWriter {
+	return &frameWriter{w: w, pool: pool}
+}
+
+// WriteMessage writes msg as one frame and returns once it is on the stream.
+// The payload of msg is not copied before, it must stay valid until then.
+func (fw *frameWriter) WriteMessage(msg codec.Message) error {
+	return fw.WriteMessageFunc(func() (codec.Message, error) {
+		return msg, nil
+	})
+}
+
+// WriteMessageFunc writes the message returned by build like WriteMessage.
+// build is called in the order the frames go out, so that it can decide what
+// a frame carries depending on the frames before it.
+func (fw *frameWriter) WriteMessageFunc(build func() (codec.Message, error)) error {
+	fw.mu.Lock()
+	if fw.err != nil {
+		fw.mu.Unlock()
+		return fw.err
+	}
+	f, err := newQueuedFrame(build)
+	if err != nil {
+		fw.mu.Unlock()
+		return err
+	}
+	fw.queue = append(fw.queue, f)
+	if fw.writing {
+		f.done = make(chan struct{})
+		fw.mu.Unlock()
+		<-f.done
+		return f.err
+	}
+
+	fw.writing = true
+	for len(fw.queue) > 0 {
+		batch := fw.queue
+		fw.queue = nil
+
+		err := fw.err
+		if err == nil {
+			fw.mu.Unlock()
+			err = fw.write(batch)
+			fw.mu.Lock()
+			if err != nil {
+				fw.err = err
+			}
+		}
+		for _, qf := range batch {
+			qf.err = err
+			if qf.done != nil {
+				close(qf.done)
+			}
+		}
+	}
+	fw.writing = false
+	fw.mu.Unlock()
+	return f.err
+}
+
+func newQueuedFrame(build func() (codec.Message, error)) (*queuedFrame, error) {
+	msg, err := build()
+	if err != nil {
+		return nil, err
+	}
+	head, pl, err := codec.EncodeHead(msg)
+	if err != nil {
+		return nil, err
+	}
+	f := &queuedFrame{data: mem.BufferSlice{mem.SliceBuffer(head)}}
+	if pl != nil && pl.Len() > 0 {
+		f.data = append(f.data, payloadBuffer(pl))
+	}
+	return f, nil
+}
+
+// write writes the frames of batch, the buffers smaller than
+// writeCopyThreshold coalesced into a single Write.
+func (fw *frameWriter) write(batch []*queuedFrame) error {
+	var small mem.BufferSlice
+	flush := func() error {
+		var err error
+		switch len(small) {
+		case 0:
+		case 1:
+			_, err = fw.w.Write(small[0].ReadOnlyData())
+		default:
+			buf := small.MaterializeToBuffer(fw.pool)
+			_, err = fw.w.Write(buf.ReadOnlyData())
+			buf.Free()
+		}
+		small = small[:0]
+		return err
+	}
+	for _, qf := range batch {
+		for _, b := range qf.data {
+			if b.Len() < writeCopyThreshold {
+				small = append(small, b)
+				continue
+			}
+			if err := flush(); err != nil {
+				return err
+			}
+			if _, err := fw.w.Write(b.ReadOnlyData()); err != nil {
+				return err
+			}
+		}
+	}
+	return flush()
+}
+
+// payloadBuffer returns pl as a mem.Buffer, without copying it. The buffer is
+// not referenced, the caller keeps ownership of pl.
+func payloadBuffer(pl codec.Payload) mem.Buffer {
+	if b, ok := pl.(mem.Buffer); ok {
+		return b
+	}
+	return mem.SliceBuffer(pl.ReadOnlyData())
+}
@@ -0,0 +1,118 @@
+package qrpc
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stonefire-oss/stonefire-im/pkg/codec"
+	"google.golang.org/grpc/mem"
+)
+
+// slowWriter records every Write, taking some time for each so that senders
+// pile up behind the one writing.
+type slowWriter struct {
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	writes int
+	active bool
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	if w.active {
+		w.mu.Unlock()
+		return 0, fmt.Errorf("concurrent Write")
+	}
+	w.active = true
+	w.mu.Unlock()
+
+	time.Sleep(time.Millisecond)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.active = false
+	w.writes++
+	return w.buf.Write(p)
+}
+
+func TestFrameWriter_Concurrent(t *testing.T) {
+	w := &slowWriter{}
+	fw := newFrameWriter(w, mem.DefaultBufferPool())
+
+	const senders, frames = 8, 50
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < frames; j++ {
+				pub := &codec.Publish{
+					Path:    fmt.Sprintf("/%d", i),
+					Payload: codec.SlicePayload(bytes.Repeat([]byte{byte(i)}, 100+j)),
+				}
+				if err := fw.WriteMessage(pub); err != nil {
+					t.Errorf("WriteMessage() error = %v", err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	next := make([]int, senders)
+	for w.buf.Len() > 0 {
+		msg, err := codec.DecodeOneMessage(&w.buf, codec.SlicePayloadBuiler{})
+		if err != nil {
+			t.Fatalf("DecodeOneMessage() error = %v", err)
+		}
+		pub := msg.(*codec.Publish)
+		var i int
+		fmt.Sscanf(pub.Path, "/%d", &i)
+		want := bytes.Repeat([]byte{byte(i)}, 100+next[i])
+		if !bytes.Equal(pub.Payload.ReadOnlyData(), want) {
+			t.Fatalf("frame %d of sender %d is corrupted", next[i], i)
+		}
+		next[i]++
+	}
+	for i, n := range next {
+		if n != frames {
+			t.Errorf("sender %d: %d frames written, want %d", i, n, frames)
+		}
+	}
+	if w.writes >= senders*frames {
+		t.Errorf("%d writes for %d frames, want them coalesced", w.writes, senders*frames)
+	}
+}
+
+// recordingWriter keeps the slices it is given.
+type recordingWriter struct {
+	writes [][]byte
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.writes = append(w.writes, p)
+	return len(p), nil
+}
+
+func TestFrameWriter_LargePayloadNotCopied(t *testing.T) {
+	w := &recordingWriter{}
+	fw := newFrameWriter(w, mem.DefaultBufferPool())
+	payload := bytes.Repeat([]byte{1}, writeCopyThreshold)
+	if err := fw.WriteMessage(&codec.Publish{Path: "/large", Payload: codec.SlicePayload(payload)}); err != nil {
+		t.Fatalf("WriteMessage() error = %v", err)
+	}
+	if len(w.writes) != 2 || &w.writes[1][0] != &payload[0] {
+		t.Errorf("the payload was copied before being written")
+	}
+	var buf bytes.Buffer
+	for _, p := range w.writes {
+		buf.Write(p)
+	}
+	msg, err := codec.DecodeOneMessage(&buf, codec.SlicePayloadBuiler{})
+	if pub, ok := msg.(*codec.Publish); err != nil || !ok || !bytes.Equal(pub.Payload.ReadOnlyData(), payload) {
+		t.Errorf("DecodeOneMessage() = %v, %v, want the frame written", msg, err)
+	}
+}